@@ -0,0 +1,239 @@
+package files
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"evalgo.org/evmsg"
+	"github.com/minio/minio-go/v6"
+)
+
+var ArchiveFilePath string = "/v0.0.1/files/buckets/:bucket/archive"
+var ArchiveManifestFile string = "manifest.json"
+
+// ArchiveContentType returns the content type and file extension of a supported archive format
+func ArchiveContentType(format string) (string, string, error) {
+	switch format {
+	case "", "zip":
+		return "application/zip", ".zip", nil
+	case "tar.gz", "tgz":
+		return "application/gzip", ".tar.gz", nil
+	}
+	return "", "", errors.New("the given archive format <" + format + "> is not supported!")
+}
+
+// ArchiveEntry is an object of an archive, the entries keep the time the object was
+// last modified so the same objects always give the same archive
+type ArchiveEntry struct {
+	Key      string
+	Modified time.Time
+}
+
+// ArchiveKeys resolves the objects of a bucket that belong into an archive,
+// an explicit key list takes precedence over the prefix. The explicit keys are
+// checked up front, a missing or unreadable key fails before anything is sent
+func ArchiveKeys(s Storage, bucket, prefix string, keys []string) ([]ArchiveEntry, error) {
+	if len(keys) == 0 {
+		return archiveList(s, bucket, prefix, "")
+	}
+	entries := []ArchiveEntry{}
+	for _, key := range keys {
+		found, err := archiveList(s, bucket, key, key)
+		if err != nil {
+			return nil, err
+		}
+		if len(found) == 0 {
+			return nil, commandError(http.StatusNotFound, errors.New("the key <"+key+"> does not exist!"))
+		}
+		obj, _, err := s.ReadObject(bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		obj.Close()
+		entries = append(entries, found[0])
+	}
+	return entries, nil
+}
+
+// archiveList lists the objects of a prefix, only the exact key if one is given
+func archiveList(s Storage, bucket, prefix, exact string) ([]ArchiveEntry, error) {
+	msg, err := s.ListObjects(minio.BucketInfo{Name: bucket}, prefix)
+	if err != nil {
+		return nil, err
+	}
+	entries := []ArchiveEntry{}
+	list, _ := msg.Data.([]interface{})
+	for _, obj := range list {
+		info := obj.(map[string]interface{})
+		key := info["key"].(string)
+		if exact != "" && key != exact {
+			continue
+		}
+		modified, _ := info["modified"].(time.Time)
+		if modified.IsZero() {
+			modified = time.Unix(0, 0)
+		}
+		entries = append(entries, ArchiveEntry{Key: key, Modified: modified.UTC()})
+	}
+	return entries, nil
+}
+
+// archiveModified is the time of the manifest, the newest entry
+func archiveModified(entries []ArchiveEntry) time.Time {
+	modified := time.Unix(0, 0).UTC()
+	for _, entry := range entries {
+		if entry.Modified.After(modified) {
+			modified = entry.Modified
+		}
+	}
+	return modified
+}
+
+// WriteArchive streams the given objects of a bucket as zip or tar.gz into w,
+// nothing is staged on disk, every entry is read from the storage and copied through
+func WriteArchive(w io.Writer, s Storage, format, bucket string, entries []ArchiveEntry, manifest bool) error {
+	if _, _, err := ArchiveContentType(format); err != nil {
+		return err
+	}
+	flusher, _ := w.(http.Flusher)
+	metas := map[string]map[string]string{}
+	switch format {
+	case "", "zip":
+		zw := zip.NewWriter(w)
+		for _, entry := range entries {
+			key := entry.Key
+			obj, _, err := s.ReadObject(bucket, key)
+			if err != nil {
+				return err
+			}
+			fw, err := zw.CreateHeader(&zip.FileHeader{Name: key, Method: zip.Deflate, Modified: entry.Modified})
+			if err != nil {
+				obj.Close()
+				return err
+			}
+			_, err = io.Copy(fw, obj)
+			obj.Close()
+			if err != nil {
+				return err
+			}
+			if manifest {
+				metas[key] = archiveMeta(s, key)
+			}
+			if flusher != nil {
+				zw.Flush()
+				flusher.Flush()
+			}
+		}
+		if manifest {
+			mB, err := json.Marshal(metas)
+			if err != nil {
+				return err
+			}
+			fw, err := zw.CreateHeader(&zip.FileHeader{Name: ArchiveManifestFile, Method: zip.Deflate, Modified: archiveModified(entries)})
+			if err != nil {
+				return err
+			}
+			if _, err := fw.Write(mB); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	default:
+		gw := gzip.NewWriter(w)
+		tw := tar.NewWriter(gw)
+		for _, entry := range entries {
+			key := entry.Key
+			obj, size, err := s.ReadObject(bucket, key)
+			if err != nil {
+				return err
+			}
+			err = tw.WriteHeader(&tar.Header{Name: key, Mode: 0644, Size: size, ModTime: entry.Modified})
+			if err != nil {
+				obj.Close()
+				return err
+			}
+			_, err = io.Copy(tw, obj)
+			obj.Close()
+			if err != nil {
+				return err
+			}
+			if manifest {
+				metas[key] = archiveMeta(s, key)
+			}
+			if flusher != nil {
+				tw.Flush()
+				gw.Flush()
+				flusher.Flush()
+			}
+		}
+		if manifest {
+			mB, err := json.Marshal(metas)
+			if err != nil {
+				return err
+			}
+			err = tw.WriteHeader(&tar.Header{Name: ArchiveManifestFile, Mode: 0644, Size: int64(len(mB)), ModTime: archiveModified(entries)})
+			if err != nil {
+				return err
+			}
+			if _, err := tw.Write(mB); err != nil {
+				return err
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return gw.Close()
+	}
+}
+
+// ArchiveDownloadPath returns the REST path a client can use to download an archive
+func ArchiveDownloadPath(bucket, format, prefix string, keys []string, manifest bool) string {
+	q := url.Values{}
+	if format != "" {
+		q.Set("format", format)
+	}
+	if prefix != "" {
+		q.Set("prefix", prefix)
+	}
+	if len(keys) > 0 {
+		// keys may contain commas, every key is a value of its own
+		q["keys"] = keys
+	}
+	if manifest {
+		q.Set("manifest", "true")
+	}
+	path := strings.Replace(ArchiveFilePath, ":bucket", bucket, 1)
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	return path
+}
+
+// ArchiveMessage answers the websocket archive command with the download path
+func ArchiveMessage(bucket, format, prefix string, keys []string, manifest bool) (*evmsg.Message, error) {
+	msg := evmsg.NewMessage()
+	msg.State = "Response"
+	if _, _, err := ArchiveContentType(format); err != nil {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	msg.Data = []interface{}{
+		map[string]interface{}{
+			"path": ArchiveDownloadPath(bucket, format, prefix, keys, manifest),
+		},
+	}
+	return msg, nil
+}
+
+func archiveMeta(s Storage, key string) map[string]string {
+	meta, _ := GetMeta(s, key)
+	return meta
+}
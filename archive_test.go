@@ -0,0 +1,247 @@
+package files
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"evalgo.org/evmsg"
+	echo "github.com/labstack/echo/v4"
+	"github.com/minio/minio-go/v6"
+)
+
+// memModified is the last modification time of every object of the memStorage
+var memModified = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// errMemNotFound is the error of MinIO for a missing object
+var errMemNotFound = minio.ErrorResponse{Code: "NoSuchKey", Message: "The specified key does not exist."}
+
+// memStorage is an in memory storage used by the unit tests
+type memStorage struct {
+	objects map[string]map[string][]byte
+	// reads counts the calls of ReadObject
+	reads int64
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{objects: map[string]map[string][]byte{"meta": {}}}
+}
+
+func (s *memStorage) put(bucket, file string, data []byte) {
+	if _, ok := s.objects[bucket]; !ok {
+		s.objects[bucket] = map[string][]byte{}
+	}
+	s.objects[bucket][file] = data
+}
+
+func (s *memStorage) CreateBucket(bucket string) (*evmsg.Message, error) {
+	s.objects[bucket] = map[string][]byte{}
+	return evmsg.NewMessage(), nil
+}
+
+func (s *memStorage) ListBuckets() (*evmsg.Message, error) {
+	msg := evmsg.NewMessage()
+	msg.Data = []interface{}{}
+	for name := range s.objects {
+		msg.Data = append(msg.Data.([]interface{}), map[string]interface{}{"name": name})
+	}
+	return msg, nil
+}
+
+func (s *memStorage) ListObjects(bucket minio.BucketInfo, prefix string) (*evmsg.Message, error) {
+	msg := evmsg.NewMessage()
+	keys := []string{}
+	for key := range s.objects[bucket.Name] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	data := []interface{}{}
+	for _, key := range keys {
+		data = append(data, map[string]interface{}{"key": key, "size": int64(len(s.objects[bucket.Name][key])), "bucket": bucket.Name, "modified": memModified})
+	}
+	msg.Data = data
+	return msg, nil
+}
+
+func (s *memStorage) GetObject(bucket, file string) (*evmsg.Message, error) {
+	msg := evmsg.NewMessage()
+	if _, ok := s.objects[bucket][file]; !ok {
+		return msg, errMemNotFound
+	}
+	msg.Data = []interface{}{map[string]interface{}{"path": bucket + "/" + file}}
+	return msg, nil
+}
+
+func (s *memStorage) GetThumbnail(bucket, file string) ([]byte, error) {
+	return s.objects[bucket][file], nil
+}
+
+func (s *memStorage) ReadObject(bucket, file string) (io.ReadCloser, int64, error) {
+	atomic.AddInt64(&s.reads, 1)
+	data, ok := s.objects[bucket][file]
+	if !ok {
+		return nil, 0, errMemNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func (s *memStorage) ReadCache(cached string) (io.ReadCloser, error) {
+	return os.Open(cached)
+}
+
+func (s *memStorage) WriteCache(cached string, r io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(cached), 0700)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cached, data, 0600)
+}
+
+func (s *memStorage) PutObject(bucket string, file *multipart.FileHeader) error {
+	src, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	s.put(bucket, file.Filename, data)
+	return nil
+}
+
+func (s *memStorage) RemoveObject(bucket, file string) (*evmsg.Message, error) {
+	delete(s.objects[bucket], file)
+	return evmsg.NewMessage(), nil
+}
+
+func Test_Unit_WriteArchiveZip(t *testing.T) {
+	s := newMemStorage()
+	s.put("test", "a/one.jpg", []byte("one"))
+	s.put("test", "a/two.png", []byte("two"))
+	s.put("test", "b/three.jpg", []byte("three"))
+	s.put("meta", "a/one.json", []byte(`{"description":"first"}`))
+	keys, err := ArchiveKeys(s, "test", "a/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buff := bytes.NewBuffer(nil)
+	err = WriteArchive(buff, s, "zip", "test", keys, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buff.Bytes()), int64(buff.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, ",") != "a/one.jpg,a/two.png,"+ArchiveManifestFile {
+		t.Error("unexpected zip entries", names)
+	}
+	again := bytes.NewBuffer(nil)
+	WriteArchive(again, s, "zip", "test", keys, true)
+	if !bytes.Equal(buff.Bytes(), again.Bytes()) {
+		t.Error("the same objects have to give the same archive")
+	}
+}
+
+func Test_Unit_WriteArchiveTarGz(t *testing.T) {
+	s := newMemStorage()
+	s.put("test", "one.jpg", []byte("one"))
+	s.put("test", "two.png", []byte("two"))
+	buff := bytes.NewBuffer(nil)
+	entries, err := ArchiveKeys(s, "test", "", []string{"two.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteArchive(buff, s, "tar.gz", "test", entries, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gr, err := gzip.NewReader(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(tr)
+	if hdr.Name != "two.png" || string(data) != "two" || !hdr.ModTime.Equal(memModified) {
+		t.Error("unexpected tar entry", hdr.Name, string(data))
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Error("expected a single tar entry")
+	}
+}
+
+func Test_Unit_ArchiveMissingKey(t *testing.T) {
+	s := newMemStorage()
+	s.put("test", "one.jpg", []byte("one"))
+	_, err := ArchiveKeys(s, "test", "", []string{"one.jpg", "one"})
+	if cErr, ok := err.(*CommandError); !ok || cErr.Status != http.StatusNotFound {
+		t.Error("a missing key has to be not found", err)
+	}
+	f := &Files{WSStorage: s, WSClient: "files", WSSecret: "secret"}
+	e := echo.New()
+	e.GET(ArchiveFilePath, f.serveArchive)
+	for path, status := range map[string]int{"/v0.0.1/files/buckets/test/archive?keys=one.jpg&keys=one": http.StatusNotFound, "/v0.0.1/files/buckets/meta/archive": http.StatusForbidden} {
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Error("unexpected status", path, w.Code)
+		}
+	}
+}
+
+func Test_Unit_ArchiveKeysWithCommas(t *testing.T) {
+	s := newMemStorage()
+	s.put("test", "a,b.jpg", []byte("ab"))
+	s.put("test", "c.jpg", []byte("c"))
+	f := &Files{WSStorage: s, WSClient: "files", WSSecret: "secret"}
+	e := echo.New()
+	e.GET(ArchiveFilePath, f.serveArchive)
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", ArchiveDownloadPath("test", "zip", "", []string{"a,b.jpg", "c.jpg"}, false), nil))
+	if w.Code != http.StatusOK {
+		t.Fatal("unexpected status", w.Code, w.Body.String())
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 2 || zr.File[0].Name != "a,b.jpg" {
+		t.Error("expected both keys in the archive", zr.File)
+	}
+}
+
+func Test_Unit_ArchiveUnsupportedFormat(t *testing.T) {
+	_, err := ArchiveMessage("test", "rar", "", nil, false)
+	if err == nil {
+		t.Error("expected an error for an unsupported format")
+	}
+}
@@ -0,0 +1,372 @@
+package files
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"evalgo.org/evmsg"
+	echo "github.com/labstack/echo/v4"
+	"github.com/neko-neko/echo-logrus/v2/log"
+)
+
+var (
+	// AuditMaxSize rotates the audit log once it grows beyond these bytes
+	AuditMaxSize int64 = 100 << 20
+	// AuditMaxFiles is the number of rotated files kept besides the current one
+	AuditMaxFiles int = 10
+)
+
+// AuditEntry records who accessed or changed what, when and with which result
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Identity string    `json:"identity"`
+	Action   string    `json:"action"`
+	Bucket   string    `json:"bucket,omitempty"`
+	Key      string    `json:"key,omitempty"`
+	Size     int64     `json:"size"`
+	Result   string    `json:"result"`
+	Status   int       `json:"status"`
+	Client   string    `json:"client"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// AuditLog appends the entries to a file and rotates it, rotated files are never written again
+type AuditLog struct {
+	path string
+	mu   sync.Mutex
+	fd   *os.File
+	size int64
+}
+
+// OpenAuditLog opens the audit log for appending, the directory is created if needed
+func OpenAuditLog(path string) (*AuditLog, error) {
+	// without a size every entry rotates the file, without files the rotation removes the history
+	if AuditMaxSize <= 0 || AuditMaxFiles <= 0 {
+		return nil, errors.New("the audit log needs a max size and a number of rotated files above 0!")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	a := &AuditLog{path: path}
+	return a, a.open()
+}
+
+func (a *AuditLog) open() error {
+	fd, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	a.fd, a.size = fd, info.Size()
+	return nil
+}
+
+// Record appends an entry, a log without a file records nothing
+func (a *AuditLog) Record(entry AuditEntry) error {
+	if a == nil {
+		return nil
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	eB, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	eB = append(eB, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.fd == nil {
+		return errors.New("the audit log is closed!")
+	}
+	if a.size > 0 && a.size+int64(len(eB)) > AuditMaxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.fd.Write(eB)
+	a.size += int64(n)
+	return err
+}
+
+// rotate renames the current file with its rotation time and removes the oldest files beyond AuditMaxFiles
+func (a *AuditLog) rotate() error {
+	if err := a.fd.Close(); err != nil {
+		return err
+	}
+	a.fd = nil
+	err := os.Rename(a.path, a.path+"."+time.Now().UTC().Format("20060102T150405.000000000"))
+	if err != nil {
+		return err
+	}
+	rotated, err := a.rotated()
+	if err != nil {
+		return err
+	}
+	for len(rotated) > AuditMaxFiles {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return a.open()
+}
+
+// rotated returns the rotated files, the oldest first
+func (a *AuditLog) rotated() ([]string, error) {
+	files, err := filepath.Glob(a.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Close closes the current file, later entries are rejected
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.fd == nil {
+		return nil
+	}
+	err := a.fd.Close()
+	a.fd = nil
+	return err
+}
+
+// AuditQuery filters the entries of the audit log, empty fields match everything
+type AuditQuery struct {
+	Identity string
+	Action   string
+	Bucket   string
+	Key      string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+func (q AuditQuery) matches(entry *AuditEntry) bool {
+	return (q.Identity == "" || entry.Identity == q.Identity) &&
+		(q.Action == "" || entry.Action == q.Action) &&
+		(q.Bucket == "" || entry.Bucket == q.Bucket) &&
+		(q.Key == "" || strings.HasPrefix(entry.Key, q.Key)) &&
+		(q.Since.IsZero() || !entry.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || entry.Time.Before(q.Until))
+}
+
+// Query returns the latest matching entries in the order they were recorded
+func (a *AuditLog) Query(q AuditQuery) ([]AuditEntry, error) {
+	if q.Limit <= 0 || q.Limit > 1000 {
+		q.Limit = 1000
+	}
+	a.mu.Lock()
+	files, err := a.rotated()
+	a.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	entries := []AuditEntry{}
+	for _, file := range append(files, a.path) {
+		fd, err := os.Open(file)
+		if os.IsNotExist(err) {
+			// rotated away while reading
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		lines := bufio.NewScanner(fd)
+		lines.Buffer(make([]byte, 64*1024), 1<<20)
+		for lines.Scan() {
+			entry := AuditEntry{}
+			if json.Unmarshal(lines.Bytes(), &entry) != nil || !q.matches(&entry) {
+				continue
+			}
+			entries = append(entries, entry)
+			if len(entries) > q.Limit {
+				entries = entries[1:]
+			}
+		}
+		err = lines.Err()
+		fd.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// auditTime reads the bounds of a query, an empty bound is open
+func auditTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// AuditMessage answers a query of the admin Audit scope
+func (a *AuditLog) AuditMessage(q AuditQuery) (*evmsg.Message, error) {
+	msg := evmsg.NewMessage()
+	msg.State = "Response"
+	entries, err := a.Query(q)
+	if err != nil {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	list := make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		item := map[string]interface{}{}
+		if err := convert(entry, &item); err != nil {
+			return msg, err
+		}
+		list = append(list, item)
+	}
+	msg.Data = list
+	return msg, nil
+}
+
+// audit records an entry, a failing audit log is logged but does not fail the request
+func (f *Files) audit(entry AuditEntry) {
+	if err := f.WSAudit.Record(entry); err != nil {
+		log.Logger().Error(err)
+	}
+}
+
+// auditResult names the outcome of a status for the entries
+func auditResult(status int) string {
+	switch {
+	case status < 400:
+		return "ok"
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return "denied"
+	case status == http.StatusTooManyRequests:
+		return "rate_limited"
+	}
+	return "error"
+}
+
+type auditClientKey struct{}
+
+// contextWithClient remembers the address of a client for the commands it sends
+func contextWithClient(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, auditClientKey{}, remoteAddr(r))
+}
+
+func clientFromContext(ctx context.Context) string {
+	client, _ := ctx.Value(auditClientKey{}).(string)
+	return client
+}
+
+// remoteAddr returns the address of the client without the port
+func remoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// auditCommand records a dispatched command
+func (f *Files) auditCommand(ctx context.Context, identity, scope, command, bucket, key string, err error) {
+	if f.WSAudit == nil {
+		return
+	}
+	entry := AuditEntry{Identity: identity, Action: scope + "/" + command, Bucket: bucket, Key: key, Result: "ok", Status: http.StatusOK, Client: clientFromContext(ctx)}
+	if err != nil {
+		entry.Result, entry.Status, entry.Error = "error", http.StatusInternalServerError, err.Error()
+		if cErr, ok := err.(*CommandError); ok {
+			if cErr.Status != 0 {
+				entry.Status = cErr.Status
+			}
+			if cErr.Code != "" {
+				entry.Result = cErr.Code
+			}
+		}
+	}
+	f.audit(entry)
+}
+
+// Audit is the echo middleware recording the routes outside of the commands under an action
+func (f *Files) Audit(action string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if f.WSAudit == nil {
+				return next(c)
+			}
+			err := next(c)
+			r := c.Request()
+			entry := AuditEntry{Identity: f.Identity(r), Action: action, Bucket: c.Param("bucket"), Key: c.Param("object"), Size: c.Response().Size, Status: c.Response().Status, Client: remoteAddr(r)}
+			if entry.Key == "" {
+				entry.Key = restFile(c)
+			}
+			if r.MultipartForm != nil && len(r.MultipartForm.File["file"]) > 0 {
+				file := r.MultipartForm.File["file"][0]
+				entry.Key, entry.Size = file.Filename, file.Size
+			}
+			if he, ok := err.(*echo.HTTPError); ok {
+				entry.Status = he.Code
+			}
+			if err != nil {
+				entry.Error = err.Error()
+			}
+			entry.Result = auditResult(entry.Status)
+			f.audit(entry)
+			return err
+		}
+	}
+}
+
+// auditRequest is filled by the handlers outside of echo once they know the identity
+type auditRequest struct {
+	identity string
+}
+
+type auditRequestKey struct{}
+
+// auditIdentity tells the audit log the identity a handler authenticated
+func auditIdentity(ctx context.Context, identity string) {
+	if req, ok := ctx.Value(auditRequestKey{}).(*auditRequest); ok {
+		req.identity = identity
+	}
+}
+
+// audited records the requests of the S3 API and WebDAV, the first segment after the prefix is the bucket
+func (f *Files) audited(route, prefix string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f.WSAudit == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		req := &auditRequest{}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), auditRequestKey{}, req)))
+		path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		parts := strings.SplitN(path, "/", 2)
+		entry := AuditEntry{Identity: req.identity, Action: route + "/" + r.Method, Bucket: parts[0], Status: rec.status, Result: auditResult(rec.status), Client: remoteAddr(r)}
+		if len(parts) == 2 {
+			entry.Key = parts[1]
+		}
+		entry.Size = rec.written
+		if r.Method != http.MethodGet && r.ContentLength > 0 {
+			entry.Size = r.ContentLength
+		}
+		f.audit(entry)
+	})
+}
@@ -0,0 +1,152 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"evalgo.org/evmsg"
+	echo "github.com/labstack/echo/v4"
+)
+
+func Test_Unit_AuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maxSize, maxFiles := AuditMaxSize, AuditMaxFiles
+	AuditMaxSize, AuditMaxFiles = 400, 2
+	defer func() { AuditMaxSize, AuditMaxFiles = maxSize, maxFiles }()
+	a, err := OpenAuditLog(filepath.Join(dir, "log", "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().UTC().Add(-time.Hour)
+	for i := 0; i < 20; i++ {
+		identity := "alice"
+		if i%2 == 1 {
+			identity = "bob"
+		}
+		entry := AuditEntry{Time: start.Add(time.Duration(i) * time.Minute), Identity: identity, Action: "Object/download", Bucket: "docs", Key: "file" + strconv.Itoa(i) + ".txt", Result: "ok", Status: http.StatusOK}
+		if err := a.Record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotated, _ := a.rotated()
+	if len(rotated) != 2 {
+		t.Error("only the newest rotated files have to be kept", rotated)
+	}
+	all, err := a.Query(AuditQuery{})
+	if err != nil || len(all) == 0 || all[len(all)-1].Key != "file19.txt" {
+		t.Fatal("unexpected entries", all, err)
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i].Time.Before(all[i-1].Time) {
+			t.Error("the entries have to be in the order they were recorded")
+		}
+	}
+	bob, _ := a.Query(AuditQuery{Identity: "bob", Since: start.Add(15 * time.Minute), Limit: 1})
+	if len(bob) != 1 || bob[0].Key != "file19.txt" {
+		t.Error("the latest matching entries have to be returned", bob)
+	}
+	a.Close()
+	if err := a.Record(AuditEntry{Action: "late"}); err == nil {
+		t.Error("a closed audit log has to reject entries")
+	}
+}
+
+func Test_Unit_AuditRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, err := OpenAuditLog(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	permissions := IdentityPermissions
+	identities := Identities
+	Identities = map[string]string{"reader": "secret"}
+	IdentityPermissions = map[string]string{"reader": PermissionRead}
+	defer func() { Identities, IdentityPermissions = identities, permissions }()
+	s := newMemStorage()
+	s.put("docs", "old.txt", []byte("old"))
+	f := &Files{WSStorage: s, WSClient: "files", WSSecret: "secret", WSAudit: a}
+	e := echo.New()
+	f.RegisterREST(e)
+
+	body := bytes.NewBuffer(nil)
+	mw := multipart.NewWriter(body)
+	fw, _ := mw.CreateFormFile("file", "notes.txt")
+	fw.Write([]byte("hello"))
+	mw.Close()
+	if w := restDo(e, "POST", "/v1/buckets/docs/objects", body.Bytes(), mw.FormDataContentType()); w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	restDo(e, "DELETE", "/v1/buckets/docs/objects/old.txt", nil, "")
+	msg := evmsg.NewMessage()
+	msg.Scope, msg.Command = "Object", "delete"
+	msg.Data = []interface{}{map[string]interface{}{"bucket": "docs", "file": "notes.txt"}}
+	f.Dispatch(context.Background(), "reader", msg)
+
+	query := evmsg.NewMessage()
+	query.Scope, query.Command = "Audit", "query"
+	if _, err := f.Dispatch(context.Background(), "reader", query); err == nil {
+		t.Error("the audit log is only queryable by admins")
+	}
+	query = evmsg.NewMessage()
+	query.Scope, query.Command = "Audit", "query"
+	query.Data = []interface{}{map[string]interface{}{"bucket": "docs"}}
+	entries, err := f.Dispatch(context.Background(), "files", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := entries.Data.([]interface{})
+	if len(list) != 3 {
+		t.Fatal("unexpected entries", list)
+	}
+	upload := list[0].(map[string]interface{})
+	if upload["action"] != "Object/upload" || upload["key"] != "notes.txt" || upload["size"] != float64(5) || upload["identity"] != "files" || upload["client"] != "192.0.2.1" || upload["result"] != "ok" {
+		t.Error("unexpected upload entry", upload)
+	}
+	remove := list[1].(map[string]interface{})
+	if remove["action"] != "Object/delete" || remove["key"] != "old.txt" || remove["client"] != "192.0.2.1" || remove["status"] != float64(http.StatusOK) {
+		t.Error("unexpected delete entry", remove)
+	}
+	denied := list[2].(map[string]interface{})
+	if denied["identity"] != "reader" || denied["result"] != "forbidden" || denied["status"] != float64(http.StatusForbidden) {
+		t.Error("unexpected denied entry", denied)
+	}
+	query = evmsg.NewMessage()
+	query.Scope, query.Command = "Audit", "query"
+	query.Data = []interface{}{map[string]interface{}{"since": "yesterday"}}
+	if _, err := f.Dispatch(context.Background(), "files", query); err == nil {
+		t.Error("the bounds have to be RFC 3339 times")
+	}
+}
+
+func Test_Unit_AuditLogLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maxSize, maxFiles := AuditMaxSize, AuditMaxFiles
+	defer func() { AuditMaxSize, AuditMaxFiles = maxSize, maxFiles }()
+	for _, limits := range [][2]int{{0, 10}, {100, 0}, {-1, 10}} {
+		AuditMaxSize, AuditMaxFiles = int64(limits[0]), limits[1]
+		if _, err := OpenAuditLog(filepath.Join(dir, "audit.jsonl")); err == nil {
+			t.Error("limits that drop the history have to be rejected", limits)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package files
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"evalgo.org/evmsg"
+	"github.com/minio/minio-go/v6"
+)
+
+var ChecksumDefaultAlgorithm string = "sha256"
+
+// NewChecksumHash returns the hash of a supported checksum algorithm
+func NewChecksumHash(algorithm string) (hash.Hash, error) {
+	switch strings.ToLower(algorithm) {
+	case "sha256":
+		return sha256.New(), nil
+	case "md5":
+		return md5.New(), nil
+	case "crc32c":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	}
+	return nil, errors.New("the given checksum algorithm <" + algorithm + "> is not supported!")
+}
+
+// ParseChecksum splits a checksum of the form <algorithm>:<value> and normalizes
+// the value to lower case hex, base64 encoded values are accepted as well
+func ParseChecksum(checksum string) (string, string, error) {
+	parts := strings.SplitN(checksum, ":", 2)
+	if len(parts) != 2 {
+		return "", "", errors.New("the given checksum <" + checksum + "> is not of the form <algorithm>:<value>!")
+	}
+	algorithm := strings.ToLower(parts[0])
+	h, err := NewChecksumHash(algorithm)
+	if err != nil {
+		return "", "", err
+	}
+	if sum, err := hex.DecodeString(parts[1]); err == nil && len(sum) == h.Size() {
+		return algorithm, hex.EncodeToString(sum), nil
+	}
+	if sum, err := base64.StdEncoding.DecodeString(parts[1]); err == nil && len(sum) == h.Size() {
+		return algorithm, hex.EncodeToString(sum), nil
+	}
+	return "", "", errors.New("the given checksum value <" + parts[1] + "> is not a valid " + algorithm + " sum!")
+}
+
+// ComputeChecksum reads r completely and returns its checksum as <algorithm>:<hex>
+func ComputeChecksum(algorithm string, r io.Reader) (string, error) {
+	h, err := NewChecksumHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return strings.ToLower(algorithm) + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyChecksum compares the content of r with the expected checksum
+func VerifyChecksum(checksum string, r io.Reader) error {
+	algorithm, sum, err := ParseChecksum(checksum)
+	if err != nil {
+		return err
+	}
+	computed, err := ComputeChecksum(algorithm, r)
+	if err != nil {
+		return err
+	}
+	if computed != algorithm+":"+sum {
+		return errors.New("checksum mismatch, expected <" + algorithm + ":" + sum + "> got <" + computed + ">!")
+	}
+	return nil
+}
+
+// UploadChecksum computes the checksum of an upload, if the client provided
+// a checksum the upload is verified against it
+func UploadChecksum(src io.Reader, clientChecksum string) (string, error) {
+	if clientChecksum == "" {
+		return ComputeChecksum(ChecksumDefaultAlgorithm, src)
+	}
+	algorithm, sum, err := ParseChecksum(clientChecksum)
+	if err != nil {
+		return "", err
+	}
+	computed, err := ComputeChecksum(algorithm, src)
+	if err != nil {
+		return "", err
+	}
+	if computed != algorithm+":"+sum {
+		return "", errors.New("checksum mismatch, the client sent <" + algorithm + ":" + sum + "> but the upload has <" + computed + ">!")
+	}
+	return computed, nil
+}
+
+// VerifyBucket re-reads every object of a bucket below prefix from the storage
+// and checks it against the checksum stored in the meta information
+func VerifyBucket(s Storage, bucket, prefix string) (*evmsg.Message, error) {
+	msg, err := s.ListObjects(minio.BucketInfo{Name: bucket}, prefix)
+	if err != nil {
+		return msg, err
+	}
+	list, _ := msg.Data.([]interface{})
+	report := []interface{}{}
+	for _, obj := range list {
+		key := obj.(map[string]interface{})["key"].(string)
+		entry := map[string]interface{}{"bucket": bucket, "key": key, "state": "OK"}
+		report = append(report, entry)
+		meta, err := GetMeta(s, key)
+		if err != nil || meta["checksum"] == "" {
+			entry["state"] = "missing"
+			continue
+		}
+		entry["checksum"] = meta["checksum"]
+		rc, _, err := s.ReadObject(bucket, key)
+		if err != nil {
+			entry["state"] = "failed"
+			entry["error"] = err.Error()
+			continue
+		}
+		err = VerifyChecksum(meta["checksum"], rc)
+		rc.Close()
+		if err != nil {
+			entry["state"] = "mismatch"
+			entry["error"] = err.Error()
+		}
+	}
+	vMsg := evmsg.NewMessage()
+	vMsg.State = "Response"
+	vMsg.Data = report
+	return vMsg, nil
+}
@@ -0,0 +1,63 @@
+package files
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_Unit_ParseChecksum(t *testing.T) {
+	// sha256 of "hello"
+	hexSum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	algorithm, sum, err := ParseChecksum("SHA256:" + hexSum)
+	if err != nil || algorithm != "sha256" || sum != hexSum {
+		t.Error("unexpected hex checksum", algorithm, sum, err)
+	}
+	_, sum, err = ParseChecksum("md5:XUFAKrxLKna5cZ2REBfFkg==")
+	if err != nil || sum != "5d41402abc4b2a76b9719d911017c592" {
+		t.Error("unexpected base64 checksum", sum, err)
+	}
+	for _, checksum := range []string{"sha256", "sha1:aaaa", "crc32c:zz"} {
+		if _, _, err := ParseChecksum(checksum); err == nil {
+			t.Error("expected an error for", checksum)
+		}
+	}
+}
+
+func Test_Unit_UploadChecksum(t *testing.T) {
+	checksum, err := UploadChecksum(bytes.NewReader([]byte("hello")), "")
+	if err != nil || checksum != "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Error("unexpected default checksum", checksum, err)
+	}
+	checksum, err = UploadChecksum(bytes.NewReader([]byte("hello")), "crc32c:9a71bb4c")
+	if err != nil || checksum != "crc32c:9a71bb4c" {
+		t.Error("unexpected crc32c checksum", checksum, err)
+	}
+	_, err = UploadChecksum(bytes.NewReader([]byte("hello!")), "crc32c:9a71bb4c")
+	if err == nil {
+		t.Error("expected a checksum mismatch")
+	}
+}
+
+func Test_Unit_VerifyBucket(t *testing.T) {
+	s := newMemStorage()
+	s.put("test", "good.jpg", []byte("hello"))
+	s.put("test", "bad.jpg", []byte("hello!"))
+	s.put("test", "none.jpg", []byte("hello"))
+	for _, key := range []string{"good.jpg", "bad.jpg"} {
+		err := PutMeta(s, key, map[string]string{"checksum": "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg, err := VerifyBucket(s, "test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := map[string]string{}
+	for _, entry := range msg.Data.([]interface{}) {
+		states[entry.(map[string]interface{})["key"].(string)] = entry.(map[string]interface{})["state"].(string)
+	}
+	if states["good.jpg"] != "OK" || states["bad.jpg"] != "mismatch" || states["none.jpg"] != "missing" {
+		t.Error("unexpected verify report", states)
+	}
+}
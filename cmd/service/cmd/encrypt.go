@@ -0,0 +1,75 @@
+/*
+Copyright © 2020 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"simon.services/files"
+)
+
+// encryptCmd represents the encrypt command
+var encryptCmd = &cobra.Command{
+	Use:   "encrypt",
+	Short: "encrypts the objects stored before the encryption was enabled",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		master, err := files.LoadMasterKey(keyFile)
+		if err != nil {
+			return err
+		}
+		m := files.NewMinio()
+		err = m.Connect(sURL, sKey, sSecret)
+		if err != nil {
+			return err
+		}
+		err = m.InitCache()
+		if err != nil {
+			return err
+		}
+		exists, err := files.HasBucket(m, files.EncryptionKeysBucket)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if _, err := m.CreateBucket(files.EncryptionKeysBucket); err != nil {
+				return err
+			}
+		}
+		m.Crypt, err = files.NewCrypt(m, master)
+		if err != nil {
+			return err
+		}
+		encrypted, err := m.EncryptObjects()
+		if err != nil {
+			return err
+		}
+		// the cache entries are plaintext, the service fetches them again
+		if err := os.RemoveAll(files.MinioFilesCacheDir); err != nil {
+			return err
+		}
+		fmt.Println("encrypted", encrypted, "objects, start the service with --key_file", keyFile)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(encryptCmd)
+	encryptCmd.Flags().StringVar(&keyFile, "key_file", "", "master keyfile")
+	encryptCmd.Flags().StringVar(&sURL, "s_url", "http://127.0.0.1:9000", "storage url")
+	encryptCmd.Flags().StringVar(&sKey, "s_key", "minioadmin", "storage key")
+	encryptCmd.Flags().StringVar(&sSecret, "s_secret", "minioadmin", "storage secret")
+}
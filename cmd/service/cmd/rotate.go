@@ -0,0 +1,64 @@
+/*
+Copyright © 2020 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"simon.services/files"
+)
+
+var newKeyFile string
+
+// rotateCmd represents the rotate command
+var rotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "re-wraps the data keys of every bucket with a new master key",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		master, err := files.LoadMasterKey(keyFile)
+		if err != nil {
+			return err
+		}
+		newMaster, err := files.LoadMasterKey(newKeyFile)
+		if err != nil {
+			return err
+		}
+		m := files.NewMinio()
+		err = m.Connect(sURL, sKey, sSecret)
+		if err != nil {
+			return err
+		}
+		crypt, err := files.NewCrypt(m, master)
+		if err != nil {
+			return err
+		}
+		rotated, err := crypt.Rotate(newMaster)
+		if err != nil {
+			return err
+		}
+		fmt.Println("rotated", rotated, "data keys, start the service with --key_file", newKeyFile)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rotateCmd)
+	rotateCmd.Flags().StringVar(&keyFile, "key_file", "", "current master keyfile")
+	rotateCmd.Flags().StringVar(&newKeyFile, "new_key_file", "", "new master keyfile")
+	rotateCmd.Flags().StringVar(&sURL, "s_url", "http://127.0.0.1:9000", "storage url")
+	rotateCmd.Flags().StringVar(&sKey, "s_key", "minioadmin", "storage key")
+	rotateCmd.Flags().StringVar(&sSecret, "s_secret", "minioadmin", "storage secret")
+}
@@ -16,22 +16,63 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"os"
+	"os/signal"
 	"simon.services/files"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var (
-	cfgFile string
-	address string
-	client  string
-	secret  string
-	webroot string
-	err     error
-	sURL    string
-	sKey    string
-	sSecret string
+	cfgFile         string
+	address         string
+	client          string
+	secret          string
+	webroot         string
+	err             error
+	sURL            string
+	sKey            string
+	sSecret         string
+	dedup           bool
+	keyFile         string
+	clamd           string
+	index           string
+	tKey            string
+	idFile          string
+	s3Addr          string
+	davPath         string
+	wsInFlight      int
+	wsOrigins       string
+	wsMaxConns      int
+	wsPing          time.Duration
+	wsIdle          time.Duration
+	wsMaxMsg        int
+	shutdownTimeout time.Duration
+	tlsCert         string
+	tlsKey          string
+	tlsClientCA     string
+	tlsSubjects     string
+	tlsRedirect     string
+	rateLimits      string
+	downloadRate    int
+	imageWorkers    int
+	metricsPath     string
+	traceEndpoint   string
+	traceFile       string
+	traceService    string
+	auditMaxSize    int
+	auditMaxFiles   int
+	auditFile       string
+	debugPath       string
+	searchSaveDelay time.Duration
+	tUnsignedOps    int
+	tUnsignedSize   int
+	s3Expiry        time.Duration
 )
 
 // startCmd represents the start command
@@ -47,6 +88,41 @@ var startCmd = &cobra.Command{
 			sURL = viper.GetString("s_url")
 			sKey = viper.GetString("s_key")
 			sSecret = viper.GetString("s_secret")
+			dedup = viper.GetBool("dedup")
+			keyFile = viper.GetString("key_file")
+			clamd = viper.GetString("clamd")
+			index = viper.GetString("search_index")
+			tKey = viper.GetString("transform_key")
+			idFile = viper.GetString("identities")
+			s3Addr = viper.GetString("s3_address")
+			davPath = viper.GetString("webdav_path")
+			wsInFlight = viper.GetInt("ws_max_inflight")
+			wsOrigins = viper.GetString("ws_origins")
+			wsMaxConns = viper.GetInt("ws_max_conns")
+			wsPing = viper.GetDuration("ws_ping_interval")
+			wsIdle = viper.GetDuration("ws_idle_timeout")
+			wsMaxMsg = viper.GetInt("ws_max_message_size")
+			shutdownTimeout = viper.GetDuration("shutdown_timeout")
+			tlsCert = viper.GetString("tls_cert")
+			tlsKey = viper.GetString("tls_key")
+			tlsClientCA = viper.GetString("tls_client_ca")
+			tlsSubjects = viper.GetString("tls_identities")
+			tlsRedirect = viper.GetString("tls_redirect_address")
+			rateLimits = viper.GetString("rate_limits")
+			downloadRate = viper.GetInt("download_rate")
+			imageWorkers = viper.GetInt("image_workers")
+			metricsPath = viper.GetString("metrics_path")
+			traceEndpoint = viper.GetString("trace_otlp_endpoint")
+			traceFile = viper.GetString("trace_file")
+			traceService = viper.GetString("trace_service_name")
+			auditMaxSize = viper.GetInt("audit_max_size")
+			auditMaxFiles = viper.GetInt("audit_max_files")
+			auditFile = viper.GetString("audit_file")
+			debugPath = viper.GetString("debug_path")
+			searchSaveDelay = viper.GetDuration("search_save_delay")
+			tUnsignedOps = viper.GetInt("transform_unsigned_max_ops")
+			tUnsignedSize = viper.GetInt("transform_unsigned_max_size")
+			s3Expiry = viper.GetDuration("s3_upload_expiry")
 		} else {
 			address, err = cmd.Flags().GetString("address")
 			if err != nil {
@@ -76,13 +152,225 @@ var startCmd = &cobra.Command{
 			if err != nil {
 				return err
 			}
+			dedup, err = cmd.Flags().GetBool("dedup")
+			if err != nil {
+				return err
+			}
+			keyFile, err = cmd.Flags().GetString("key_file")
+			if err != nil {
+				return err
+			}
+			clamd, err = cmd.Flags().GetString("clamd")
+			if err != nil {
+				return err
+			}
+			index, err = cmd.Flags().GetString("search_index")
+			if err != nil {
+				return err
+			}
+			tKey, err = cmd.Flags().GetString("transform_key")
+			if err != nil {
+				return err
+			}
+			idFile, err = cmd.Flags().GetString("identities")
+			if err != nil {
+				return err
+			}
+			s3Addr, err = cmd.Flags().GetString("s3_address")
+			if err != nil {
+				return err
+			}
+			davPath, err = cmd.Flags().GetString("webdav_path")
+			if err != nil {
+				return err
+			}
+			wsInFlight, err = cmd.Flags().GetInt("ws_max_inflight")
+			if err != nil {
+				return err
+			}
+			wsOrigins, err = cmd.Flags().GetString("ws_origins")
+			if err != nil {
+				return err
+			}
+			wsMaxConns, err = cmd.Flags().GetInt("ws_max_conns")
+			if err != nil {
+				return err
+			}
+			wsPing, err = cmd.Flags().GetDuration("ws_ping_interval")
+			if err != nil {
+				return err
+			}
+			wsIdle, err = cmd.Flags().GetDuration("ws_idle_timeout")
+			if err != nil {
+				return err
+			}
+			wsMaxMsg, err = cmd.Flags().GetInt("ws_max_message_size")
+			if err != nil {
+				return err
+			}
+			shutdownTimeout, err = cmd.Flags().GetDuration("shutdown_timeout")
+			if err != nil {
+				return err
+			}
+			tlsCert, err = cmd.Flags().GetString("tls_cert")
+			if err != nil {
+				return err
+			}
+			tlsKey, err = cmd.Flags().GetString("tls_key")
+			if err != nil {
+				return err
+			}
+			tlsClientCA, err = cmd.Flags().GetString("tls_client_ca")
+			if err != nil {
+				return err
+			}
+			tlsSubjects, err = cmd.Flags().GetString("tls_identities")
+			if err != nil {
+				return err
+			}
+			tlsRedirect, err = cmd.Flags().GetString("tls_redirect_address")
+			if err != nil {
+				return err
+			}
+			rateLimits, err = cmd.Flags().GetString("rate_limits")
+			if err != nil {
+				return err
+			}
+			downloadRate, err = cmd.Flags().GetInt("download_rate")
+			if err != nil {
+				return err
+			}
+			imageWorkers, err = cmd.Flags().GetInt("image_workers")
+			if err != nil {
+				return err
+			}
+			metricsPath, err = cmd.Flags().GetString("metrics_path")
+			if err != nil {
+				return err
+			}
+			traceEndpoint, err = cmd.Flags().GetString("trace_otlp_endpoint")
+			if err != nil {
+				return err
+			}
+			traceFile, err = cmd.Flags().GetString("trace_file")
+			if err != nil {
+				return err
+			}
+			traceService, err = cmd.Flags().GetString("trace_service_name")
+			if err != nil {
+				return err
+			}
+			auditMaxSize, err = cmd.Flags().GetInt("audit_max_size")
+			if err != nil {
+				return err
+			}
+			auditMaxFiles, err = cmd.Flags().GetInt("audit_max_files")
+			if err != nil {
+				return err
+			}
+			auditFile, err = cmd.Flags().GetString("audit_file")
+			if err != nil {
+				return err
+			}
+			debugPath, err = cmd.Flags().GetString("debug_path")
+			if err != nil {
+				return err
+			}
+			searchSaveDelay, err = cmd.Flags().GetDuration("search_save_delay")
+			if err != nil {
+				return err
+			}
+			tUnsignedOps, err = cmd.Flags().GetInt("transform_unsigned_max_ops")
+			if err != nil {
+				return err
+			}
+			tUnsignedSize, err = cmd.Flags().GetInt("transform_unsigned_max_size")
+			if err != nil {
+				return err
+			}
+			s3Expiry, err = cmd.Flags().GetDuration("s3_upload_expiry")
+			if err != nil {
+				return err
+			}
+		}
+		files.DedupEnabled = dedup
+		files.EncryptionKeyFile = keyFile
+		files.SearchIndexFile = index
+		files.TransformSigningKey = tKey
+		files.S3Address = s3Addr
+		files.WebDAVPath = strings.TrimSuffix(davPath, "/")
+		files.WSMaxInFlight = wsInFlight
+		if len(wsOrigins) > 0 {
+			files.WSAllowedOrigins = strings.Split(wsOrigins, ",")
+		}
+		files.WSMaxConnsPerClient = wsMaxConns
+		files.WSPingInterval = wsPing
+		files.WSIdleTimeout = wsIdle
+		files.WSMaxMessageSize = wsMaxMsg
+		files.ShutdownTimeout = shutdownTimeout
+		files.TLSCertFile = tlsCert
+		files.TLSKeyFile = tlsKey
+		files.TLSClientCAFile = tlsClientCA
+		if len(tlsSubjects) > 0 {
+			files.TLSSubjects, err = files.LoadTLSSubjects(tlsSubjects)
+			if err != nil {
+				return err
+			}
+		}
+		files.TLSRedirectAddress = tlsRedirect
+		if len(rateLimits) > 0 {
+			files.RateLimits, err = files.ParseRateLimits(rateLimits)
+			if err != nil {
+				return err
+			}
+		}
+		files.DownloadRate = int64(downloadRate)
+		files.ImageWorkers = imageWorkers
+		files.MetricsPath = metricsPath
+		files.TraceOTLPEndpoint = traceEndpoint
+		files.TraceFile = traceFile
+		files.TraceServiceName = traceService
+		files.AuditMaxSize = int64(auditMaxSize) << 20
+		files.AuditMaxFiles = auditMaxFiles
+		files.DebugPath = debugPath
+		files.SearchSaveDelay = searchSaveDelay
+		files.TransformUnsignedMaxOps = tUnsignedOps
+		files.TransformUnsignedMaxSize = tUnsignedSize
+		files.S3UploadExpiry = s3Expiry
+		if len(idFile) > 0 {
+			files.Identities, files.IdentityPermissions, err = files.LoadIdentities(idFile)
+			if err != nil {
+				return err
+			}
 		}
 		f := files.New()
 		err = f.ConnectStorage("minio", map[string]string{"url": sURL, "key": sKey, "secret": sSecret})
 		if err != nil {
 			return err
 		}
-		return f.Start(address, client, secret, webroot)
+		if len(clamd) > 0 {
+			f.WSScanner, err = files.NewClamd(clamd)
+			if err != nil {
+				return err
+			}
+		}
+		if len(auditFile) > 0 {
+			f.WSAudit, err = files.OpenAuditLog(auditFile)
+			if err != nil {
+				return err
+			}
+		}
+		// the first signal shuts the service down gracefully, a second one kills it
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-signals
+			signal.Stop(signals)
+			cancel()
+		}()
+		return f.Start(ctx, address, client, secret, webroot)
 	},
 }
 
@@ -97,6 +385,59 @@ func init() {
 	startCmd.Flags().StringVar(&sURL, "s_url", "http://127.0.0.1:9000", "storage url")
 	startCmd.Flags().StringVar(&sKey, "s_key", "minioadmin", "storage key")
 	startCmd.Flags().StringVar(&sSecret, "s_secret", "minioadmin", "storage secret")
+	startCmd.Flags().BoolVar(&dedup, "dedup", false, "store identical uploads only once")
+	startCmd.Flags().StringVar(&keyFile, "key_file", "", "master keyfile, enables the encryption at rest")
+	startCmd.Flags().StringVar(&index, "search_index", files.SearchIndexFile, "location of the search index, empty disables the search")
+	startCmd.Flags().StringVar(&tKey, "transform_key", "", "key to sign image transformation urls, empty allows limited unsigned transformations")
+	startCmd.Flags().StringVar(&idFile, "identities", "", "JSON file of identity names and secrets, used for the bucket watermark owners")
+	startCmd.Flags().StringVar(&s3Addr, "s3_address", "", "address of the S3 compatible API, empty disables it")
+	startCmd.Flags().StringVar(&davPath, "webdav_path", "", "path of the WebDAV endpoint, e.g. /dav, empty disables it")
+	startCmd.Flags().IntVar(&wsInFlight, "ws_max_inflight", files.WSMaxInFlight, "requests of a websocket connection that run at the same time")
+	startCmd.Flags().StringVar(&wsOrigins, "ws_origins", "", "comma separated origins allowed to open websockets, empty allows the host of the service, * allows all")
+	startCmd.Flags().IntVar(&wsMaxConns, "ws_max_conns", files.WSMaxConnsPerClient, "websocket connections of an identity or an address, 0 disables the limit")
+	startCmd.Flags().DurationVar(&wsPing, "ws_ping_interval", files.WSPingInterval, "time between the pings of a websocket connection, 0 disables them")
+	startCmd.Flags().DurationVar(&wsIdle, "ws_idle_timeout", files.WSIdleTimeout, "closes websocket connections without any traffic for this long")
+	startCmd.Flags().IntVar(&wsMaxMsg, "ws_max_message_size", files.WSMaxMessageSize, "maximum size of a websocket message in bytes")
+	startCmd.Flags().DurationVar(&shutdownTimeout, "shutdown_timeout", files.ShutdownTimeout, "time the requests in flight get to finish on shutdown")
+	startCmd.Flags().StringVar(&tlsCert, "tls_cert", "", "certificate file, enables TLS, reloaded when it changes")
+	startCmd.Flags().StringVar(&tlsKey, "tls_key", "", "key file of the certificate")
+	startCmd.Flags().StringVar(&tlsClientCA, "tls_client_ca", "", "CA file of the client certificates, enables the authentication with client certificates")
+	startCmd.Flags().StringVar(&tlsSubjects, "tls_identities", "", "JSON file mapping the subjects of client certificates to identities, without it the common name is the identity")
+	startCmd.Flags().StringVar(&tlsRedirect, "tls_redirect_address", "", "address redirecting plain HTTP to TLS, e.g. 0.0.0.0:80")
+	startCmd.Flags().StringVar(&rateLimits, "rate_limits", "", "rate limits per identity or address, e.g. upload=2:10,download=20:40,rendition=5:10,command=50:100")
+	startCmd.Flags().IntVar(&downloadRate, "download_rate", 0, "bytes per second an identity or an address may download, 0 disables the throttling")
+	startCmd.Flags().IntVar(&imageWorkers, "image_workers", files.ImageWorkers, "thumbnails and renditions generated at the same time")
+	startCmd.Flags().StringVar(&metricsPath, "metrics_path", files.MetricsPath, "the path of the Prometheus metrics, empty disables them")
+	startCmd.Flags().StringVar(&traceEndpoint, "trace_otlp_endpoint", "", "exports trace spans with OTLP over HTTP to this collector, e.g. http://localhost:4318")
+	startCmd.Flags().StringVar(&traceFile, "trace_file", "", "appends trace spans as OTLP JSON lines to this file")
+	startCmd.Flags().StringVar(&traceService, "trace_service_name", files.TraceServiceName, "the service name of the exported trace spans")
+	startCmd.Flags().IntVar(&auditMaxSize, "audit_max_size", 100, "rotates the audit log after these megabytes")
+	startCmd.Flags().IntVar(&auditMaxFiles, "audit_max_files", 10, "rotated audit log files that are kept")
+	startCmd.Flags().StringVar(&auditFile, "audit_file", "", "appends an audit log of every data access and change as JSON lines to this file")
+	startCmd.Flags().StringVar(&debugPath, "debug_path", files.DebugPath, "the path of the admin only build info, config and pprof endpoints, empty disables them")
+	startCmd.Flags().DurationVar(&searchSaveDelay, "search_save_delay", files.SearchSaveDelay, "batches the writes of the search index for this long")
+	startCmd.Flags().IntVar(&tUnsignedOps, "transform_unsigned_max_ops", files.TransformUnsignedMaxOps, "steps of the unsigned image transformations without a transform_key, 0 disables them")
+	startCmd.Flags().IntVar(&tUnsignedSize, "transform_unsigned_max_size", files.TransformUnsignedMaxSize, "largest resize of the unsigned image transformations without a transform_key")
+	startCmd.Flags().DurationVar(&s3Expiry, "s3_upload_expiry", files.S3UploadExpiry, "unfinished multipart uploads older than this get removed")
+	startCmd.Flags().StringVar(&clamd, "clamd", "", "clamd address to scan uploads, e.g. tcp://127.0.0.1:3310")
+	// settings missing in the config file get the defaults of the flags
+	viper.SetDefault("search_index", files.SearchIndexFile)
+	viper.SetDefault("search_save_delay", files.SearchSaveDelay)
+	viper.SetDefault("transform_unsigned_max_ops", files.TransformUnsignedMaxOps)
+	viper.SetDefault("transform_unsigned_max_size", files.TransformUnsignedMaxSize)
+	viper.SetDefault("ws_max_inflight", files.WSMaxInFlight)
+	viper.SetDefault("ws_max_conns", files.WSMaxConnsPerClient)
+	viper.SetDefault("ws_ping_interval", files.WSPingInterval)
+	viper.SetDefault("ws_idle_timeout", files.WSIdleTimeout)
+	viper.SetDefault("ws_max_message_size", files.WSMaxMessageSize)
+	viper.SetDefault("shutdown_timeout", files.ShutdownTimeout)
+	viper.SetDefault("image_workers", files.ImageWorkers)
+	viper.SetDefault("metrics_path", files.MetricsPath)
+	viper.SetDefault("trace_service_name", files.TraceServiceName)
+	viper.SetDefault("debug_path", files.DebugPath)
+	viper.SetDefault("s3_upload_expiry", files.S3UploadExpiry)
+	viper.SetDefault("audit_max_size", 100)
+	viper.SetDefault("audit_max_files", 10)
 }
 
 func initConfig() {
@@ -0,0 +1,188 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	rpprof "runtime/pprof"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+)
+
+// DebugPath serves the build info, the effective config and the profiles to admins, empty disables it
+var DebugPath string = "/debug"
+
+const redacted = "[redacted]"
+
+// redact hides a secret but tells if it is set
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// redactURL hides the password of an URL
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redact(raw)
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return u.String()
+}
+
+// BuildInfo describes the running binary
+func BuildInfo() map[string]interface{} {
+	info := map[string]interface{}{
+		"go":      runtime.Version(),
+		"os":      runtime.GOOS,
+		"arch":    runtime.GOARCH,
+		"started": processStart.UTC().Format(time.RFC3339),
+		"uptime":  time.Since(processStart).Round(time.Second).String(),
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		info["path"] = build.Path
+		info["version"] = build.Main.Version
+		deps := map[string]string{}
+		for _, dep := range build.Deps {
+			deps[dep.Path] = dep.Version
+		}
+		info["deps"] = deps
+	}
+	return info
+}
+
+// EffectiveConfig returns the settings the service runs with, the secrets are redacted
+func (f *Files) EffectiveConfig() map[string]interface{} {
+	identities := map[string]string{}
+	for name := range Identities {
+		identities[name] = f.Permission(name)
+	}
+	return map[string]interface{}{
+		"address":    f.WSAddress,
+		"client":     f.WSClient,
+		"secret":     redact(f.WSSecret),
+		"webroot":    f.WSWebroot,
+		"scanner":    f.WSScanner != nil,
+		"audit":      f.WSAudit != nil,
+		"identities": identities,
+		"minio": map[string]interface{}{
+			"cacheDir":                 MinioFilesCacheDir,
+			"connectionSecondsTimeout": MinioConnectionSecondsTimeout,
+			"downloadSecondsTimeout":   MinioDownloadSecondsTimeout,
+			"uploadSecondsTimeout":     MinioUploadSecondsTimeout,
+		},
+		"buckets": RequiredBuckets(),
+		"dedup": map[string]interface{}{
+			"enabled": DedupEnabled,
+			"bucket":  DedupBucket,
+		},
+		"encryption": map[string]interface{}{
+			"keyFile":    EncryptionKeyFile,
+			"keysBucket": EncryptionKeysBucket,
+		},
+		"transform": map[string]interface{}{
+			"signingKey":      redact(TransformSigningKey),
+			"maxOps":          TransformMaxOps,
+			"maxSize":         TransformMaxSize,
+			"unsignedMaxOps":  TransformUnsignedMaxOps,
+			"unsignedMaxSize": TransformUnsignedMaxSize,
+		},
+		"s3": map[string]interface{}{
+			"address":       S3Address,
+			"region":        S3Region,
+			"maxObjectSize": S3MaxObjectSize,
+		},
+		"webdav": map[string]interface{}{
+			"path":          WebDAVPath,
+			"maxObjectSize": WebDAVMaxObjectSize,
+		},
+		"rest": RESTPrefix,
+		"search": map[string]interface{}{
+			"indexFile": SearchIndexFile,
+		},
+		"tls": map[string]interface{}{
+			"certFile":        TLSCertFile,
+			"keyFile":         TLSKeyFile,
+			"clientCAFile":    TLSClientCAFile,
+			"subjects":        TLSSubjects,
+			"redirectAddress": TLSRedirectAddress,
+		},
+		"websocket": map[string]interface{}{
+			"maxInFlight":       WSMaxInFlight,
+			"allowedOrigins":    WSAllowedOrigins,
+			"maxConnsPerClient": WSMaxConnsPerClient,
+			"pingInterval":      WSPingInterval.String(),
+			"idleTimeout":       WSIdleTimeout.String(),
+			"maxMessageSize":    WSMaxMessageSize,
+		},
+		"rateLimits":      RateLimits,
+		"downloadRate":    DownloadRate,
+		"imageWorkers":    ImageWorkers,
+		"shutdownTimeout": ShutdownTimeout.String(),
+		"metricsPath":     MetricsPath,
+		"debugPath":       DebugPath,
+		"tracing": map[string]interface{}{
+			"otlpEndpoint": redactURL(TraceOTLPEndpoint),
+			"file":         TraceFile,
+			"serviceName":  TraceServiceName,
+		},
+		"auditLog": map[string]interface{}{
+			"maxSize":  AuditMaxSize,
+			"maxFiles": AuditMaxFiles,
+		},
+	}
+}
+
+// debugAuth allows admins only, the profiles and the config tell too much about the service
+func (f *Files) debugAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		identity := f.Identity(c.Request())
+		if identity == "" {
+			c.Response().Header().Set("WWW-Authenticate", "Basic realm=\"files\"")
+			return jsonError(c, http.StatusUnauthorized, errors.New("the debug endpoints need basic auth!"))
+		}
+		if !f.Allowed(identity, PermissionAdmin) {
+			return jsonError(c, http.StatusForbidden, errors.New("the debug endpoints are only allowed for admins!"))
+		}
+		return next(c)
+	}
+}
+
+// RegisterDebug adds the build info, the effective config, the goroutine dump and pprof under DebugPath
+func (f *Files) RegisterDebug(e *echo.Echo) {
+	if DebugPath == "" {
+		return
+	}
+	g := e.Group(DebugPath, f.debugAuth)
+	g.GET("/build", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, BuildInfo())
+	})
+	g.GET("/config", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, f.EffectiveConfig())
+	})
+	g.GET("/goroutines", func(c echo.Context) error {
+		c.Response().Header().Set("Content-Type", "text/plain; charset=utf-8")
+		c.Response().WriteHeader(http.StatusOK)
+		return rpprof.Lookup("goroutine").WriteTo(c.Response(), 2)
+	})
+	// pprof.Index finds the named profiles below /debug/pprof/ only
+	index := http.StripPrefix(DebugPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = "/debug" + r.URL.Path
+		pprof.Index(w, r)
+	}))
+	g.GET("/pprof/", echo.WrapHandler(index))
+	// no cmdline, the arguments carry the secrets of the service
+	g.GET("/pprof/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+	g.GET("/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	g.POST("/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	g.GET("/pprof/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+	g.GET("/pprof/:profile", echo.WrapHandler(index))
+}
@@ -0,0 +1,412 @@
+package files
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"evalgo.org/evmsg"
+	"github.com/minio/minio-go/v6"
+)
+
+var DedupEnabled bool = false
+var DedupBucket string = "blobs"
+
+// DedupRefCacheSize bounds the cached references, entries are dropped at random beyond it
+var DedupRefCacheSize int = 100000
+
+// Dedup stores the content of every object only once by its sha256, the objects
+// of the wrapped storage buckets become references onto those blobs
+type Dedup struct {
+	Storage Storage
+	// lock lets Close wait for the writes in progress, the writes share it
+	lock sync.RWMutex
+	// keys serializes the writes of an object and the reference counts of a blob
+	keysMu sync.Mutex
+	keys   map[string]*dedupKeyLock
+
+	// refs caches the references, every write of the buckets goes through the dedup
+	refsMu sync.Mutex
+	refs   map[string]*dedupRef
+}
+
+type dedupRef struct {
+	Blob string `json:"blob"`
+	Size int64  `json:"size"`
+}
+
+type dedupKeyLock struct {
+	sync.Mutex
+	users int
+}
+
+func NewDedup(s Storage) *Dedup {
+	return &Dedup{Storage: s, keys: map[string]*dedupKeyLock{}, refs: map[string]*dedupRef{}}
+}
+
+func dedupRefKey(bucket, file string) string {
+	return "refs/" + bucket + "/" + file
+}
+
+// lockKey locks an object or a blob and returns the unlock, an object is always
+// locked before its blobs so the writes can not deadlock
+func (d *Dedup) lockKey(key string) func() {
+	d.keysMu.Lock()
+	l, ok := d.keys[key]
+	if !ok {
+		l = &dedupKeyLock{}
+		d.keys[key] = l
+	}
+	l.users++
+	d.keysMu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		d.keysMu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(d.keys, key)
+		}
+		d.keysMu.Unlock()
+	}
+}
+
+func (d *Dedup) readJSON(key string, v interface{}) error {
+	obj, _, err := d.Storage.ReadObject(DedupBucket, key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	return json.NewDecoder(obj).Decode(v)
+}
+
+func (d *Dedup) writeJSON(key string, v interface{}) error {
+	vB, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	fh, err := NewFileHeader(key, vB)
+	if err != nil {
+		return err
+	}
+	return d.Storage.PutObject(DedupBucket, fh)
+}
+
+// ref returns the blob reference of an object, objects stored before
+// dedup was enabled have none
+func (d *Dedup) ref(bucket, file string) (*dedupRef, bool) {
+	if IsInternalBucket(bucket) {
+		return nil, false
+	}
+	key := dedupRefKey(bucket, file)
+	d.refsMu.Lock()
+	ref, cached := d.refs[key]
+	d.refsMu.Unlock()
+	if cached {
+		return ref, ref != nil
+	}
+	ref = &dedupRef{}
+	err := d.readJSON(key, ref)
+	if err != nil && !IsNotFound(err) {
+		// a failed read is not cached, the next call tries again
+		return nil, false
+	}
+	if err != nil || ref.Blob == "" {
+		ref = nil
+	}
+	d.refsMu.Lock()
+	// a reference written meanwhile wins over the one read before
+	if cached, ok := d.refs[key]; ok {
+		ref = cached
+	} else {
+		d.cacheRef(key, ref)
+	}
+	d.refsMu.Unlock()
+	return ref, ref != nil
+}
+
+// setRef caches the reference of an object, nil for an object without one
+func (d *Dedup) setRef(bucket, file string, ref *dedupRef) {
+	d.refsMu.Lock()
+	d.cacheRef(dedupRefKey(bucket, file), ref)
+	d.refsMu.Unlock()
+}
+
+// cacheRef stores a reference in the bounded cache, refsMu has to be held
+func (d *Dedup) cacheRef(key string, ref *dedupRef) {
+	if _, ok := d.refs[key]; !ok {
+		for evict := range d.refs {
+			if len(d.refs) < DedupRefCacheSize {
+				break
+			}
+			delete(d.refs, evict)
+		}
+	}
+	d.refs[key] = ref
+}
+
+// blobRefs reads the meta of a blob with its reference count
+func (d *Dedup) blobRefs(blob string) (map[string]string, int64, error) {
+	meta, err := GetMeta(d.Storage, blob)
+	if err != nil {
+		return meta, 0, err
+	}
+	refs, err := strconv.ParseInt(meta["refs"], 10, 64)
+	return meta, refs, err
+}
+
+// setBlobRefs writes the reference count into the meta of a blob
+func (d *Dedup) setBlobRefs(blob string, meta map[string]string, refs int64) error {
+	meta["refs"] = strconv.FormatInt(refs, 10)
+	return PutMeta(d.Storage, blob, meta)
+}
+
+// Close waits for the reference updates in progress and closes the wrapped storage
+func (d *Dedup) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return CloseStorage(d.Storage)
+}
+
+func (d *Dedup) CreateBucket(bucket string) (*evmsg.Message, error) {
+	return d.Storage.CreateBucket(bucket)
+}
+
+func (d *Dedup) ListBuckets() (*evmsg.Message, error) {
+	return d.Storage.ListBuckets()
+}
+
+func (d *Dedup) ListObjects(bucket minio.BucketInfo, prefix string) (*evmsg.Message, error) {
+	msg, err := d.Storage.ListObjects(bucket, prefix)
+	if err != nil {
+		return msg, err
+	}
+	list, _ := msg.Data.([]interface{})
+	for _, obj := range list {
+		mObj := obj.(map[string]interface{})
+		// the stored object is only the reference, report the size of the content
+		if ref, ok := d.ref(bucket.Name, mObj["key"].(string)); ok {
+			mObj["size"] = ref.Size
+			mObj["blob"] = ref.Blob
+		}
+	}
+	return msg, nil
+}
+
+func (d *Dedup) GetObject(bucket, file string) (*evmsg.Message, error) {
+	ref, ok := d.ref(bucket, file)
+	if !ok {
+		return d.Storage.GetObject(bucket, file)
+	}
+	msg, err := d.Storage.GetObject(DedupBucket, ref.Blob)
+	if err != nil {
+		return msg, err
+	}
+	// the blob only knows its content, the object keeps the meta information of the upload
+	meta, err := GetMeta(d.Storage, file)
+	if err != nil && !IsNotFound(err) {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	if data, ok := msg.Data.([]interface{}); ok && len(data) > 0 {
+		entry := data[0].(map[string]interface{})
+		if path, ok := entry["path"].(string); ok {
+			downloadPath := strings.Replace(MinioDownloadsFilePath, ":bucket", bucket, 1)
+			entry["path"] = strings.Replace(downloadPath, ":object", filepath.Base(path), 1)
+		}
+		for _, field := range objectMetaFields {
+			if meta[field] != "" {
+				entry[field] = meta[field]
+			}
+		}
+		entry["description"] = meta["description"]
+	}
+	return msg, nil
+}
+
+func (d *Dedup) GetThumbnail(bucket, file string) ([]byte, error) {
+	if ref, ok := d.ref(bucket, file); ok {
+		// the blob has no extension, the name of the object tells how to render it
+		rc, _, err := d.Storage.ReadObject(DedupBucket, ref.Blob)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return renderThumbnail(file, rc)
+	}
+	return d.Storage.GetThumbnail(bucket, file)
+}
+
+func (d *Dedup) ReadObject(bucket, file string) (io.ReadCloser, int64, error) {
+	if ref, ok := d.ref(bucket, file); ok {
+		return d.Storage.ReadObject(DedupBucket, ref.Blob)
+	}
+	return d.Storage.ReadObject(bucket, file)
+}
+
+func (d *Dedup) ReadCache(cached string) (io.ReadCloser, error) {
+	return d.Storage.ReadCache(cached)
+}
+
+func (d *Dedup) WriteCache(cached string, r io.Reader) error {
+	return d.Storage.WriteCache(cached, r)
+}
+
+func (d *Dedup) PutObject(bucket string, file *multipart.FileHeader) error {
+	if IsInternalBucket(bucket) {
+		return d.Storage.PutObject(bucket, file)
+	}
+	src, err := file.Open()
+	if err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, src)
+	src.Close()
+	if err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	// the same content is one blob whatever the extension of its names
+	blob := "objects/" + sum
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	defer d.lockKey(dedupRefKey(bucket, file.Filename))()
+	old, replaced := d.ref(bucket, file.Filename)
+	if replaced && old.Blob == blob {
+		return nil
+	}
+	err = d.acquire(blob, sum, file)
+	if err != nil {
+		return err
+	}
+	if replaced {
+		if err := d.release(old.Blob); err != nil {
+			return err
+		}
+	}
+	ref := &dedupRef{Blob: blob, Size: file.Size}
+	err = d.writeJSON(dedupRefKey(bucket, file.Filename), ref)
+	if err != nil {
+		return err
+	}
+	d.setRef(bucket, file.Filename, ref)
+	// the bucket keeps a small reference object so listings stay intact
+	rfh, err := NewFileHeader(file.Filename, []byte(blob))
+	if err != nil {
+		return err
+	}
+	return d.Storage.PutObject(bucket, rfh)
+}
+
+// acquire adds one reference to a blob, the content is uploaded with the first one
+func (d *Dedup) acquire(blob, sum string, file *multipart.FileHeader) error {
+	defer d.lockKey(blob)()
+	meta, refs, err := d.blobRefs(blob)
+	if err != nil && !IsNotFound(err) {
+		return err
+	}
+	if refs == 0 {
+		bfh := *file
+		bfh.Filename = blob
+		err = d.Storage.PutObject(DedupBucket, &bfh)
+		if err != nil {
+			return err
+		}
+		meta = map[string]string{"name": blob, "checksum": "sha256:" + sum, "size": strconv.FormatInt(file.Size, 10)}
+	}
+	return d.setBlobRefs(blob, meta, refs+1)
+}
+
+// release drops one reference of a blob, the blob is removed with the last one
+func (d *Dedup) release(blob string) error {
+	defer d.lockKey(blob)()
+	meta, refs, err := d.blobRefs(blob)
+	if err != nil {
+		return err
+	}
+	if refs > 1 {
+		return d.setBlobRefs(blob, meta, refs-1)
+	}
+	if _, err := d.Storage.RemoveObject(DedupBucket, blob); err != nil {
+		return err
+	}
+	_, err = d.Storage.RemoveObject("meta", metaKey(blob))
+	return err
+}
+
+func (d *Dedup) RemoveObject(bucket, file string) (*evmsg.Message, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	defer d.lockKey(dedupRefKey(bucket, file))()
+	ref, ok := d.ref(bucket, file)
+	msg, err := d.Storage.RemoveObject(bucket, file)
+	if err != nil || !ok {
+		return msg, err
+	}
+	if _, err := d.Storage.RemoveObject(DedupBucket, dedupRefKey(bucket, file)); err != nil {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	d.setRef(bucket, file, nil)
+	if err := d.release(ref.Blob); err != nil {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	return msg, nil
+}
+
+// Report sums up how much space the deduplication saved
+func (d *Dedup) Report() (*evmsg.Message, error) {
+	msg := evmsg.NewMessage()
+	msg.State = "Response"
+	lMsg, err := d.Storage.ListObjects(minio.BucketInfo{Name: DedupBucket}, "objects/")
+	if err != nil {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	var blobs, refs, physical, logical int64
+	list, _ := lMsg.Data.([]interface{})
+	for _, obj := range list {
+		meta, count, err := d.blobRefs(obj.(map[string]interface{})["key"].(string))
+		if err != nil {
+			msg.Debug.Error = err.Error()
+			return msg, err
+		}
+		size, _ := strconv.ParseInt(meta["size"], 10, 64)
+		blobs++
+		refs += count
+		physical += size
+		logical += count * size
+	}
+	msg.Data = []interface{}{
+		map[string]interface{}{
+			"blobs":    blobs,
+			"refs":     refs,
+			"physical": physical,
+			"logical":  logical,
+			"saved":    logical - physical,
+		},
+	}
+	return msg, nil
+}
+
+// DedupReport answers the websocket report command of a storage
+func DedupReport(s Storage) (*evmsg.Message, error) {
+	d, ok := s.(*Dedup)
+	if !ok {
+		msg := evmsg.NewMessage()
+		msg.State = "Response"
+		err := errors.New("the deduplication of uploads is not enabled!")
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	return d.Report()
+}
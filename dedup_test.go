@@ -0,0 +1,179 @@
+package files
+
+import (
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v6"
+)
+
+func dedupBlobs(s *memStorage) []string {
+	blobs := []string{}
+	for key := range s.objects[DedupBucket] {
+		if strings.HasPrefix(key, "objects/") {
+			blobs = append(blobs, key)
+		}
+	}
+	return blobs
+}
+
+func Test_Unit_Dedup(t *testing.T) {
+	s := newMemStorage()
+	d := NewDedup(s)
+	for _, target := range [][2]string{{"one", "a.jpg"}, {"two", "b.png"}, {"two", "c.jpg"}} {
+		fh, err := NewFileHeader(target[1], []byte("same content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.PutObject(target[0], fh); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fh, _ := NewFileHeader("d.jpg", []byte("other content"))
+	if err := d.PutObject("two", fh); err != nil {
+		t.Fatal(err)
+	}
+	if len(dedupBlobs(s)) != 2 {
+		t.Error("the same content has to be one blob whatever the extension", dedupBlobs(s))
+	}
+	reads := atomic.LoadInt64(&s.reads)
+	if _, err := d.ListObjects(minio.BucketInfo{Name: "two"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt64(&s.reads) != reads {
+		t.Error("the listing has to use the cached references")
+	}
+	rc, size, err := d.ReadObject("two", "c.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(rc)
+	if string(data) != "same content" || size != int64(len("same content")) {
+		t.Error("unexpected content", string(data), size)
+	}
+	msg, err := d.Report()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved := msg.Value("saved").(int64); saved != 2*int64(len("same content")) {
+		t.Error("unexpected saved bytes", saved)
+	}
+	for _, target := range [][2]string{{"one", "a.jpg"}, {"two", "b.png"}} {
+		if _, err := d.RemoveObject(target[0], target[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := d.ReadObject("two", "c.jpg"); err != nil {
+		t.Error("expected the blob to survive while referenced", err)
+	}
+	if _, err := d.RemoveObject("two", "c.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if len(dedupBlobs(s)) != 1 {
+		t.Error("expected the last reference to free the blob", dedupBlobs(s))
+	}
+	if len(s.objects["meta"]) != 1 {
+		t.Error("the meta of the freed blob has to be removed", s.objects["meta"])
+	}
+}
+
+// blockingStorage serializes the memStorage and holds the upload of the first blob
+type blockingStorage struct {
+	*memStorage
+	mu      sync.Mutex
+	blocked chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (s *blockingStorage) ReadObject(bucket, file string) (io.ReadCloser, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.memStorage.ReadObject(bucket, file)
+}
+
+func (s *blockingStorage) PutObject(bucket string, file *multipart.FileHeader) error {
+	if bucket == DedupBucket && strings.HasPrefix(file.Filename, "objects/") {
+		first := false
+		s.once.Do(func() { first = true })
+		if first {
+			close(s.blocked)
+			<-s.release
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.memStorage.PutObject(bucket, file)
+}
+
+func Test_Unit_DedupConcurrentUploads(t *testing.T) {
+	s := &blockingStorage{memStorage: newMemStorage(), blocked: make(chan struct{}), release: make(chan struct{})}
+	d := NewDedup(s)
+	slow, _ := NewFileHeader("slow.jpg", []byte("slow content"))
+	fast, _ := NewFileHeader("fast.jpg", []byte("fast content"))
+	done := make(chan error, 1)
+	go func() { done <- d.PutObject("one", slow) }()
+	<-s.blocked
+	finished := make(chan error, 1)
+	go func() { finished <- d.PutObject("two", fast) }()
+	select {
+	case err := <-finished:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the upload of other content must not wait for a running blob upload")
+	}
+	close(s.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(dedupBlobs(s.memStorage)) != 2 {
+		t.Error("expected both blobs", dedupBlobs(s.memStorage))
+	}
+}
+
+func Test_Unit_DedupRefCache(t *testing.T) {
+	size := DedupRefCacheSize
+	DedupRefCacheSize = 2
+	defer func() { DedupRefCacheSize = size }()
+	s := newMemStorage()
+	d := NewDedup(s)
+	for _, key := range []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg"} {
+		s.put("one", key, []byte("plain"))
+	}
+	if _, err := d.ListObjects(minio.BucketInfo{Name: "one"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.refs) > DedupRefCacheSize {
+		t.Error("the cached references have to be bounded", len(d.refs))
+	}
+}
+
+func Test_Unit_DedupGetObjectMeta(t *testing.T) {
+	s := newMemStorage()
+	d := NewDedup(s)
+	fh, _ := NewFileHeader("report.pdf", []byte("%PDF"))
+	if err := d.PutObject("docs", fh); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutMeta(s, "report.pdf", map[string]string{"description": "the report", "pages": "3", "text": "quarterly", "duration": "1.5"}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := d.GetObject("docs", "report.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Value("pages") != "3" || msg.Value("text") != "quarterly" || msg.Value("duration") != "1.5" || msg.Value("description") != "the report" {
+		t.Error("the meta information of the object has to be returned", msg.Data)
+	}
+	if path, _ := msg.Value("path").(string); strings.Contains(path, DedupBucket) {
+		t.Error("the path must not point into the blobs", path)
+	}
+}
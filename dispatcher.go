@@ -0,0 +1,568 @@
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"evalgo.org/evmsg"
+	"github.com/minio/minio-go/v6"
+)
+
+// the types of the command parameters, strings of REST queries are converted into them
+const (
+	ParamString = "string"
+	ParamBool   = "bool"
+	ParamNumber = "number"
+	ParamList   = "list"
+	ParamObject = "object"
+	ParamAny    = "any"
+)
+
+// the permissions of the identities, every level includes the ones before it
+const (
+	PermissionRead  = "read"
+	PermissionWrite = "write"
+	PermissionAdmin = "admin"
+)
+
+var permissionLevels = map[string]int{PermissionRead: 1, PermissionWrite: 2, PermissionAdmin: 3}
+
+// IdentityPermissions limits identities, identities without an entry may write
+var IdentityPermissions = map[string]string{}
+
+// Param is a typed parameter of a command
+type Param struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Required bool   `json:"required"`
+}
+
+// Params are the validated parameters of a command, the accessors never panic
+type Params map[string]interface{}
+
+func (p Params) String(name string) string {
+	s, _ := p[name].(string)
+	return s
+}
+
+func (p Params) Bool(name string) bool {
+	b, _ := p[name].(bool)
+	return b
+}
+
+func (p Params) Int(name string, def int) int {
+	if n, ok := p[name].(float64); ok {
+		return int(n)
+	}
+	return def
+}
+
+func (p Params) Strings(name string) []string {
+	return stringList(p[name])
+}
+
+func (p Params) Object(name string) map[string]interface{} {
+	o, _ := p[name].(map[string]interface{})
+	return o
+}
+
+// Command is an operation of the protocol, the websocket and the REST API both dispatch to it
+type Command struct {
+	Scope       string
+	Name        string
+	Description string
+	Permission  string
+	Params      []Param
+	// Validate checks the parameters beyond their types
+	Validate func(p Params) error
+	// Method and Path bind the command to the REST API, commands without a path are websocket only
+	Method string
+	Path   string
+	Run    func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error)
+}
+
+// CommandError carries the HTTP status and a code for the clients of a failed command
+type CommandError struct {
+	Status int
+	Code   string
+	Err    error
+}
+
+func (e *CommandError) Error() string {
+	return e.Err.Error()
+}
+
+func commandError(status int, err error) *CommandError {
+	return &CommandError{Status: status, Err: err}
+}
+
+var (
+	commandsMu sync.RWMutex
+	commands   = map[string]*Command{}
+)
+
+// RegisterCommand adds a command to the protocol, a command of the same scope and name is replaced
+func RegisterCommand(cmd *Command) {
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+	commands[cmd.Scope+"/"+cmd.Name] = cmd
+}
+
+func lookupCommand(scope, name string) (*Command, bool) {
+	commandsMu.RLock()
+	defer commandsMu.RUnlock()
+	cmd, ok := commands[scope+"/"+name]
+	return cmd, ok
+}
+
+// Commands returns the registered commands ordered by scope and name
+func Commands() []*Command {
+	commandsMu.RLock()
+	list := make([]*Command, 0, len(commands))
+	for _, cmd := range commands {
+		list = append(list, cmd)
+	}
+	commandsMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Scope != list[j].Scope {
+			return list[i].Scope < list[j].Scope
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// convert decodes a value of a message into a struct
+func convert(v interface{}, target interface{}) error {
+	vB, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(vB, target)
+}
+
+func stringList(v interface{}) []string {
+	list := []string{}
+	if values, ok := v.([]interface{}); ok {
+		for _, value := range values {
+			if s, ok := value.(string); ok {
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
+
+// coerce checks the type of a value, strings are converted since REST queries only know strings
+func coerce(param Param, v interface{}) (interface{}, error) {
+	s, isString := v.(string)
+	fail := errors.New("the parameter <" + param.Name + "> has to be of the type " + param.Type + "!")
+	switch param.Type {
+	case ParamString:
+		if !isString {
+			return nil, fail
+		}
+	case ParamBool:
+		if _, ok := v.(bool); ok {
+			return v, nil
+		}
+		b, err := strconv.ParseBool(s)
+		if !isString || err != nil {
+			return nil, fail
+		}
+		return b, nil
+	case ParamNumber:
+		if _, ok := v.(float64); ok {
+			return v, nil
+		}
+		n, err := strconv.ParseFloat(s, 64)
+		if !isString || err != nil {
+			return nil, fail
+		}
+		return n, nil
+	case ParamList:
+		if _, ok := v.([]interface{}); ok {
+			return v, nil
+		}
+		if !isString {
+			return nil, fail
+		}
+		list := []interface{}{}
+		for _, item := range strings.Split(s, ",") {
+			if item != "" {
+				list = append(list, item)
+			}
+		}
+		return list, nil
+	case ParamObject:
+		if _, ok := v.(map[string]interface{}); ok {
+			return v, nil
+		}
+		o := map[string]interface{}{}
+		if !isString || json.Unmarshal([]byte(s), &o) != nil {
+			return nil, fail
+		}
+		return o, nil
+	}
+	return v, nil
+}
+
+// parse collects the declared parameters of a message and checks their types
+func (cmd *Command) parse(msg *evmsg.Message) (Params, error) {
+	values := map[string]interface{}{}
+	switch data := msg.Data.(type) {
+	case map[string]interface{}:
+		values = data
+	case []interface{}:
+		for i := len(data) - 1; i >= 0; i-- {
+			if m, ok := data[i].(map[string]interface{}); ok {
+				for k, v := range m {
+					values[k] = v
+				}
+			}
+		}
+	}
+	params := Params{}
+	for _, param := range cmd.Params {
+		v, ok := values[param.Name]
+		if !ok || v == nil || v == "" {
+			if param.Required {
+				return nil, errors.New("the parameter <" + param.Name + "> is missing!")
+			}
+			continue
+		}
+		v, err := coerce(param, v)
+		if err != nil {
+			return nil, err
+		}
+		params[param.Name] = v
+	}
+	if cmd.Scope == "Object" {
+		if err := CheckBucket(params.String("bucket")); err != nil {
+			return nil, err
+		}
+	}
+	return params, nil
+}
+
+// Permission returns the permission of an identity, the service client administrates the service
+func (f *Files) Permission(identity string) string {
+	if identity == "" {
+		return ""
+	}
+	if identity == f.WSClient {
+		return PermissionAdmin
+	}
+	if permission, ok := IdentityPermissions[identity]; ok {
+		return permission
+	}
+	return PermissionWrite
+}
+
+// Allowed reports if an identity has a permission
+func (f *Files) Allowed(identity, permission string) bool {
+	return identity != "" && permissionLevels[f.Permission(identity)] >= permissionLevels[permission]
+}
+
+// Dispatch runs a command of the protocol for an identity, failed commands return the
+// message with the error and a CommandError for the status of the REST API
+func (f *Files) Dispatch(ctx context.Context, identity string, msg *evmsg.Message) (*evmsg.Message, error) {
+	start, scope, command := time.Now(), msg.Scope, msg.Command
+	name := "command unknown"
+	if _, ok := lookupCommand(scope, command); ok {
+		name = "command " + scope + "/" + command
+	}
+	ctx, span := StartSpan(ctx, name, SpanServer)
+	span.SetAttribute("files.scope", scope)
+	span.SetAttribute("files.command", command)
+	span.SetAttribute("files.identity", identity)
+	bucket, _ := msg.Value("bucket").(string)
+	file, _ := msg.Value("file").(string)
+	nMsg, err := f.dispatch(ctx, identity, msg)
+	observeCommand(scope, command, start, err)
+	f.auditCommand(ctx, identity, scope, command, bucket, file, err)
+	span.Finish(err)
+	return nMsg, err
+}
+
+func (f *Files) dispatch(ctx context.Context, identity string, msg *evmsg.Message) (*evmsg.Message, error) {
+	cmd, ok := lookupCommand(msg.Scope, msg.Command)
+	if !ok {
+		return failed(msg, &CommandError{Status: http.StatusNotFound, Code: "unknown_command", Err: errors.New("the command <" + msg.Command + "> of the scope <" + msg.Scope + "> is not known!")})
+	}
+	if !f.Allowed(identity, cmd.Permission) {
+		return failed(msg, &CommandError{Status: http.StatusForbidden, Code: "forbidden", Err: errors.New("the command <" + msg.Scope + "/" + msg.Command + "> needs the permission <" + cmd.Permission + ">!")})
+	}
+	params, err := cmd.parse(msg)
+	if err == nil && cmd.Validate != nil {
+		err = cmd.Validate(params)
+	}
+	if err != nil {
+		return failed(msg, &CommandError{Status: http.StatusBadRequest, Code: "invalid_parameter", Err: err})
+	}
+	if ctx.Err() != nil {
+		return failed(msg, &CommandError{Status: http.StatusRequestTimeout, Code: "canceled", Err: errors.New("the command <" + msg.Scope + "/" + msg.Command + "> was canceled!")})
+	}
+	nMsg, err := cmd.Run(ctx, f, params)
+	if nMsg == nil {
+		nMsg = msg
+	}
+	nMsg.State = "Response"
+	if err != nil {
+		if nMsg.Debug.Error == "" {
+			nMsg.Debug.Error = err.Error()
+		}
+		return nMsg, err
+	}
+	return nMsg, nil
+}
+
+// failed answers a command the dispatcher rejected, the data tells the clients why
+func failed(msg *evmsg.Message, err *CommandError) (*evmsg.Message, error) {
+	msg.State = "Response"
+	msg.Debug.Error = err.Error()
+	msg.Data = []interface{}{map[string]interface{}{"code": err.Code, "scope": msg.Scope, "command": msg.Command, "error": err.Error()}}
+	return msg, err
+}
+
+// CommandsMessage describes the registered commands with their parameters and permissions
+func CommandsMessage() *evmsg.Message {
+	msg := evmsg.NewMessage()
+	msg.State = "Response"
+	list := []interface{}{}
+	for _, cmd := range Commands() {
+		entry := map[string]interface{}{
+			"scope":       cmd.Scope,
+			"command":     cmd.Name,
+			"description": cmd.Description,
+			"permission":  cmd.Permission,
+			"params":      cmd.Params,
+		}
+		if cmd.Path != "" {
+			entry["method"] = cmd.Method
+			entry["path"] = RESTPrefix + cmd.Path
+		}
+		list = append(list, entry)
+	}
+	msg.Data = list
+	return msg
+}
+
+func bucketParam() Param {
+	return Param{Name: "bucket", Type: ParamString, Required: true}
+}
+
+func fileParam() Param {
+	return Param{Name: "file", Type: ParamString, Required: true}
+}
+
+func init() {
+	RegisterCommand(&Command{Scope: "System", Name: "commands", Description: "lists the commands of the protocol", Permission: PermissionRead,
+		Method: http.MethodGet, Path: "/commands",
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			return CommandsMessage(), nil
+		}})
+	RegisterCommand(&Command{Scope: "System", Name: "cancel", Description: "cancels a request of the same websocket connection", Permission: PermissionRead,
+		Params: []Param{{Name: "requestId", Type: ParamString, Required: true}},
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			// the connections answer it themselves, it only reaches the dispatcher from elsewhere
+			return nil, commandError(http.StatusBadRequest, errors.New("only requests of the websocket connection can be canceled!"))
+		}})
+	RegisterCommand(&Command{Scope: "System", Name: "connections", Description: "returns the counters of the websocket connections", Permission: PermissionAdmin,
+		Method: http.MethodGet, Path: "/connections",
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			stats := map[string]interface{}{}
+			if err := convert(f.WebsocketStats(), &stats); err != nil {
+				return nil, err
+			}
+			msg := evmsg.NewMessage()
+			msg.Data = []interface{}{stats}
+			return msg, nil
+		}})
+	RegisterCommand(&Command{Scope: "Audit", Name: "query", Description: "returns the latest entries of the audit log, since and until are RFC 3339 times", Permission: PermissionAdmin,
+		Params: []Param{{Name: "identity", Type: ParamString}, {Name: "action", Type: ParamString}, {Name: "bucket", Type: ParamString}, {Name: "key", Type: ParamString},
+			{Name: "since", Type: ParamString}, {Name: "until", Type: ParamString}, {Name: "limit", Type: ParamNumber}},
+		Validate: func(p Params) error {
+			for _, name := range []string{"since", "until"} {
+				if _, err := auditTime(p.String(name)); err != nil {
+					return errors.New("the parameter <" + name + "> has to be an RFC 3339 time!")
+				}
+			}
+			return nil
+		},
+		Method: http.MethodGet, Path: "/audit",
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			if f.WSAudit == nil {
+				return nil, commandError(http.StatusNotImplemented, errors.New("the audit log is not enabled!"))
+			}
+			since, _ := auditTime(p.String("since"))
+			until, _ := auditTime(p.String("until"))
+			return f.WSAudit.AuditMessage(AuditQuery{
+				Identity: p.String("identity"),
+				Action:   p.String("action"),
+				Bucket:   p.String("bucket"),
+				Key:      p.String("key"),
+				Since:    since,
+				Until:    until,
+				Limit:    p.Int("limit", 100),
+			})
+		}})
+	RegisterCommand(&Command{Scope: "Object", Name: "delete", Description: "removes an object and its meta information", Permission: PermissionWrite,
+		Params: []Param{bucketParam(), fileParam()}, Method: http.MethodDelete, Path: "/buckets/:bucket/objects/*",
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			return f.storageOf(ctx).RemoveObject(p.String("bucket"), p.String("file"))
+		}})
+	RegisterCommand(&Command{Scope: "Object", Name: "get", Description: "caches an object and returns its meta information", Permission: PermissionRead,
+		Params: []Param{bucketParam(), fileParam()}, Method: http.MethodGet, Path: "/buckets/:bucket/meta/*",
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			if err := CheckScan(f.storageOf(ctx), p.String("bucket"), p.String("file")); err != nil {
+				return nil, commandError(http.StatusForbidden, err)
+			}
+			return f.storageOf(ctx).GetObject(p.String("bucket"), p.String("file"))
+		}})
+	RegisterCommand(&Command{Scope: "Object", Name: "getList", Description: "lists the objects of a bucket", Permission: PermissionRead,
+		Params: []Param{bucketParam(), {Name: "prefix", Type: ParamString}}, Method: http.MethodGet, Path: "/buckets/:bucket/objects",
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			return f.storageOf(ctx).ListObjects(minio.BucketInfo{Name: p.String("bucket")}, p.String("prefix"))
+		}})
+	RegisterCommand(&Command{Scope: "Object", Name: "verify", Description: "compares the objects of a bucket with their checksums", Permission: PermissionRead,
+		Params: []Param{bucketParam(), {Name: "prefix", Type: ParamString}}, Method: http.MethodPost, Path: "/buckets/:bucket/verify",
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			return VerifyBucket(f.storageOf(ctx), p.String("bucket"), p.String("prefix"))
+		}})
+	RegisterCommand(&Command{Scope: "Object", Name: "update", Description: "changes the description and the tags of an object", Permission: PermissionWrite,
+		Params: []Param{bucketParam(), fileParam(), {Name: "description", Type: ParamString}, {Name: "tags", Type: ParamString}}, Method: http.MethodPatch, Path: "/buckets/:bucket/meta/*",
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			changes := map[string]string{}
+			for _, field := range []string{"description", "tags"} {
+				if _, ok := p[field]; ok {
+					changes[field] = p.String(field)
+				}
+			}
+			return UpdateMeta(f.storageOf(ctx), p.String("file"), changes)
+		}})
+	RegisterCommand(&Command{Scope: "Object", Name: "similar", Description: "finds visually similar images", Permission: PermissionRead,
+		Params: []Param{bucketParam(), fileParam(), {Name: "allBuckets", Type: ParamBool}, {Name: "distance", Type: ParamNumber}},
+		Validate: func(p Params) error {
+			if d := p.Int("distance", SimilarDefaultDistance); d < 0 || d > 64 {
+				return errors.New("the distance has to be between 0 and 64!")
+			}
+			return nil
+		},
+		Method: http.MethodGet, Path: "/buckets/:bucket/similar/*",
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			return FindSimilar(f.storageOf(ctx), p.String("bucket"), p.String("file"), p.Bool("allBuckets"), p.Int("distance", SimilarDefaultDistance))
+		}})
+	RegisterCommand(&Command{Scope: "Object", Name: "transformURL", Description: "returns the url of an image transformation", Permission: PermissionRead,
+		Params: []Param{bucketParam(), fileParam(), {Name: "pipeline", Type: ParamAny, Required: true}, {Name: "ttl", Type: ParamNumber}},
+		Validate: func(p Params) error {
+			_, err := ParseTransformPipeline(p["pipeline"])
+			return err
+		},
+		Method: http.MethodPost, Path: "/buckets/:bucket/transforms/*",
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			pipeline, _ := ParseTransformPipeline(p["pipeline"])
+			return TransformURL(p.String("bucket"), p.String("file"), pipeline, int64(p.Int("ttl", 0)))
+		}})
+	RegisterCommand(&Command{Scope: "Object", Name: "archive", Description: "returns the download path of an archive", Permission: PermissionRead,
+		Params: []Param{bucketParam(), {Name: "format", Type: ParamString}, {Name: "prefix", Type: ParamString}, {Name: "keys", Type: ParamList}, {Name: "manifest", Type: ParamBool}},
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			return ArchiveMessage(p.String("bucket"), p.String("format"), p.String("prefix"), p.Strings("keys"), p.Bool("manifest"))
+		}})
+	RegisterCommand(&Command{Scope: "Search", Name: "query", Description: "searches the keys, the meta information and the EXIF fields", Permission: PermissionRead,
+		Params: []Param{{Name: "query", Type: ParamString}, {Name: "bucket", Type: ParamString}, {Name: "prefix", Type: ParamString}, {Name: "sort", Type: ParamString}, {Name: "order", Type: ParamString},
+			{Name: "offset", Type: ParamNumber}, {Name: "limit", Type: ParamNumber}, {Name: "tags", Type: ParamList}, {Name: "filters", Type: ParamObject}},
+		Validate: func(p Params) error {
+			if p.Int("offset", 0) < 0 || p.Int("limit", 0) < 0 {
+				return errors.New("the offset and the limit can not be negative!")
+			}
+			switch p.String("sort") {
+			case "", "score", "size", "modified", "key":
+			default:
+				return errors.New("the results can only be sorted by score, size, modified or key!")
+			}
+			switch p.String("order") {
+			case "", "asc", "desc":
+			default:
+				return errors.New("the order has to be asc or desc!")
+			}
+			return nil
+		},
+		Method: http.MethodGet, Path: "/search",
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			index, ok := SearchIndex(f.WSStorage)
+			if !ok {
+				return nil, commandError(http.StatusNotImplemented, errors.New("the search is not enabled!"))
+			}
+			q := SearchQuery{
+				Query:   p.String("query"),
+				Bucket:  p.String("bucket"),
+				Prefix:  p.String("prefix"),
+				Sort:    p.String("sort"),
+				Order:   p.String("order"),
+				Offset:  p.Int("offset", 0),
+				Limit:   p.Int("limit", 0),
+				Tags:    p.Strings("tags"),
+				Filters: map[string]string{},
+			}
+			for field, value := range p.Object("filters") {
+				if v, ok := value.(string); ok {
+					q.Filters[field] = v
+				}
+			}
+			return index.Search(q)
+		}})
+	RegisterCommand(&Command{Scope: "Search", Name: "reindex", Description: "rebuilds the search index from the storage", Permission: PermissionAdmin,
+		Method: http.MethodPost, Path: "/search/reindex",
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			index, ok := SearchIndex(f.WSStorage)
+			if !ok {
+				return nil, commandError(http.StatusNotImplemented, errors.New("the search is not enabled!"))
+			}
+			return index.Rebuild()
+		}})
+	RegisterCommand(&Command{Scope: "Bucket", Name: "create", Description: "creates a bucket", Permission: PermissionWrite,
+		Params: []Param{bucketParam()}, Method: http.MethodPost, Path: "/buckets",
+		Validate: func(p Params) error {
+			return CheckBucket(p.String("bucket"))
+		},
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			return f.storageOf(ctx).CreateBucket(p.String("bucket"))
+		}})
+	RegisterCommand(&Command{Scope: "Bucket", Name: "setWatermark", Description: "sets the watermark policy of a bucket", Permission: PermissionAdmin,
+		Params: []Param{bucketParam(), {Name: "policy", Type: ParamObject, Required: true}}, Method: http.MethodPut, Path: "/buckets/:bucket/watermark",
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			policy := &WatermarkPolicy{Opacity: WatermarkOpacity}
+			if err := convert(p["policy"], policy); err != nil {
+				return nil, commandError(http.StatusBadRequest, err)
+			}
+			return PutWatermarkPolicy(f.storageOf(ctx), p.String("bucket"), policy)
+		}})
+	RegisterCommand(&Command{Scope: "Bucket", Name: "getWatermark", Description: "returns the watermark policy of a bucket", Permission: PermissionRead,
+		Params: []Param{bucketParam()}, Method: http.MethodGet, Path: "/buckets/:bucket/watermark",
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			return WatermarkPolicyMessage(f.storageOf(ctx), p.String("bucket"))
+		}})
+	RegisterCommand(&Command{Scope: "Bucket", Name: "removeWatermark", Description: "removes the watermark policy of a bucket", Permission: PermissionAdmin,
+		Params: []Param{bucketParam()}, Method: http.MethodDelete, Path: "/buckets/:bucket/watermark",
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			return RemoveWatermarkPolicy(f.storageOf(ctx), p.String("bucket"))
+		}})
+	RegisterCommand(&Command{Scope: "Bucket", Name: "dedupReport", Description: "reports the savings of the deduplication", Permission: PermissionAdmin,
+		Method: http.MethodGet, Path: "/dedup",
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			return DedupReport(f.WSStorage)
+		}})
+	RegisterCommand(&Command{Scope: "Bucket", Name: "getList", Description: "lists the buckets", Permission: PermissionRead,
+		Method: http.MethodGet, Path: "/buckets",
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			return f.storageOf(ctx).ListBuckets()
+		}})
+}
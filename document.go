@@ -0,0 +1,358 @@
+package files
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/xml"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var DocumentTextMaxLength int = 64 << 10
+var DocumentExcerptLength int = 200
+
+// IsDocument reports if the file is a document the text can be extracted from
+func IsDocument(file string) bool {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".pdf", ".docx", ".odt", ".txt":
+		return true
+	}
+	return false
+}
+
+// ExtractText returns the plain text and the page count of a document
+func ExtractText(file string, r io.ReaderAt, size int64) (string, int, error) {
+	var text string
+	var pages int
+	var err error
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".pdf":
+		text, pages, err = pdfText(io.NewSectionReader(r, 0, size))
+	case ".docx":
+		text, pages, err = docxText(r, size)
+	case ".odt":
+		text, pages, err = odtText(r, size)
+	case ".txt":
+		var tB []byte
+		tB, err = ioutil.ReadAll(io.LimitReader(io.NewSectionReader(r, 0, size), int64(DocumentTextMaxLength)))
+		text, pages = string(tB), 1
+	default:
+		err = errors.New("the text of <" + file + "> can not be extracted!")
+	}
+	if len(text) > DocumentTextMaxLength {
+		text = text[:DocumentTextMaxLength]
+	}
+	return strings.TrimSpace(text), pages, err
+}
+
+// AddTextMeta stores the extracted text and the page count in the meta information
+func AddTextMeta(meta map[string]string, file string, r io.ReaderAt, size int64) {
+	if !IsDocument(file) {
+		return
+	}
+	text, pages, err := ExtractText(file, r, size)
+	if err != nil {
+		return
+	}
+	meta["text"] = text
+	meta["pages"] = strconv.Itoa(pages)
+}
+
+// Excerpt shortens an extracted text for listings
+func Excerpt(text string) string {
+	if len(text) <= DocumentExcerptLength {
+		return text
+	}
+	return strings.ToValidUTF8(text[:DocumentExcerptLength], "") + "..."
+}
+
+var pdfStream = regexp.MustCompile(`(?s)<<(.*?)>>\s*stream\r?\n`)
+var pdfPage = regexp.MustCompile(`/Type\s*/Page[^s]`)
+
+func pdfText(r io.Reader) (string, int, error) {
+	pdf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", 0, err
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF")) {
+		return "", 0, errors.New("the given data is not a PDF document!")
+	}
+	text := bytes.NewBuffer(nil)
+	for _, loc := range pdfStream.FindAllSubmatchIndex(pdf, -1) {
+		dict := pdf[loc[2]:loc[3]]
+		start := loc[1]
+		end := bytes.Index(pdf[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		data := pdf[start : start+end]
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			zr, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				continue
+			}
+			data, _ = ioutil.ReadAll(io.LimitReader(zr, 16<<20))
+			zr.Close()
+		} else if bytes.Contains(dict, []byte("/Filter")) {
+			// images and other encodings carry no text
+			continue
+		}
+		pdfContentText(data, text)
+		if text.Len() > DocumentTextMaxLength {
+			break
+		}
+	}
+	pages := len(pdfPage.FindAll(pdf, -1))
+	return text.String(), pages, nil
+}
+
+// pdfContentText collects the strings shown by the Tj, TJ, ' and " operators of a content stream
+func pdfContentText(content []byte, text *bytes.Buffer) {
+	var pending []string
+	for i := 0; i < len(content); i++ {
+		switch content[i] {
+		case '(':
+			s, n := pdfString(content[i:])
+			pending = append(pending, s)
+			i += n - 1
+		case '[':
+			pending = pending[:0]
+		case 'T':
+			if i+1 < len(content) && (content[i+1] == 'j' || content[i+1] == 'J') {
+				text.WriteString(strings.Join(pending, ""))
+				pending = pending[:0]
+			} else if i+1 < len(content) && (content[i+1] == 'd' || content[i+1] == 'D' || content[i+1] == '*') {
+				text.WriteString("\n")
+			}
+		case '\'', '"':
+			text.WriteString("\n" + strings.Join(pending, ""))
+			pending = pending[:0]
+		case 'E':
+			if i+1 < len(content) && content[i+1] == 'T' {
+				text.WriteString("\n")
+			}
+		}
+	}
+}
+
+// pdfString decodes a literal string starting at an opening parenthesis and returns it with its length
+func pdfString(data []byte) (string, int) {
+	out := bytes.NewBuffer(nil)
+	depth := 0
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '\\' && i+1 < len(data):
+			i++
+			switch data[i] {
+			case 'n':
+				out.WriteByte('\n')
+			case 'r', 't', 'b', 'f':
+				out.WriteByte(' ')
+			case '\r', '\n':
+			default:
+				if data[i] >= '0' && data[i] <= '7' {
+					j := i
+					for j < len(data) && j < i+3 && data[j] >= '0' && data[j] <= '7' {
+						j++
+					}
+					v, _ := strconv.ParseUint(string(data[i:j]), 8, 8)
+					out.WriteByte(byte(v))
+					i = j - 1
+				} else {
+					out.WriteByte(data[i])
+				}
+			}
+		case c == '(':
+			if depth > 0 {
+				out.WriteByte(c)
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return out.String(), i + 1
+			}
+			out.WriteByte(c)
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String(), len(data)
+}
+
+func zipFile(zr *zip.Reader, name string) ([]byte, error) {
+	for _, zf := range zr.File {
+		if zf.Name == name {
+			rc, err := zf.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return ioutil.ReadAll(io.LimitReader(rc, 64<<20))
+		}
+	}
+	return nil, errors.New("the document contains no <" + name + ">!")
+}
+
+// xmlText collects the character data of an office XML part, the given elements end a paragraph
+func xmlText(data []byte, textElement string, paragraphs ...string) string {
+	text := bytes.NewBuffer(nil)
+	d := xml.NewDecoder(bytes.NewReader(data))
+	inText := textElement == ""
+	for {
+		token, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Local == textElement {
+				inText = true
+			}
+			if t.Name.Local == "tab" {
+				text.WriteString("\t")
+			}
+		case xml.EndElement:
+			if t.Name.Local == textElement && textElement != "" {
+				inText = false
+			}
+			for _, p := range paragraphs {
+				if t.Name.Local == p {
+					text.WriteString("\n")
+				}
+			}
+		case xml.CharData:
+			if inText {
+				text.Write(t)
+			}
+		}
+		if text.Len() > DocumentTextMaxLength {
+			break
+		}
+	}
+	return text.String()
+}
+
+var docxPages = regexp.MustCompile(`<Pages>(\d+)</Pages>`)
+var odtPages = regexp.MustCompile(`meta:page-count="(\d+)"`)
+
+func docxText(r io.ReaderAt, size int64) (string, int, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return "", 0, err
+	}
+	doc, err := zipFile(zr, "word/document.xml")
+	if err != nil {
+		return "", 0, err
+	}
+	pages := 0
+	if app, err := zipFile(zr, "docProps/app.xml"); err == nil {
+		if m := docxPages.FindSubmatch(app); m != nil {
+			pages, _ = strconv.Atoi(string(m[1]))
+		}
+	}
+	return xmlText(doc, "t", "p"), pages, nil
+}
+
+func odtText(r io.ReaderAt, size int64) (string, int, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return "", 0, err
+	}
+	content, err := zipFile(zr, "content.xml")
+	if err != nil {
+		return "", 0, err
+	}
+	pages := 0
+	if meta, err := zipFile(zr, "meta.xml"); err == nil {
+		if m := odtPages.FindSubmatch(meta); m != nil {
+			pages, _ = strconv.Atoi(string(m[1]))
+		}
+	}
+	return xmlText(content, "", "p", "h"), pages, nil
+}
+
+var placeholderColors = map[string]color.RGBA{
+	".pdf":  {0xD3, 0x2F, 0x2F, 0xFF},
+	".docx": {0x29, 0x5C, 0xB8, 0xFF},
+	".odt":  {0x2E, 0x8B, 0x57, 0xFF},
+	".txt":  {0x75, 0x75, 0x75, 0xFF},
+	".mp4":  {0x6A, 0x1B, 0x9A, 0xFF},
+	".m4v":  {0x6A, 0x1B, 0x9A, 0xFF},
+	".mov":  {0x6A, 0x1B, 0x9A, 0xFF},
+	".webm": {0x6A, 0x1B, 0x9A, 0xFF},
+	".mkv":  {0x6A, 0x1B, 0x9A, 0xFF},
+	".mp3":  {0xEF, 0x6C, 0x00, 0xFF},
+	".m4a":  {0xEF, 0x6C, 0x00, 0xFF},
+}
+
+// DocumentThumbnail returns the embedded first page preview of office documents,
+// every other document gets a placeholder
+func DocumentThumbnail(file string, r io.ReaderAt, size int64) ([]byte, error) {
+	ext := strings.ToLower(filepath.Ext(file))
+	if ext == ".docx" || ext == ".odt" {
+		if zr, err := zip.NewReader(r, size); err == nil {
+			for _, name := range []string{"Thumbnails/thumbnail.png", "docProps/thumbnail.jpeg", "docProps/thumbnail.png"} {
+				tB, err := zipFile(zr, name)
+				if err != nil {
+					continue
+				}
+				img, _, err := image.Decode(bytes.NewReader(tB))
+				if err != nil {
+					continue
+				}
+				return encodeThumbnail(img, ".png")
+			}
+		}
+	}
+	return PlaceholderThumbnail(ext)
+}
+
+// PlaceholderThumbnail draws a page with a folded corner in the color of the file type
+func PlaceholderThumbnail(ext string) ([]byte, error) {
+	const width, height, fold = 125, 160, 28
+	c, ok := placeholderColors[ext]
+	if !ok {
+		c = placeholderColors[".txt"]
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.Transparent, image.Point{}, draw.Src)
+	border := color.RGBA{0xBD, 0xBD, 0xBD, 0xFF}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			// cut the upper right corner
+			if x > width-fold && y < fold-(width-x) {
+				continue
+			}
+			switch {
+			case x == 0 || y == 0 || x == width-1 || y == height-1 || (x > width-fold && y == fold-(width-x)):
+				img.Set(x, y, border)
+			case x > width-fold && y < fold && x < width-fold+y+1 && y >= fold-(width-x):
+				img.Set(x, y, color.RGBA{0xE0, 0xE0, 0xE0, 0xFF})
+			case y >= height-36 && y < height-12:
+				img.Set(x, y, c)
+			case y >= 40 && y < height-48 && y%10 < 3 && x >= 14 && x < width-14-(y%30):
+				img.Set(x, y, color.RGBA{0xCC, 0xCC, 0xCC, 0xFF})
+			default:
+				img.Set(x, y, color.White)
+			}
+		}
+	}
+	imgBuffer := bytes.NewBuffer(nil)
+	err := png.Encode(imgBuffer, img)
+	if err != nil {
+		return nil, err
+	}
+	return imgBuffer.Bytes(), nil
+}
@@ -0,0 +1,77 @@
+package files
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func testOffice(t *testing.T, files map[string]string) []byte {
+	buff := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buff)
+	for name, content := range files {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	zw.Close()
+	return buff.Bytes()
+}
+
+func Test_Unit_ExtractTextPdf(t *testing.T) {
+	content := bytes.NewBuffer(nil)
+	zw := zlib.NewWriter(content)
+	zw.Write([]byte("BT /F1 12 Tf 72 712 Td (Hello \\(PDF\\)) Tj T* [(Wor) -20 (ld)] TJ ET"))
+	zw.Close()
+	pdf := bytes.NewBuffer(nil)
+	pdf.WriteString("%PDF-1.4\n1 0 obj << /Type /Pages /Kids [2 0 R 3 0 R] /Count 2 >> endobj\n")
+	pdf.WriteString("2 0 obj << /Type /Page /Parent 1 0 R >> endobj\n3 0 obj << /Type /Page /Parent 1 0 R >> endobj\n")
+	pdf.WriteString("4 0 obj << /Length 42 /Filter /FlateDecode >>\nstream\n")
+	pdf.Write(content.Bytes())
+	pdf.WriteString("\nendstream\nendobj\n%%EOF")
+	text, pages, err := ExtractText("doc.pdf", bytes.NewReader(pdf.Bytes()), int64(pdf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "Hello (PDF)\nWorld" || pages != 2 {
+		t.Errorf("unexpected pdf text %q with %d pages", text, pages)
+	}
+}
+
+func Test_Unit_ExtractTextOffice(t *testing.T) {
+	docx := testOffice(t, map[string]string{
+		"word/document.xml": `<w:document xmlns:w="w"><w:body><w:p><w:r><w:t>First</w:t></w:r></w:p><w:p><w:r><w:t>Second</w:t></w:r></w:p></w:body></w:document>`,
+		"docProps/app.xml":  `<Properties><Pages>3</Pages></Properties>`,
+	})
+	text, pages, err := ExtractText("doc.docx", bytes.NewReader(docx), int64(len(docx)))
+	if err != nil || text != "First\nSecond" || pages != 3 {
+		t.Errorf("unexpected docx text %q with %d pages %v", text, pages, err)
+	}
+	odt := testOffice(t, map[string]string{
+		"content.xml": `<office:document-content xmlns:office="o" xmlns:text="t"><office:body><text:h>Title</text:h><text:p>Body</text:p></office:body></office:document-content>`,
+		"meta.xml":    `<office:meta><meta:document-statistic meta:page-count="1"/></office:meta>`,
+	})
+	text, pages, err = ExtractText("doc.odt", bytes.NewReader(odt), int64(len(odt)))
+	if err != nil || text != "Title\nBody" || pages != 1 {
+		t.Errorf("unexpected odt text %q with %d pages %v", text, pages, err)
+	}
+}
+
+func Test_Unit_DocumentThumbnail(t *testing.T) {
+	tB, err := DocumentThumbnail("notes.txt", strings.NewReader("notes"), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(tB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 125 {
+		t.Error("unexpected placeholder width", img.Bounds().Dx())
+	}
+}
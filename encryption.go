@@ -0,0 +1,338 @@
+package files
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+var EncryptionKeyFile string = ""
+var EncryptionKeysBucket string = "keys"
+var EncryptionCacheKey string = "cache"
+var EncryptionChunkSize int = 64 << 10
+
+var encryptionMagic = []byte("FEN1")
+
+const encryptionPrefixSize = 7
+const encryptionHeaderSize = 4 + encryptionPrefixSize
+const encryptionTagSize = 16
+
+// KeyStore persists the wrapped data keys
+type KeyStore interface {
+	// LoadKey fails with an error IsNotFound reports if the key does not exist
+	LoadKey(name string) ([]byte, error)
+	SaveKey(name string, wrapped []byte) error
+	ListKeys() ([]string, error)
+}
+
+// Crypt holds the master key and the unwrapped data keys of every bucket
+type Crypt struct {
+	Store  KeyStore
+	master []byte
+	keys   map[string][]byte
+	lock   sync.Mutex
+}
+
+func NewCrypt(store KeyStore, master []byte) (*Crypt, error) {
+	if len(master) != 32 {
+		return nil, errors.New("the master key has to be 32 bytes long!")
+	}
+	return &Crypt{Store: store, master: master, keys: map[string][]byte{}}, nil
+}
+
+// LoadMasterKey reads a 32 byte master key from a keyfile, the key can be stored raw, hex or base64 encoded
+func LoadMasterKey(file string) ([]byte, error) {
+	kB, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(kB) == 32 {
+		return kB, nil
+	}
+	kS := strings.TrimSpace(string(kB))
+	if key, err := hex.DecodeString(kS); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(kS); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("the keyfile <" + file + "> does not contain a 32 byte key!")
+}
+
+func seal(key, plain, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, aad), nil
+}
+
+func open(key, sealed, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("the sealed data is too short!")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], aad)
+}
+
+// DataKey returns the data key of a bucket, a new one is created and wrapped on first use
+func (c *Crypt) DataKey(name string) ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if key, ok := c.keys[name]; ok {
+		return key, nil
+	}
+	wrapped, err := c.Store.LoadKey(name)
+	if err == nil {
+		key, err := open(c.master, wrapped, []byte(name))
+		if err != nil {
+			return nil, errors.New("the data key of <" + name + "> can not be unwrapped with the master key!")
+		}
+		c.keys[name] = key
+		return key, nil
+	}
+	if !IsNotFound(err) {
+		// a new key would replace the stored one and every object encrypted with it is lost
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	wrapped, err = seal(c.master, key, []byte(name))
+	if err != nil {
+		return nil, err
+	}
+	err = c.Store.SaveKey(name, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	c.keys[name] = key
+	return key, nil
+}
+
+// Rotate re-wraps every data key with a new master key, the data itself stays untouched.
+// Keys already wrapped with the new master are kept, so a rotation that failed while
+// writing and could not be rolled back is finished by running it again
+func (c *Crypt) Rotate(master []byte) (int, error) {
+	if len(master) != 32 {
+		return 0, errors.New("the master key has to be 32 bytes long!")
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	names, err := c.Store.ListKeys()
+	if err != nil {
+		return 0, err
+	}
+	previous := map[string][]byte{}
+	rewrapped := map[string][]byte{}
+	for _, name := range names {
+		wrapped, err := c.Store.LoadKey(name)
+		if err != nil {
+			return 0, err
+		}
+		key, err := open(c.master, wrapped, []byte(name))
+		if err != nil {
+			if _, rErr := open(master, wrapped, []byte(name)); rErr == nil {
+				// rotated by an earlier run
+				continue
+			}
+			return 0, errors.New("the data key of <" + name + "> can not be unwrapped with the current master key!")
+		}
+		previous[name] = wrapped
+		rewrapped[name], err = seal(master, key, []byte(name))
+		if err != nil {
+			return 0, err
+		}
+	}
+	// only write once every key could be unwrapped, a failed write restores the keys written before
+	written := []string{}
+	for _, name := range names {
+		if _, ok := rewrapped[name]; !ok {
+			continue
+		}
+		if err := c.Store.SaveKey(name, rewrapped[name]); err != nil {
+			for _, done := range written {
+				if rErr := c.Store.SaveKey(done, previous[done]); rErr != nil {
+					return 0, errors.New("the rotation failed with <" + err.Error() + "> and could not be rolled back, run it again with the same keys!")
+				}
+			}
+			return 0, err
+		}
+		written = append(written, name)
+	}
+	c.master = master
+	return len(written), nil
+}
+
+// EncryptedSize returns the stored size of n bytes plaintext
+func EncryptedSize(n int64) int64 {
+	chunks := (n + int64(EncryptionChunkSize) - 1) / int64(EncryptionChunkSize)
+	if chunks == 0 {
+		chunks = 1
+	}
+	return encryptionHeaderSize + n + chunks*encryptionTagSize
+}
+
+// DecryptedSize returns the plaintext size of n bytes stored encrypted
+func DecryptedSize(n int64) int64 {
+	n -= encryptionHeaderSize
+	if n < encryptionTagSize {
+		return 0
+	}
+	chunks := (n + int64(EncryptionChunkSize+encryptionTagSize) - 1) / int64(EncryptionChunkSize+encryptionTagSize)
+	return n - chunks*encryptionTagSize
+}
+
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionPrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encryptReader struct {
+	src     *bufio.Reader
+	gcm     cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buff    bytes.Buffer
+	done    bool
+}
+
+// NewEncryptReader encrypts src in chunks with AES-GCM, every chunk is authenticated
+// on its own and the last chunk is flagged so a truncation is detected
+func NewEncryptReader(src io.Reader, key []byte) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	r := &encryptReader{src: bufio.NewReaderSize(src, EncryptionChunkSize), gcm: gcm, prefix: make([]byte, encryptionPrefixSize)}
+	if _, err := io.ReadFull(rand.Reader, r.prefix); err != nil {
+		return nil, err
+	}
+	r.buff.Write(encryptionMagic)
+	r.buff.Write(r.prefix)
+	return r, nil
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for r.buff.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		chunk := make([]byte, EncryptionChunkSize)
+		n, err := io.ReadFull(r.src, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		if _, err := r.src.Peek(1); err != nil {
+			r.done = true
+		}
+		r.buff.Write(r.gcm.Seal(nil, chunkNonce(r.prefix, r.counter, r.done), chunk[:n], nil))
+		r.counter++
+	}
+	return r.buff.Read(p)
+}
+
+type decryptReader struct {
+	src     *bufio.Reader
+	gcm     cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buff    bytes.Buffer
+	done    bool
+}
+
+// NewDecryptReader reverses NewEncryptReader
+func NewDecryptReader(src io.Reader, key []byte) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	r := &decryptReader{src: bufio.NewReaderSize(src, EncryptionChunkSize+encryptionTagSize), gcm: gcm}
+	header := make([]byte, encryptionHeaderSize)
+	if _, err := io.ReadFull(r.src, header); err != nil {
+		return nil, errors.New("the encrypted data has no valid header!")
+	}
+	if !bytes.Equal(header[:4], encryptionMagic) {
+		return nil, errors.New("the data is not encrypted by the files service!")
+	}
+	r.prefix = header[4:]
+	return r, nil
+}
+
+// IsEncrypted reports whether src starts with a chunk NewEncryptReader wrote with key, the magic alone
+// could be the start of a plaintext object
+func IsEncrypted(src io.Reader, key []byte) (bool, error) {
+	head := make([]byte, encryptionHeaderSize+EncryptionChunkSize+encryptionTagSize+1)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	dec, err := NewDecryptReader(bytes.NewReader(head[:n]), key)
+	if err != nil {
+		return false, nil
+	}
+	_, err = dec.Read(make([]byte, 1))
+	return err == nil || err == io.EOF, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for r.buff.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		chunk := make([]byte, EncryptionChunkSize+encryptionTagSize)
+		n, err := io.ReadFull(r.src, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		if _, err := r.src.Peek(1); err != nil {
+			r.done = true
+		}
+		plain, err := r.gcm.Open(nil, chunkNonce(r.prefix, r.counter, r.done), chunk[:n], nil)
+		if err != nil {
+			return 0, errors.New("the encrypted data is corrupt or truncated!")
+		}
+		r.buff.Write(plain)
+		r.counter++
+	}
+	return r.buff.Read(p)
+}
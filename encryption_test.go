@@ -0,0 +1,187 @@
+package files
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+)
+
+type memKeyStore map[string][]byte
+
+func (s memKeyStore) LoadKey(name string) ([]byte, error) {
+	wrapped, ok := s[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return wrapped, nil
+}
+
+func (s memKeyStore) SaveKey(name string, wrapped []byte) error {
+	s[name] = wrapped
+	return nil
+}
+
+func (s memKeyStore) ListKeys() ([]string, error) {
+	names := []string{}
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// failingKeyStore fails loading every key and saving the given keys
+type failingKeyStore struct {
+	memKeyStore
+	load error
+	save map[string]bool
+}
+
+func (s failingKeyStore) LoadKey(name string) ([]byte, error) {
+	if s.load != nil {
+		return nil, s.load
+	}
+	return s.memKeyStore.LoadKey(name)
+}
+
+func (s failingKeyStore) SaveKey(name string, wrapped []byte) error {
+	if s.save[name] {
+		return errors.New("the storage is not reachable")
+	}
+	return s.memKeyStore.SaveKey(name, wrapped)
+}
+
+func testKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func Test_Unit_EncryptDecrypt(t *testing.T) {
+	key := testKey(t)
+	for _, size := range []int{0, 1, EncryptionChunkSize - 1, EncryptionChunkSize, 3*EncryptionChunkSize + 7} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		enc, err := NewEncryptReader(bytes.NewReader(plain), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cipherB, err := ioutil.ReadAll(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(cipherB)) != EncryptedSize(int64(size)) || DecryptedSize(int64(len(cipherB))) != int64(size) {
+			t.Error("unexpected encrypted size for", size, len(cipherB))
+		}
+		dec, err := NewDecryptReader(bytes.NewReader(cipherB), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plainB, err := ioutil.ReadAll(dec)
+		if err != nil || !bytes.Equal(plain, plainB) {
+			t.Error("decryption failed for", size, err)
+		}
+		if size > EncryptionChunkSize {
+			// cutting off the last chunk has to be detected
+			dec, _ := NewDecryptReader(bytes.NewReader(cipherB[:encryptionHeaderSize+EncryptionChunkSize+encryptionTagSize]), key)
+			if _, err := ioutil.ReadAll(dec); err == nil {
+				t.Error("expected the truncation to be detected")
+			}
+		}
+	}
+}
+
+func Test_Unit_CryptRotate(t *testing.T) {
+	store := memKeyStore{}
+	crypt, err := NewCrypt(store, testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := crypt.DataKey("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newMaster := testKey(t)
+	rotated, err := crypt.Rotate(newMaster)
+	if err != nil || rotated != 1 {
+		t.Fatal("rotation failed", rotated, err)
+	}
+	rotatedCrypt, _ := NewCrypt(store, newMaster)
+	rotatedKey, err := rotatedCrypt.DataKey("test")
+	if err != nil || !bytes.Equal(key, rotatedKey) {
+		t.Error("expected the data key to survive the rotation", err)
+	}
+	oldCrypt, _ := NewCrypt(store, testKey(t))
+	if _, err := oldCrypt.DataKey("test"); err == nil {
+		t.Error("expected a wrong master key to fail")
+	}
+}
+
+func Test_Unit_CryptStoreErrors(t *testing.T) {
+	store := memKeyStore{}
+	master := testKey(t)
+	crypt, _ := NewCrypt(store, master)
+	key, _ := crypt.DataKey("a")
+	crypt.DataKey("b")
+	stored := append([]byte{}, store["a"]...)
+	broken, _ := NewCrypt(failingKeyStore{memKeyStore: store, load: errors.New("timeout")}, master)
+	if _, err := broken.DataKey("a"); err == nil || !bytes.Equal(store["a"], stored) {
+		t.Error("a failed read must not replace the stored key", err)
+	}
+
+	failing := failingKeyStore{memKeyStore: store, save: map[string]bool{"b": true}}
+	crypt, _ = NewCrypt(failing, master)
+	newMaster := testKey(t)
+	if _, err := crypt.Rotate(newMaster); err == nil {
+		t.Fatal("the rotation has to fail")
+	}
+	if _, err := open(master, store["a"], []byte("a")); err != nil {
+		t.Error("the written keys have to be rolled back", err)
+	}
+	if _, err := open(master, store["b"], []byte("b")); err != nil {
+		t.Error("the keys not written have to stay unchanged", err)
+	}
+
+	// a rotation left half done is finished by running it again
+	store["a"], _ = seal(newMaster, key, []byte("a"))
+	crypt, _ = NewCrypt(store, master)
+	if count, err := crypt.Rotate(newMaster); err != nil || count != 1 {
+		t.Fatal("only the keys left over have to be counted", count, err)
+	}
+	rotated, _ := NewCrypt(store, newMaster)
+	for _, name := range []string{"a", "b"} {
+		if _, err := rotated.DataKey(name); err != nil {
+			t.Error("every key has to be rotated", name, err)
+		}
+	}
+}
+
+func Test_Unit_IsEncrypted(t *testing.T) {
+	key := testKey(t)
+	for _, size := range []int{0, 10, EncryptionChunkSize, 3*EncryptionChunkSize + 5} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		enc, _ := NewEncryptReader(bytes.NewReader(plain), key)
+		data, _ := ioutil.ReadAll(enc)
+		if encrypted, err := IsEncrypted(bytes.NewReader(data), key); !encrypted || err != nil {
+			t.Error("expected the data to be encrypted", size, err)
+		}
+		if encrypted, err := IsEncrypted(bytes.NewReader(plain), key); encrypted || err != nil {
+			t.Error("expected plaintext", size, err)
+		}
+		if encrypted, _ := IsEncrypted(bytes.NewReader(data), testKey(t)); encrypted {
+			t.Error("data of another key is no encrypted data of this key", size)
+		}
+	}
+	// plaintext that happens to start with the magic
+	if encrypted, _ := IsEncrypted(bytes.NewReader(append([]byte("FEN1"), make([]byte, 100)...)), key); encrypted {
+		t.Error("the magic alone does not make the data encrypted")
+	}
+}
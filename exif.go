@@ -0,0 +1,162 @@
+package files
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var exifTags = map[uint16]string{
+	0x010F: "make",
+	0x0110: "model",
+	0x0112: "orientation",
+	0x0131: "software",
+	0x0132: "datetime",
+	0x013B: "artist",
+	0x8298: "copyright",
+	0x829A: "exposure_time",
+	0x829D: "f_number",
+	0x8827: "iso",
+	0x9003: "datetime_original",
+	0x920A: "focal_length",
+	0xA002: "width",
+	0xA003: "height",
+	0xA434: "lens_model",
+}
+
+const exifIFDPointer = 0x8769
+
+// ReadExif returns the well known EXIF fields of a JPEG image
+func ReadExif(r io.Reader) (map[string]string, error) {
+	br := bufio.NewReader(r)
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(br, soi); err != nil || soi[0] != 0xFF || soi[1] != 0xD8 {
+		return nil, errors.New("the given data is not a JPEG image!")
+	}
+	hdr := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(br, hdr); err != nil {
+			return nil, err
+		}
+		if hdr[0] != 0xFF {
+			return nil, errors.New("the JPEG segments are corrupt!")
+		}
+		size := int(binary.BigEndian.Uint16(hdr[2:])) - 2
+		// start of scan, no metadata follows
+		if hdr[1] == 0xDA || size < 0 {
+			return map[string]string{}, nil
+		}
+		if hdr[1] != 0xE1 {
+			if _, err := br.Discard(size); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		segment := make([]byte, size)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return parseTiff(segment[6:])
+		}
+	}
+}
+
+func parseTiff(tiff []byte) (map[string]string, error) {
+	if len(tiff) < 8 {
+		return nil, errors.New("the EXIF data is too short!")
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("the EXIF byte order is unknown!")
+	}
+	fields := map[string]string{}
+	ifd := order.Uint32(tiff[4:])
+	exifIFD := parseIFD(tiff, order, ifd, fields)
+	if exifIFD > 0 {
+		parseIFD(tiff, order, exifIFD, fields)
+	}
+	return fields, nil
+}
+
+// parseIFD reads the known tags of one directory and returns the offset of the EXIF sub directory
+func parseIFD(tiff []byte, order binary.ByteOrder, offset uint32, fields map[string]string) uint32 {
+	if int(offset)+2 > len(tiff) {
+		return 0
+	}
+	var exifIFD uint32
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := int(offset) + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		tag := order.Uint16(tiff[entry:])
+		typ := order.Uint16(tiff[entry+2:])
+		n := order.Uint32(tiff[entry+4:])
+		value := tiff[entry+8 : entry+12]
+		if tag == exifIFDPointer {
+			exifIFD = order.Uint32(value)
+			continue
+		}
+		name, ok := exifTags[tag]
+		if !ok {
+			continue
+		}
+		switch typ {
+		case 2: // ascii
+			data := value
+			if n > 4 {
+				start := order.Uint32(value)
+				if int(start)+int(n) > len(tiff) {
+					continue
+				}
+				data = tiff[start : start+n]
+			}
+			if int(n) <= len(data) {
+				data = data[:n]
+			}
+			fields[name] = strings.TrimSpace(strings.TrimRight(string(data), "\x00"))
+		case 3: // short
+			fields[name] = strconv.Itoa(int(order.Uint16(value)))
+		case 4: // long
+			fields[name] = strconv.FormatUint(uint64(order.Uint32(value)), 10)
+		case 5: // rational
+			start := order.Uint32(value)
+			if int(start)+8 > len(tiff) {
+				continue
+			}
+			num := order.Uint32(tiff[start:])
+			den := order.Uint32(tiff[start+4:])
+			if den == 0 {
+				continue
+			}
+			if num < den && num != 0 {
+				fields[name] = "1/" + strconv.FormatFloat(float64(den)/float64(num), 'f', 0, 64)
+			} else {
+				fields[name] = strconv.FormatFloat(float64(num)/float64(den), 'f', -1, 64)
+			}
+		}
+	}
+	return exifIFD
+}
+
+// AddExifMeta stores the EXIF fields of an image with the prefix exif_ in the meta information
+func AddExifMeta(meta map[string]string, r io.Reader) {
+	fields, err := ReadExif(r)
+	if err != nil {
+		return
+	}
+	for name, value := range fields {
+		meta["exif_"+name] = value
+	}
+}
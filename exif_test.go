@@ -0,0 +1,49 @@
+package files
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testJpeg builds a JPEG header with an EXIF segment containing make, orientation and iso
+func testJpeg() []byte {
+	tiff := bytes.NewBuffer(nil)
+	le := binary.LittleEndian
+	tiff.WriteString("II*\x00")
+	binary.Write(tiff, le, uint32(8))
+	// IFD0 with 3 entries at offset 8, the ascii value follows at 8+2+3*12+4=50
+	binary.Write(tiff, le, uint16(3))
+	binary.Write(tiff, le, []uint16{0x010F, 2})
+	binary.Write(tiff, le, []uint32{6, 50})
+	binary.Write(tiff, le, []uint16{0x0112, 3})
+	binary.Write(tiff, le, []uint32{1, 6})
+	binary.Write(tiff, le, []uint16{0x8769, 4})
+	binary.Write(tiff, le, []uint32{1, 56})
+	binary.Write(tiff, le, uint32(0))
+	tiff.WriteString("Canon\x00")
+	// EXIF IFD at offset 56
+	binary.Write(tiff, le, uint16(1))
+	binary.Write(tiff, le, []uint16{0x8827, 3})
+	binary.Write(tiff, le, []uint32{1, 200})
+	binary.Write(tiff, le, uint32(0))
+	segment := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	jpg := bytes.NewBuffer([]byte{0xFF, 0xD8, 0xFF, 0xE1})
+	binary.Write(jpg, binary.BigEndian, uint16(len(segment)+2))
+	jpg.Write(segment)
+	jpg.Write([]byte{0xFF, 0xDA, 0x00, 0x02})
+	return jpg.Bytes()
+}
+
+func Test_Unit_ReadExif(t *testing.T) {
+	fields, err := ReadExif(bytes.NewReader(testJpeg()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields["make"] != "Canon" || fields["orientation"] != "6" || fields["iso"] != "200" {
+		t.Error("unexpected exif fields", fields)
+	}
+	if _, err := ReadExif(bytes.NewReader([]byte("not a jpeg"))); err == nil {
+		t.Error("expected an error for a non JPEG")
+	}
+}
@@ -0,0 +1,248 @@
+package files
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"path"
+	"strconv"
+	"strings"
+
+	"evalgo.org/evmsg"
+)
+
+var ExtractMaxEntries int = 1000
+var ExtractMaxEntrySize int64 = 64 << 20
+var ExtractMaxTotalSize int64 = 1 << 30
+var ExtractMaxRatio uint64 = 100
+
+// IsArchive reports if the given file name is an archive that can be extracted
+func IsArchive(file string) bool {
+	file = strings.ToLower(file)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(file, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExtractKey joins prefix and archive entry name into an object key,
+// entries escaping the prefix (zip slip) are rejected
+func ExtractKey(prefix, name string) (string, error) {
+	name = strings.Replace(name, "\\", "/", -1)
+	if strings.HasPrefix(name, "/") || strings.Contains(name, ":") {
+		return "", errors.New("the archive entry <" + name + "> has an absolute path!")
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", errors.New("the archive entry <" + name + "> leaves the target prefix!")
+		}
+	}
+	key := path.Clean(name)
+	if prefix != "" {
+		key = strings.TrimSuffix(prefix, "/") + "/" + key
+	}
+	return key, nil
+}
+
+type extractor struct {
+	storage     Storage
+	scanner     Scanner
+	bucket      string
+	prefix      string
+	description string
+	archive     string
+	entries     int
+	total       int64
+	report      []interface{}
+}
+
+// ExtractArchive stores every entry of a zip or tar archive as object below prefix,
+// the returned message contains a report for every entry
+func ExtractArchive(s Storage, scanner Scanner, bucket, prefix, description string, file *multipart.FileHeader) (*evmsg.Message, error) {
+	msg := evmsg.NewMessage()
+	msg.State = "Response"
+	x := &extractor{storage: s, scanner: scanner, bucket: bucket, prefix: prefix, description: description, archive: file.Filename, report: []interface{}{}}
+	src, err := file.Open()
+	if err != nil {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	defer src.Close()
+	name := strings.ToLower(file.Filename)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		err = x.zip(src, file.Size)
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		var gr *gzip.Reader
+		gr, err = gzip.NewReader(src)
+		if err == nil {
+			err = x.tar(gr)
+			gr.Close()
+		}
+	case strings.HasSuffix(name, ".tar"):
+		err = x.tar(src)
+	default:
+		err = errors.New("the given archive <" + file.Filename + "> is not supported!")
+	}
+	msg.Data = x.report
+	if err != nil {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	return msg, nil
+}
+
+func (x *extractor) zip(src io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(src, size)
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		if zf.CompressedSize64 > 0 && zf.UncompressedSize64/zf.CompressedSize64 > ExtractMaxRatio {
+			err := errors.New("the archive entry <" + zf.Name + "> exceeds the compression ratio of " + strconv.FormatUint(ExtractMaxRatio, 10) + "!")
+			x.add(zf.Name, "", 0, err)
+			return err
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			x.add(zf.Name, "", 0, err)
+			return err
+		}
+		err = x.entry(zf.Name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extractor) tar(src io.Reader) error {
+	tr := tar.NewReader(src)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		err = x.entry(hdr.Name, tr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// entry stores a single archive entry, policy violations are reported and skipped,
+// exceeded limits abort the extraction
+func (x *extractor) entry(name string, r io.Reader) error {
+	x.entries++
+	if x.entries > ExtractMaxEntries {
+		err := errors.New("the archive contains more than " + strconv.Itoa(ExtractMaxEntries) + " entries!")
+		x.add(name, "", 0, err)
+		return err
+	}
+	key, err := ExtractKey(x.prefix, name)
+	if err != nil {
+		x.add(name, "", 0, err)
+		return nil
+	}
+	err = CheckUploadExtension(key)
+	if err != nil {
+		x.add(name, key, 0, err)
+		return nil
+	}
+	// never trust the sizes of the archive headers
+	data, err := ioutil.ReadAll(io.LimitReader(r, ExtractMaxEntrySize+1))
+	if err != nil {
+		x.add(name, key, 0, err)
+		return err
+	}
+	if int64(len(data)) > ExtractMaxEntrySize {
+		err = errors.New("the archive entry <" + name + "> exceeds the maximum size of " + strconv.FormatInt(ExtractMaxEntrySize, 10) + " bytes!")
+		x.add(name, key, 0, err)
+		return err
+	}
+	x.total += int64(len(data))
+	if x.total > ExtractMaxTotalSize {
+		err = errors.New("the archive exceeds the maximum extracted size of " + strconv.FormatInt(ExtractMaxTotalSize, 10) + " bytes!")
+		x.add(name, key, 0, err)
+		return err
+	}
+	fh, err := NewFileHeader(key, data)
+	if err != nil {
+		x.add(name, key, 0, err)
+		return err
+	}
+	checksum, err := ComputeChecksum(ChecksumDefaultAlgorithm, bytes.NewReader(data))
+	if err != nil {
+		x.add(name, key, 0, err)
+		return err
+	}
+	meta := map[string]string{"name": key, "description": x.description, "archive": x.archive, "checksum": checksum}
+	AddExifMeta(meta, bytes.NewReader(data))
+	AddTextMeta(meta, key, bytes.NewReader(data), int64(len(data)))
+	AddMediaMeta(meta, key, bytes.NewReader(data), int64(len(data)))
+	AddImageHashMeta(meta, key, bytes.NewReader(data))
+	if x.scanner != nil {
+		meta["scan"] = ScanPending
+		err = PutScanState(x.storage, x.bucket, key, meta)
+	} else {
+		err = RemoveScanState(x.storage, x.bucket, key)
+	}
+	if err != nil {
+		x.add(name, key, 0, err)
+		return err
+	}
+	err = x.storage.PutObject(x.bucket, fh)
+	if err != nil {
+		x.add(name, key, 0, err)
+		return err
+	}
+	err = PutMeta(x.storage, key, meta)
+	if err != nil {
+		x.add(name, key, 0, err)
+		return err
+	}
+	if x.scanner != nil {
+		result, err := ScanObject(x.scanner, x.storage, x.bucket, key, bytes.NewReader(data), meta)
+		if err != nil {
+			x.add(name, key, 0, errors.New("the entry stays quarantined, the scan failed: "+err.Error()))
+			return nil
+		}
+		if result.Infected {
+			x.add(name, key, 0, errors.New("the entry is infected with <"+result.Signature+">!"))
+			return nil
+		}
+	}
+	x.add(name, key, int64(len(data)), nil)
+	return nil
+}
+
+func (x *extractor) add(name, key string, size int64, err error) {
+	entry := map[string]interface{}{
+		"entry": name,
+		"key":   key,
+		"size":  size,
+		"state": "OK",
+	}
+	if err != nil {
+		entry["state"] = "rejected"
+		entry["error"] = err.Error()
+	}
+	x.report = append(x.report, entry)
+}
@@ -0,0 +1,100 @@
+package files
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func testZip(t *testing.T, entries map[string][]byte) []byte {
+	buff := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buff)
+	for name, data := range entries {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buff.Bytes()
+}
+
+func Test_Unit_ExtractKey(t *testing.T) {
+	key, err := ExtractKey("batch/", "day1/photo.jpg")
+	if err != nil || key != "batch/day1/photo.jpg" {
+		t.Error("unexpected key", key, err)
+	}
+	for _, name := range []string{"../photo.jpg", "a/../../photo.jpg", "/etc/photo.jpg", "..\\photo.jpg", "c:/photo.jpg"} {
+		if _, err := ExtractKey("batch", name); err == nil {
+			t.Error("expected zip slip rejection for", name)
+		}
+	}
+}
+
+func Test_Unit_ExtractArchive(t *testing.T) {
+	s := newMemStorage()
+	zB := testZip(t, map[string][]byte{
+		"one.jpg":     []byte("one"),
+		"../evil.jpg": []byte("evil"),
+		"notes.exe":   []byte("binary"),
+		"sub/two.png": []byte("two"),
+	})
+	fh, err := NewFileHeader("batch.zip", zB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ExtractArchive(s, nil, "test", "batch", "holiday", fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Data.([]interface{})) != 4 {
+		t.Error("expected a report for every entry", msg.Data)
+	}
+	if string(s.objects["test"]["batch/one.jpg"]) != "one" || string(s.objects["test"]["batch/sub/two.png"]) != "two" {
+		t.Error("expected extracted objects", s.objects["test"])
+	}
+	if len(s.objects["test"]) != 2 {
+		t.Error("expected rejected entries not to be stored", s.objects["test"])
+	}
+	if !strings.Contains(string(s.objects["meta"]["batch/one.json"]), "holiday") {
+		t.Error("expected meta information for the extracted object")
+	}
+}
+
+func Test_Unit_ExtractArchiveBomb(t *testing.T) {
+	s := newMemStorage()
+	zB := testZip(t, map[string][]byte{"bomb.jpg": bytes.Repeat([]byte{0}, 1<<20)})
+	fh, err := NewFileHeader("bomb.zip", zB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ExtractArchive(s, nil, "test", "", "", fh)
+	if err == nil {
+		t.Error("expected the compression ratio limit to abort the extraction")
+	}
+	if len(s.objects["test"]) != 0 {
+		t.Error("expected no stored objects")
+	}
+}
+
+func Test_Unit_NewFileHeaderBoundary(t *testing.T) {
+	data := []byte("before\r\n--myBoundary\r\nafter\r\n--myBoundary--\r\n")
+	fh, err := NewFileHeader("a/data.txt", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := fh.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	read, _ := ioutil.ReadAll(src)
+	if !bytes.Equal(read, data) || fh.Filename != "a/data.txt" {
+		t.Error("the data has to be kept as it is", string(read), fh.Filename)
+	}
+}
@@ -0,0 +1,128 @@
+package files
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+	"github.com/neko-neko/echo-logrus/v2/log"
+)
+
+// RequiredBuckets returns the buckets the service can not work without
+func RequiredBuckets() []string {
+	buckets := []string{"meta"}
+	if DedupEnabled {
+		buckets = append(buckets, DedupBucket)
+	}
+	if EncryptionKeyFile != "" {
+		buckets = append(buckets, EncryptionKeysBucket)
+	}
+	return buckets
+}
+
+// createBuckets creates the buckets that do not exist yet
+func createBuckets(s Storage, buckets []string) error {
+	for _, bucket := range buckets {
+		exists, err := HasBucket(s, bucket)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if _, err := s.CreateBucket(bucket); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ensureBuckets retries creating the buckets until the storage answers
+func ensureBuckets(s Storage, buckets []string) {
+	for {
+		time.Sleep(time.Duration(MinioConnectionSecondsTimeout) * time.Second)
+		err := createBuckets(s, buckets)
+		if err == nil {
+			return
+		}
+		log.Logger().Error(err)
+	}
+}
+
+// Readiness checks everything the service needs to answer requests, the
+// checks map their names to ok or to the reason they failed
+func (f *Files) Readiness() (bool, map[string]string) {
+	checks := map[string]string{}
+	fail := func(check string, err error) {
+		checks[check] = err.Error()
+	}
+	f.wsMu.Lock()
+	closing := f.wsClosing
+	f.wsMu.Unlock()
+	if closing {
+		fail("shutdown", errors.New("the service is shutting down!"))
+	}
+	if f.WSStorage == nil {
+		fail("storage", errors.New("the storage is not connected!"))
+	} else if msg, err := f.WSStorage.ListBuckets(); err != nil {
+		fail("storage", err)
+	} else {
+		checks["storage"] = "ok"
+		existing := map[interface{}]bool{}
+		list, _ := msg.Data.([]interface{})
+		for _, b := range list {
+			if bucket, ok := b.(map[string]interface{}); ok {
+				existing[bucket["name"]] = true
+			}
+		}
+		missing := []string{}
+		for _, bucket := range RequiredBuckets() {
+			if !existing[bucket] {
+				missing = append(missing, bucket)
+			}
+		}
+		if len(missing) > 0 {
+			fail("buckets", errors.New("the buckets <"+strings.Join(missing, ", ")+"> are missing!"))
+		} else {
+			checks["buckets"] = "ok"
+		}
+	}
+	if err := checkWritable(MinioFilesCacheDir); err != nil {
+		fail("cache", err)
+	} else {
+		checks["cache"] = "ok"
+	}
+	for _, result := range checks {
+		if result != "ok" {
+			return false, checks
+		}
+	}
+	return true, checks
+}
+
+// checkWritable creates and removes a file in a directory
+func checkWritable(dir string) error {
+	fd, err := ioutil.TempFile(dir, ".ready")
+	if err != nil {
+		return err
+	}
+	fd.Close()
+	return os.Remove(fd.Name())
+}
+
+// RegisterHealth adds the liveness and the readiness routes for the orchestrators, they need no identity
+func (f *Files) RegisterHealth(e *echo.Echo) {
+	e.GET("/healthz", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, map[string]interface{}{"status": "ok"})
+	})
+	e.GET("/readyz", func(c echo.Context) error {
+		ready, checks := f.Readiness()
+		if !ready {
+			return c.JSON(http.StatusServiceUnavailable, map[string]interface{}{"status": "unavailable", "checks": checks})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"status": "ok", "checks": checks})
+	})
+}
@@ -0,0 +1,537 @@
+package files
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// MediaInfo describes the streams of an audio or video file
+type MediaInfo struct {
+	Type       string
+	Duration   float64
+	VideoCodec string
+	AudioCodec string
+	Width      int
+	Height     int
+	Bitrate    int64
+	SampleRate int
+	Channels   int
+	// Poster is an embedded cover picture, videos are not decoded
+	Poster []byte
+}
+
+// MediaProbe inspects media uploads, the default parses the containers in pure Go
+// and can be replaced by probes using external tools
+type MediaProbe interface {
+	Probe(file string, r io.ReaderAt, size int64) (*MediaInfo, error)
+}
+
+var MediaProber MediaProbe = &ContainerProbe{}
+
+// IsMedia reports if the file is an audio or video file
+func IsMedia(file string) bool {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".mp4", ".m4v", ".m4a", ".mov", ".webm", ".mkv", ".mp3":
+		return true
+	}
+	return false
+}
+
+// AddMediaMeta stores the probed media information in the meta information
+func AddMediaMeta(meta map[string]string, file string, r io.ReaderAt, size int64) {
+	if !IsMedia(file) {
+		return
+	}
+	info, err := MediaProber.Probe(file, r, size)
+	if err != nil {
+		return
+	}
+	meta["media_type"] = info.Type
+	meta["duration"] = strconv.FormatFloat(info.Duration, 'f', 3, 64)
+	if info.Duration > 0 && info.Bitrate == 0 {
+		info.Bitrate = int64(float64(size*8) / info.Duration)
+	}
+	meta["bitrate"] = strconv.FormatInt(info.Bitrate, 10)
+	if info.VideoCodec != "" {
+		meta["video_codec"] = info.VideoCodec
+		meta["width"] = strconv.Itoa(info.Width)
+		meta["height"] = strconv.Itoa(info.Height)
+	}
+	if info.AudioCodec != "" {
+		meta["audio_codec"] = info.AudioCodec
+		meta["sample_rate"] = strconv.Itoa(info.SampleRate)
+		meta["channels"] = strconv.Itoa(info.Channels)
+	}
+}
+
+// MediaThumbnail returns the embedded poster of a media file scaled to a thumbnail,
+// files without one get a placeholder
+func MediaThumbnail(file string, r io.ReaderAt, size int64) ([]byte, error) {
+	info, err := MediaProber.Probe(file, r, size)
+	if err == nil && len(info.Poster) > 0 {
+		if img, _, err := image.Decode(bytes.NewReader(info.Poster)); err == nil {
+			return encodeThumbnail(img, ".jpg")
+		}
+	}
+	return PlaceholderThumbnail(strings.ToLower(filepath.Ext(file)))
+}
+
+// ContainerProbe reads MP4, Matroska/WebM and MP3 headers
+type ContainerProbe struct{}
+
+func (p *ContainerProbe) Probe(file string, r io.ReaderAt, size int64) (*MediaInfo, error) {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".mp4", ".m4v", ".m4a", ".mov":
+		return probeMP4(r, size)
+	case ".webm", ".mkv":
+		return probeMatroska(r, size)
+	case ".mp3":
+		return probeMP3(r, size)
+	}
+	return nil, errors.New("the media type of <" + file + "> is not supported!")
+}
+
+func readAt(r io.ReaderAt, off int64, n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := r.ReadAt(b, off); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// mp4 boxes that only contain other boxes
+var mp4Containers = map[string]int64{
+	"moov": 0, "trak": 0, "mdia": 0, "minf": 0, "stbl": 0, "udta": 0, "ilst": 0, "covr": 0, "edts": 0,
+	// the meta box has a version and flags before its children
+	"meta": 4,
+}
+
+type mp4Probe struct {
+	r       io.ReaderAt
+	info    *MediaInfo
+	handler string
+}
+
+func probeMP4(r io.ReaderAt, size int64) (*MediaInfo, error) {
+	p := &mp4Probe{r: r, info: &MediaInfo{}}
+	if err := p.boxes(0, size, 0); err != nil {
+		return nil, err
+	}
+	if p.info.VideoCodec != "" {
+		p.info.Type = "video"
+	} else if p.info.AudioCodec != "" {
+		p.info.Type = "audio"
+	} else {
+		return nil, errors.New("the mp4 container contains no audio or video track!")
+	}
+	return p.info, nil
+}
+
+func (p *mp4Probe) boxes(start, end int64, depth int) error {
+	if depth > 16 {
+		return errors.New("the mp4 boxes are nested too deep!")
+	}
+	for off := start; off+8 <= end; {
+		hdr, err := readAt(p.r, off, 8)
+		if err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr))
+		typ := string(hdr[4:])
+		hdrSize := int64(8)
+		switch size {
+		case 0:
+			size = end - off
+		case 1:
+			large, err := readAt(p.r, off+8, 8)
+			if err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(large))
+			hdrSize = 16
+		}
+		if size < hdrSize || off+size > end {
+			return errors.New("the mp4 box <" + typ + "> is corrupt!")
+		}
+		payload, payloadSize := off+hdrSize, size-hdrSize
+		if skip, ok := mp4Containers[typ]; ok {
+			if err := p.boxes(payload+skip, off+size, depth+1); err != nil {
+				return err
+			}
+		} else if payloadSize <= 1<<20 || typ == "data" {
+			if err := p.box(typ, payload, payloadSize); err != nil {
+				return err
+			}
+		}
+		off += size
+	}
+	return nil
+}
+
+func (p *mp4Probe) box(typ string, off, size int64) error {
+	if size > 16<<20 {
+		return nil
+	}
+	b, err := readAt(p.r, off, int(size))
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case "mvhd":
+		if len(b) >= 32 && b[0] == 1 {
+			timescale := binary.BigEndian.Uint32(b[20:])
+			if timescale > 0 {
+				p.info.Duration = float64(binary.BigEndian.Uint64(b[24:])) / float64(timescale)
+			}
+		} else if len(b) >= 20 {
+			timescale := binary.BigEndian.Uint32(b[12:])
+			if timescale > 0 {
+				p.info.Duration = float64(binary.BigEndian.Uint32(b[16:])) / float64(timescale)
+			}
+		}
+	case "hdlr":
+		if len(b) >= 12 {
+			p.handler = string(b[8:12])
+		}
+	case "stsd":
+		// the first sample entry names the codec
+		if len(b) < 16 {
+			return nil
+		}
+		codec := string(b[12:16])
+		entry := b[8:]
+		switch p.handler {
+		case "vide":
+			p.info.VideoCodec = codec
+			if len(entry) >= 36 {
+				p.info.Width = int(binary.BigEndian.Uint16(entry[32:]))
+				p.info.Height = int(binary.BigEndian.Uint16(entry[34:]))
+			}
+		case "soun":
+			p.info.AudioCodec = codec
+			if len(entry) >= 36 {
+				p.info.Channels = int(binary.BigEndian.Uint16(entry[24:]))
+				p.info.SampleRate = int(binary.BigEndian.Uint16(entry[32:]))
+			}
+		}
+	case "data":
+		// the cover art of moov/udta/meta/ilst/covr
+		if len(b) > 8 && len(p.info.Poster) == 0 {
+			p.info.Poster = b[8:]
+		}
+	}
+	return nil
+}
+
+// matroska element ids
+const (
+	mkvSegment        = 0x18538067
+	mkvInfo           = 0x1549A966
+	mkvTimecodeScale  = 0x2AD7B1
+	mkvDuration       = 0x4489
+	mkvTracks         = 0x1654AE6B
+	mkvTrackEntry     = 0xAE
+	mkvTrackType      = 0x83
+	mkvCodecID        = 0x86
+	mkvVideo          = 0xE0
+	mkvPixelWidth     = 0xB0
+	mkvPixelHeight    = 0xBA
+	mkvAudio          = 0xE1
+	mkvSamplingFreq   = 0xB5
+	mkvChannels       = 0x9F
+	mkvAttachments    = 0x1941A469
+	mkvAttachedFile   = 0x61A7
+	mkvFileMimeType   = 0x4660
+	mkvFileData       = 0x465C
+	mkvCluster        = 0x1F43B675
+	mkvEBMLHeader     = 0x1A45DFA3
+	mkvMaxElementSize = 16 << 20
+)
+
+var mkvContainers = map[uint32]bool{mkvSegment: true, mkvInfo: true, mkvTracks: true, mkvTrackEntry: true, mkvVideo: true, mkvAudio: true, mkvAttachments: true, mkvAttachedFile: true}
+
+type mkvProbe struct {
+	r         io.ReaderAt
+	info      *MediaInfo
+	scale     float64
+	duration  float64
+	trackType uint64
+	codec     string
+	mime      string
+}
+
+// vint reads an EBML variable length integer, ids keep their length marker
+func (p *mkvProbe) vint(off int64, keepMarker bool) (uint64, int, error) {
+	first, err := readAt(p.r, off, 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	length := 1
+	for mask := byte(0x80); length <= 8 && first[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 {
+		return 0, 0, errors.New("the EBML integer is invalid!")
+	}
+	b, err := readAt(p.r, off, length)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !keepMarker {
+		b[0] &= byte(0xFF >> uint(length))
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	if !keepMarker && v == (uint64(1)<<(7*uint(length)))-1 {
+		return math.MaxUint64, length, nil
+	}
+	return v, length, nil
+}
+
+func probeMatroska(r io.ReaderAt, size int64) (*MediaInfo, error) {
+	p := &mkvProbe{r: r, info: &MediaInfo{}, scale: 1000000}
+	id, _, err := p.vint(0, true)
+	if err != nil || id != mkvEBMLHeader {
+		return nil, errors.New("the given data is not a matroska container!")
+	}
+	if err := p.elements(0, size, 0); err != nil {
+		return nil, err
+	}
+	p.info.Duration = p.duration * p.scale / 1e9
+	if p.info.VideoCodec != "" {
+		p.info.Type = "video"
+	} else if p.info.AudioCodec != "" {
+		p.info.Type = "audio"
+	} else {
+		return nil, errors.New("the matroska container contains no audio or video track!")
+	}
+	return p.info, nil
+}
+
+func (p *mkvProbe) elements(start, end int64, depth int) error {
+	if depth > 8 {
+		return errors.New("the matroska elements are nested too deep!")
+	}
+	for off := start; off < end; {
+		id, idLen, err := p.vint(off, true)
+		if err != nil {
+			return nil
+		}
+		size, sizeLen, err := p.vint(off+int64(idLen), false)
+		if err != nil {
+			return nil
+		}
+		payload := off + int64(idLen+sizeLen)
+		payloadEnd := end
+		if size != math.MaxUint64 {
+			payloadEnd = payload + int64(size)
+		}
+		if payloadEnd > end {
+			payloadEnd = end
+		}
+		switch {
+		case id == mkvCluster:
+			// clusters hold the frames, nothing of interest inside
+		case mkvContainers[uint32(id)]:
+			if id == mkvTrackEntry {
+				p.trackType, p.codec = 0, ""
+			}
+			if err := p.elements(payload, payloadEnd, depth+1); err != nil {
+				return err
+			}
+			if id == mkvTrackEntry {
+				switch p.trackType {
+				case 1:
+					p.info.VideoCodec = p.codec
+				case 2:
+					p.info.AudioCodec = p.codec
+				}
+			}
+			if id == mkvAttachedFile {
+				p.mime = ""
+			}
+		case payloadEnd-payload <= mkvMaxElementSize:
+			b, err := readAt(p.r, payload, int(payloadEnd-payload))
+			if err != nil {
+				return nil
+			}
+			p.element(uint32(id), b)
+		}
+		off = payloadEnd
+	}
+	return nil
+}
+
+func ebmlUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func ebmlFloat(b []byte) float64 {
+	switch len(b) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (p *mkvProbe) element(id uint32, b []byte) {
+	switch id {
+	case mkvTimecodeScale:
+		p.scale = float64(ebmlUint(b))
+	case mkvDuration:
+		p.duration = ebmlFloat(b)
+	case mkvTrackType:
+		p.trackType = ebmlUint(b)
+	case mkvCodecID:
+		p.codec = strings.TrimRight(string(b), "\x00")
+	case mkvPixelWidth:
+		p.info.Width = int(ebmlUint(b))
+	case mkvPixelHeight:
+		p.info.Height = int(ebmlUint(b))
+	case mkvSamplingFreq:
+		p.info.SampleRate = int(ebmlFloat(b))
+	case mkvChannels:
+		p.info.Channels = int(ebmlUint(b))
+	case mkvFileMimeType:
+		p.mime = string(b)
+	case mkvFileData:
+		if strings.HasPrefix(p.mime, "image/") && len(p.info.Poster) == 0 {
+			p.info.Poster = b
+		}
+	}
+}
+
+var mp3Bitrates = [2][16]int{
+	// mpeg 1 layer III
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	// mpeg 2 and 2.5 layer III
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+}
+var mp3SampleRates = [3]int{44100, 48000, 32000}
+
+func syncsafe(b []byte) int64 {
+	return int64(b[0]&0x7F)<<21 | int64(b[1]&0x7F)<<14 | int64(b[2]&0x7F)<<7 | int64(b[3]&0x7F)
+}
+
+func probeMP3(r io.ReaderAt, size int64) (*MediaInfo, error) {
+	info := &MediaInfo{Type: "audio", AudioCodec: "mp3"}
+	var off int64
+	if hdr, err := readAt(r, 0, 10); err == nil && string(hdr[:3]) == "ID3" {
+		tagSize := syncsafe(hdr[6:])
+		if tag, err := readAt(r, 10, int(tagSize)); err == nil {
+			info.Poster = id3Picture(tag, hdr[3])
+		}
+		off = 10 + tagSize
+	}
+	// search the first frame header
+	var hdr []byte
+	for limit := off + 64<<10; off < limit && off+4 <= size; off++ {
+		b, err := readAt(r, off, 4)
+		if err != nil {
+			break
+		}
+		if b[0] == 0xFF && b[1]&0xE0 == 0xE0 && b[1]&0x06 == 0x02 && b[2]&0xF0 != 0xF0 && b[2]&0x0C != 0x0C {
+			hdr = b
+			break
+		}
+	}
+	if hdr == nil {
+		return nil, errors.New("the given data contains no mp3 frame!")
+	}
+	version := (hdr[1] >> 3) & 0x03
+	mpeg1 := version == 3
+	table, samples := 1, 576
+	if mpeg1 {
+		table, samples = 0, 1152
+	}
+	info.Bitrate = int64(mp3Bitrates[table][hdr[2]>>4]) * 1000
+	info.SampleRate = mp3SampleRates[(hdr[2]>>2)&0x03]
+	switch version {
+	case 2:
+		info.SampleRate /= 2
+	case 0:
+		info.SampleRate /= 4
+	}
+	info.Channels = 2
+	mono := hdr[3]>>6 == 3
+	if mono {
+		info.Channels = 1
+	}
+	// a Xing or Info header carries the frame count of variable bitrate files
+	sideInfo := int64(32)
+	switch {
+	case mpeg1 && mono:
+		sideInfo = 17
+	case !mpeg1 && !mono:
+		sideInfo = 17
+	case !mpeg1 && mono:
+		sideInfo = 9
+	}
+	if xing, err := readAt(r, off+4+sideInfo, 12); err == nil && (string(xing[:4]) == "Xing" || string(xing[:4]) == "Info") && xing[7]&0x01 == 1 {
+		frames := binary.BigEndian.Uint32(xing[8:])
+		info.Duration = float64(frames) * float64(samples) / float64(info.SampleRate)
+		info.Bitrate = int64(float64((size-off)*8) / info.Duration)
+	} else if info.Bitrate > 0 {
+		info.Duration = float64((size-off)*8) / float64(info.Bitrate)
+	}
+	return info, nil
+}
+
+// id3Picture returns the first attached picture of an ID3v2.3 or v2.4 tag
+func id3Picture(tag []byte, version byte) []byte {
+	for off := 0; off+10 <= len(tag); {
+		id := string(tag[off : off+4])
+		if id[0] == 0 {
+			break
+		}
+		size := int(binary.BigEndian.Uint32(tag[off+4:]))
+		if version == 4 {
+			size = int(syncsafe(tag[off+4:]))
+		}
+		body := off + 10
+		if size <= 0 || body+size > len(tag) {
+			break
+		}
+		if id == "APIC" {
+			frame := tag[body : body+size]
+			encoding := frame[0]
+			// mime type, picture type and a description precede the data
+			i := bytes.IndexByte(frame[1:], 0)
+			// a short frame ends before the picture type
+			if i < 0 || 1+i+2 > len(frame) {
+				return nil
+			}
+			rest := frame[1+i+2:]
+			if encoding == 1 || encoding == 2 {
+				for j := 0; j+1 < len(rest); j += 2 {
+					if rest[j] == 0 && rest[j+1] == 0 {
+						return rest[j+2:]
+					}
+				}
+				return nil
+			}
+			j := bytes.IndexByte(rest, 0)
+			if j < 0 {
+				return nil
+			}
+			return rest[j+1:]
+		}
+		off = body + size
+	}
+	return nil
+}
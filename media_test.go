@@ -0,0 +1,132 @@
+package files
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"math"
+	"testing"
+)
+
+func mp4Box(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	box := make([]byte, 8)
+	binary.BigEndian.PutUint32(box, uint32(8+len(body)))
+	copy(box[4:], typ)
+	return append(box, body...)
+}
+
+func be(values ...interface{}) []byte {
+	buff := bytes.NewBuffer(nil)
+	for _, v := range values {
+		binary.Write(buff, binary.BigEndian, v)
+	}
+	return buff.Bytes()
+}
+
+func testPoster(t *testing.T) []byte {
+	buff := bytes.NewBuffer(nil)
+	if err := png.Encode(buff, image.NewRGBA(image.Rect(0, 0, 250, 100))); err != nil {
+		t.Fatal(err)
+	}
+	return buff.Bytes()
+}
+
+func testMP4(t *testing.T) []byte {
+	// mvhd version 0 with a timescale of 1000 and 5.5 seconds duration
+	mvhd := mp4Box("mvhd", be(uint32(0), uint32(0), uint32(0), uint32(1000), uint32(5500)), make([]byte, 80))
+	hdlr := mp4Box("hdlr", be(uint32(0), uint32(0)), []byte("vide"), make([]byte, 12))
+	entry := mp4Box("avc1", make([]byte, 24), be(uint16(1920), uint16(1080)), make([]byte, 50))
+	stsd := mp4Box("stsd", be(uint32(0), uint32(1)), entry)
+	trak := mp4Box("trak", mp4Box("mdia", hdlr, mp4Box("minf", mp4Box("stbl", stsd))))
+	covr := mp4Box("covr", mp4Box("data", be(uint32(14), uint32(0)), testPoster(t)))
+	udta := mp4Box("udta", mp4Box("meta", be(uint32(0)), mp4Box("ilst", covr)))
+	return bytes.Join([][]byte{mp4Box("ftyp", []byte("isom"), be(uint32(0))), mp4Box("moov", mvhd, trak, udta), mp4Box("mdat", make([]byte, 1000))}, nil)
+}
+
+func ebml(id uint32, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	idB := be(id)
+	for len(idB) > 1 && idB[0] == 0 {
+		idB = idB[1:]
+	}
+	// 8 byte sizes keep the test simple
+	size := be(uint64(len(body)))
+	size[0] = 0x01
+	return append(append(idB, size...), body...)
+}
+
+func Test_Unit_ProbeMP4(t *testing.T) {
+	mp4 := testMP4(t)
+	meta := map[string]string{}
+	AddMediaMeta(meta, "clip.mp4", bytes.NewReader(mp4), int64(len(mp4)))
+	if meta["media_type"] != "video" || meta["video_codec"] != "avc1" || meta["width"] != "1920" || meta["height"] != "1080" || meta["duration"] != "5.500" {
+		t.Error("unexpected mp4 meta information", meta)
+	}
+	tB, err := MediaThumbnail("clip.mp4", bytes.NewReader(mp4), int64(len(mp4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(tB))
+	if err != nil || img.Bounds().Dx() != 125 || img.Bounds().Dy() != 50 {
+		t.Error("expected the scaled cover as poster", err)
+	}
+}
+
+func Test_Unit_ProbeMatroska(t *testing.T) {
+	info := ebml(mkvInfo, ebml(mkvTimecodeScale, be(uint32(1000000))), ebml(mkvDuration, be(math.Float64bits(12000))))
+	video := ebml(mkvTrackEntry, ebml(mkvTrackType, []byte{1}), ebml(mkvCodecID, []byte("V_VP9")), ebml(mkvVideo, ebml(mkvPixelWidth, be(uint16(640))), ebml(mkvPixelHeight, be(uint16(360)))))
+	audio := ebml(mkvTrackEntry, ebml(mkvTrackType, []byte{2}), ebml(mkvCodecID, []byte("A_OPUS")), ebml(mkvAudio, ebml(mkvSamplingFreq, be(float32(48000))), ebml(mkvChannels, []byte{2})))
+	webm := append(ebml(mkvEBMLHeader, ebml(0x4282, []byte("webm"))), ebml(mkvSegment, info, ebml(mkvTracks, video, audio))...)
+	p := &ContainerProbe{}
+	mi, err := p.Probe("clip.webm", bytes.NewReader(webm), int64(len(webm)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mi.Type != "video" || mi.VideoCodec != "V_VP9" || mi.AudioCodec != "A_OPUS" || mi.Width != 640 || mi.Height != 360 || mi.Duration != 12 || mi.SampleRate != 48000 || mi.Channels != 2 {
+		t.Errorf("unexpected webm information %+v", mi)
+	}
+}
+
+func Test_Unit_ProbeMP3(t *testing.T) {
+	// mpeg 1 layer III, 128 kbit/s, 44100 Hz, stereo with a Xing header of 100 frames
+	frame := append([]byte{0xFF, 0xFB, 0x90, 0x00}, make([]byte, 32)...)
+	frame = append(frame, []byte("Xing")...)
+	frame = append(frame, be(uint32(1), uint32(100))...)
+	frame = append(frame, make([]byte, 400)...)
+	p := &ContainerProbe{}
+	mi, err := p.Probe("song.mp3", bytes.NewReader(frame), int64(len(frame)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mi.SampleRate != 44100 || mi.Channels != 2 || math.Abs(mi.Duration-100*1152/44100.0) > 0.001 {
+		t.Errorf("unexpected mp3 information %+v", mi)
+	}
+}
+
+func Test_Unit_ID3PictureTruncated(t *testing.T) {
+	apic := func(body string) []byte {
+		frame := append([]byte("APIC"), be(uint32(len(body)), uint16(0))...)
+		return append(frame, body...)
+	}
+	// the frame ends after the mime type, the picture type is missing
+	for _, body := range []string{"\x00image/jpeg\x00", "\x00image/jpeg\x00\x03", "\x00image/jpeg"} {
+		if picture := id3Picture(apic(body), 3); picture != nil {
+			t.Errorf("a truncated frame %q has no picture: %q", body, picture)
+		}
+	}
+	if picture := id3Picture(apic("\x00image/jpeg\x00\x03desc\x00data"), 3); string(picture) != "data" {
+		t.Errorf("unexpected picture %q", picture)
+	}
+	// a whole file with a truncated frame in its tag must probe without a panic
+	tag := apic("\x00image/png\x00")
+	file := append([]byte("ID3\x03\x00\x00"), byte(len(tag)>>21&0x7F), byte(len(tag)>>14&0x7F), byte(len(tag)>>7&0x7F), byte(len(tag)&0x7F))
+	file = append(file, tag...)
+	file = append(file, 0xFF, 0xFB, 0x90, 0x00)
+	file = append(file, make([]byte, 400)...)
+	p := &ContainerProbe{}
+	if mi, err := p.Probe("song.mp3", bytes.NewReader(file), int64(len(file))); err != nil || mi.Poster != nil {
+		t.Error("unexpected probe result", mi, err)
+	}
+}
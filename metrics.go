@@ -0,0 +1,402 @@
+package files
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"evalgo.org/evmsg"
+	echo "github.com/labstack/echo/v4"
+	"github.com/minio/minio-go/v6"
+)
+
+// MetricsPath serves the Prometheus metrics, empty disables it
+var MetricsPath string = "/metrics"
+
+// latencyBuckets are the upper bounds of the latency histograms in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metric is a counter, a gauge or a histogram with its series per label values
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	// read is called on every scrape by gauges that are not counted
+	read   func() float64
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+var metrics []*metric
+
+func newMetric(kind, name, help string, labels ...string) *metric {
+	m := &metric{name: name, help: help, kind: kind, labels: labels, series: map[string]*series{}}
+	metrics = append(metrics, m)
+	return m
+}
+
+func newHistogram(name, help string, labels ...string) *metric {
+	m := newMetric("histogram", name, help, labels...)
+	m.buckets = latencyBuckets
+	return m
+}
+
+func newGaugeFunc(name, help string, read func() float64) *metric {
+	m := newMetric("gauge", name, help)
+	m.read = read
+	return m
+}
+
+func (m *metric) get(values []string) *series {
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{values: values, counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add changes a counter or a gauge
+func (m *metric) add(v float64, values ...string) {
+	m.mu.Lock()
+	m.get(values).value += v
+	m.mu.Unlock()
+}
+
+func (m *metric) inc(values ...string) {
+	m.add(1, values...)
+}
+
+// observe counts a value into the buckets of a histogram
+func (m *metric) observe(v float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(values)
+	for i, bound := range m.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (m *metric) since(start time.Time, values ...string) {
+	m.observe(time.Since(start).Seconds(), values...)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer("\\", `\\`, "\"", `\"`, "\n", `\n`)
+
+func (m *metric) labelString(values []string, extra ...string) string {
+	pairs := []string{}
+	for i, name := range m.labels {
+		pairs = append(pairs, name+"=\""+labelEscaper.Replace(values[i])+"\"")
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"=\""+extra[i+1]+"\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// write renders the metric in the text format of Prometheus
+func (m *metric) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	if m.read != nil {
+		fmt.Fprintf(w, "%s %s\n", m.name, formatValue(m.read()))
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 && len(m.labels) == 0 {
+		m.get(nil)
+		keys = append(keys, "")
+	}
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, m.labelString(s.values), formatValue(s.value))
+			continue
+		}
+		for i, bound := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelString(s.values, "le", formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelString(s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, m.labelString(s.values), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, m.labelString(s.values), s.count)
+	}
+}
+
+var (
+	httpRequests      = newMetric("counter", "files_http_requests_total", "HTTP requests by route, method and status.", "route", "method", "status")
+	httpDuration      = newHistogram("files_http_request_duration_seconds", "Latency of the HTTP requests by route and method.", "route", "method")
+	commandRequests   = newMetric("counter", "files_commands_total", "Commands of the websocket and the REST API by scope, command and result code.", "scope", "command", "code")
+	commandDuration   = newHistogram("files_command_duration_seconds", "Latency of the commands by scope and command.", "scope", "command")
+	storageDuration   = newHistogram("files_storage_duration_seconds", "Latency of the storage backend by method.", "method")
+	storageErrors     = newMetric("counter", "files_storage_errors_total", "Failed calls of the storage backend by method.", "method")
+	cacheLookups      = newMetric("counter", "files_cache_lookups_total", "Lookups of the local cache by cache and result, hit or miss.", "cache", "result")
+	thumbnailDuration = newHistogram("files_thumbnail_duration_seconds", "Time to generate a thumbnail.")
+	uploadBytes       = newMetric("counter", "files_upload_bytes_total", "Bytes of the stored uploads.")
+	wsConnections     = newMetric("gauge", "files_websocket_connections", "Open websocket connections.")
+	_                 = newGaugeFunc("files_cache_bytes", "Size of the local cache.", cacheSize)
+	_                 = newGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	_ = newGaugeFunc("go_memstats_heap_alloc_bytes", "Number of heap bytes allocated and still in use.", func() float64 {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return float64(stats.HeapAlloc)
+	})
+	processStart = time.Now()
+	_            = newGaugeFunc("process_start_time_seconds", "Start time of the process since the unix epoch in seconds.", func() float64 {
+		return float64(processStart.UnixNano()) / 1e9
+	})
+)
+
+// MetricsHandler serves the metrics of the service in the text format of Prometheus
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, m := range metrics {
+			m.write(w)
+		}
+	})
+}
+
+var cacheSizeState struct {
+	sync.Mutex
+	size    int64
+	checked time.Time
+}
+
+// cacheSize walks the cache at most every 30 seconds, the scrapes would walk it far more often
+func cacheSize() float64 {
+	cacheSizeState.Lock()
+	defer cacheSizeState.Unlock()
+	if time.Since(cacheSizeState.checked) < 30*time.Second {
+		return float64(cacheSizeState.size)
+	}
+	var size int64
+	filepath.Walk(MinioFilesCacheDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	cacheSizeState.size, cacheSizeState.checked = size, time.Now()
+	return float64(size)
+}
+
+func cacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheLookups.inc(cache, result)
+}
+
+// Metrics is the echo middleware counting the requests per route template
+func Metrics(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if c.IsWebSocket() {
+			// the connections are counted by their own gauge, their duration is no latency
+			return next(c)
+		}
+		start := time.Now()
+		err := next(c)
+		status := c.Response().Status
+		if err != nil {
+			status = http.StatusInternalServerError
+			if he, ok := err.(*echo.HTTPError); ok {
+				status = he.Code
+			}
+		}
+		route := c.Path()
+		if route == "" {
+			route = "unknown"
+		}
+		httpRequests.inc(route, c.Request().Method, strconv.Itoa(status))
+		httpDuration.since(start, route, c.Request().Method)
+		return err
+	}
+}
+
+// statusRecorder keeps the status and the size of a response for the metrics and the audit log of plain handlers
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(p)
+	s.written += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// instrument counts the requests of a handler outside of the echo routes under one route name
+func instrument(route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		httpRequests.inc(route, r.Method, strconv.Itoa(rec.status))
+		httpDuration.since(start, route, r.Method)
+	})
+}
+
+// MeteredStorage measures the calls of the storage backend it wraps
+type MeteredStorage struct {
+	Storage Storage
+}
+
+func NewMeteredStorage(s Storage) *MeteredStorage {
+	return &MeteredStorage{Storage: s}
+}
+
+func observe(method string, start time.Time, err error) {
+	storageDuration.since(start, method)
+	if err != nil {
+		storageErrors.inc(method)
+	}
+}
+
+func (m *MeteredStorage) CreateBucket(bucket string) (*evmsg.Message, error) {
+	start := time.Now()
+	msg, err := m.Storage.CreateBucket(bucket)
+	observe("CreateBucket", start, err)
+	return msg, err
+}
+
+func (m *MeteredStorage) ListBuckets() (*evmsg.Message, error) {
+	start := time.Now()
+	msg, err := m.Storage.ListBuckets()
+	observe("ListBuckets", start, err)
+	return msg, err
+}
+
+func (m *MeteredStorage) ListObjects(bucket minio.BucketInfo, prefix string) (*evmsg.Message, error) {
+	start := time.Now()
+	msg, err := m.Storage.ListObjects(bucket, prefix)
+	observe("ListObjects", start, err)
+	return msg, err
+}
+
+func (m *MeteredStorage) GetObject(bucket, file string) (*evmsg.Message, error) {
+	start := time.Now()
+	msg, err := m.Storage.GetObject(bucket, file)
+	observe("GetObject", start, err)
+	return msg, err
+}
+
+func (m *MeteredStorage) GetThumbnail(bucket, file string) ([]byte, error) {
+	start := time.Now()
+	tBytes, err := m.Storage.GetThumbnail(bucket, file)
+	observe("GetThumbnail", start, err)
+	return tBytes, err
+}
+
+func (m *MeteredStorage) ReadObject(bucket, file string) (io.ReadCloser, int64, error) {
+	start := time.Now()
+	rc, size, err := m.Storage.ReadObject(bucket, file)
+	observe("ReadObject", start, err)
+	return rc, size, err
+}
+
+func (m *MeteredStorage) ReadCache(cached string) (io.ReadCloser, error) {
+	start := time.Now()
+	rc, err := m.Storage.ReadCache(cached)
+	observe("ReadCache", start, err)
+	return rc, err
+}
+
+func (m *MeteredStorage) WriteCache(cached string, r io.Reader) error {
+	start := time.Now()
+	err := m.Storage.WriteCache(cached, r)
+	observe("WriteCache", start, err)
+	return err
+}
+
+func (m *MeteredStorage) PutObject(bucket string, file *multipart.FileHeader) error {
+	start := time.Now()
+	err := m.Storage.PutObject(bucket, file)
+	observe("PutObject", start, err)
+	return err
+}
+
+func (m *MeteredStorage) RemoveObject(bucket string, file string) (*evmsg.Message, error) {
+	start := time.Now()
+	msg, err := m.Storage.RemoveObject(bucket, file)
+	observe("RemoveObject", start, err)
+	return msg, err
+}
+
+func (m *MeteredStorage) Close() error {
+	return CloseStorage(m.Storage)
+}
+
+// observeCommand counts a dispatched command, unknown commands share one label
+// so that clients can not grow the series
+func observeCommand(scope, command string, start time.Time, err error) {
+	if _, ok := lookupCommand(scope, command); !ok {
+		scope, command = "unknown", "unknown"
+	}
+	code := "ok"
+	if err != nil {
+		code = "error"
+		if cErr, ok := err.(*CommandError); ok && cErr.Code != "" {
+			code = cErr.Code
+		}
+	}
+	commandRequests.inc(scope, command, code)
+	commandDuration.since(start, scope, command)
+}
@@ -0,0 +1,53 @@
+package files
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"evalgo.org/evmsg"
+	echo "github.com/labstack/echo/v4"
+)
+
+func Test_Unit_Metrics(t *testing.T) {
+	f := &Files{WSStorage: NewMeteredStorage(newMemStorage()), WSClient: "files", WSSecret: "secret"}
+	e := echo.New()
+	e.Use(Metrics)
+	e.GET("/v1/things/:id", func(c echo.Context) error {
+		return c.NoContent(http.StatusTeapot)
+	})
+	e.GET(MetricsPath, echo.WrapHandler(MetricsHandler()))
+	for _, id := range []string{"a", "b"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/things/"+id, nil))
+	}
+	if _, _, err := f.WSStorage.ReadObject("missing", "file.txt"); err == nil {
+		t.Error("the object does not exist")
+	}
+	msg := evmsg.NewMessage()
+	msg.Scope, msg.Command = "Teleport", "now"
+	f.Dispatch(context.Background(), "files", msg)
+	cacheLookup("objects", true)
+	cacheLookup("objects", false)
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", MetricsPath, nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	for _, expected := range []string{
+		`files_http_requests_total{route="/v1/things/:id",method="GET",status="418"} 2`,
+		`files_storage_errors_total{method="ReadObject"} 1`,
+		`files_storage_duration_seconds_count{method="ReadObject"} 1`,
+		`files_commands_total{scope="unknown",command="unknown",code="unknown_command"}`,
+		`files_cache_lookups_total{cache="objects",result="hit"}`,
+		`files_http_request_duration_seconds_bucket{route="/v1/things/:id",method="GET",le="+Inf"} 2`,
+		`files_websocket_connections 0`,
+		`files_cache_bytes`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Error("the metrics are missing", expected)
+		}
+	}
+}
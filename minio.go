@@ -6,9 +6,11 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"image"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/url"
@@ -36,6 +38,7 @@ type Minio struct {
 	AccessSecret string
 	Client       *minio.Client
 	SSL          bool
+	Crypt        *Crypt
 }
 
 func NewMinio() *Minio {
@@ -43,7 +46,12 @@ func NewMinio() *Minio {
 }
 
 func (m *Minio) InitCache() error {
-	return os.MkdirAll(MinioFilesCacheDir, 0777)
+	err := os.MkdirAll(MinioFilesCacheDir, 0700)
+	if err != nil {
+		return err
+	}
+	// caches created by older versions are world writable
+	return os.Chmod(MinioFilesCacheDir, 0700)
 }
 
 func (m *Minio) Connect(apiURL, accessKey, accessSecret string) error {
@@ -62,8 +70,12 @@ func (m *Minio) Connect(apiURL, accessKey, accessSecret string) error {
 	m.AccessKey = accessKey
 	m.AccessSecret = accessSecret
 	m.Client, err = minio.New(m.ApiURL, m.AccessKey, m.AccessSecret, m.SSL)
+	if err != nil {
+		return err
+	}
 	m.Client.TraceOn(nil)
-	return err
+	// the client connects lazily, the readiness reports when the server is not reachable
+	return nil
 }
 
 func (m *Minio) ListBuckets() (*evmsg.Message, error) {
@@ -120,10 +132,18 @@ func (m *Minio) ListObjects(bucket minio.BucketInfo, prefix string) (*evmsg.Mess
 					return msg, err
 				}
 				mObj["description"] = msg.Value("description")
+				mObj["checksum"] = msg.Value("checksum")
+				mObj["pages"] = msg.Value("pages")
+				if text, ok := msg.Value("text").(string); ok {
+					mObj["text"] = Excerpt(text)
+				}
 			}
 		}
 		mObj["key"] = obj.Key
 		mObj["size"] = obj.Size
+		if m.Crypt != nil {
+			mObj["size"] = DecryptedSize(obj.Size)
+		}
 		mObj["etag"] = obj.ETag
 		mObj["modified"] = obj.LastModified
 		mObj["bucket"] = bucket.Name
@@ -134,6 +154,12 @@ func (m *Minio) ListObjects(bucket minio.BucketInfo, prefix string) (*evmsg.Mess
 	return msg, nil
 }
 
+// mediaMetaFields are the probed media fields GetObject returns if they are set
+var mediaMetaFields = []string{"media_type", "duration", "video_codec", "audio_codec", "width", "height", "bitrate"}
+
+// objectMetaFields are the meta information of an upload GetObject returns
+var objectMetaFields = append([]string{"description", "checksum", "pages", "text"}, mediaMetaFields...)
+
 func (m *Minio) GetObject(bucket, file string) (*evmsg.Message, error) {
 	msg := evmsg.NewMessage()
 	msg.State = "Response"
@@ -141,34 +167,54 @@ func (m *Minio) GetObject(bucket, file string) (*evmsg.Message, error) {
 	hasher.Write([]byte(file))
 	fileNameSha := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
 	cacheFilePath := MinioFilesCacheDir + string(os.PathSeparator) + fileNameSha
-	metaFile := strings.Replace(file, filepath.Ext(file), ".json", 1)
+	metaFile := metaKey(file)
 	metaFilePath := MinioFilesCacheDir + string(os.PathSeparator) + metaFile
 	_, err := os.Stat(cacheFilePath)
+	cacheLookup("objects", !os.IsNotExist(err))
 	if os.IsNotExist(err) {
 		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(MinioDownloadSecondsTimeout)*time.Second)
 		defer cancel()
-		err := m.Client.FGetObjectWithContext(ctx, "meta", metaFile, metaFilePath, minio.GetObjectOptions{})
+		err := m.download(ctx, "meta", metaFile, metaFilePath)
 		if err != nil {
 			msg.Debug.Error = err.Error()
 			return msg, err
 		}
-		err = m.Client.FGetObjectWithContext(ctx, bucket, file, cacheFilePath, minio.GetObjectOptions{})
+		err = m.download(ctx, bucket, file, cacheFilePath)
 		if err != nil {
 			msg.Debug.Error = err.Error()
 			return msg, err
 		}
 	}
-	metaB, err := ioutil.ReadFile(metaFilePath)
+	metaR, err := m.ReadCache(metaFilePath)
 	if err != nil {
 		msg.Debug.Error = err.Error()
 		return msg, err
 	}
 	meta := map[string]string{}
-	err = json.Unmarshal(metaB, &meta)
+	err = json.NewDecoder(metaR).Decode(&meta)
+	metaR.Close()
 	if err != nil {
 		msg.Debug.Error = err.Error()
 		return msg, err
 	}
+	if meta["checksum"] != "" && bucket != "meta" {
+		err = m.verifyCache(cacheFilePath, meta["checksum"])
+		if err != nil {
+			// the cache entry is corrupt, fetch the object once more
+			os.Remove(cacheFilePath)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(MinioDownloadSecondsTimeout)*time.Second)
+			defer cancel()
+			err = m.download(ctx, bucket, file, cacheFilePath)
+			if err == nil {
+				err = m.verifyCache(cacheFilePath, meta["checksum"])
+			}
+			if err != nil {
+				os.Remove(cacheFilePath)
+				msg.Debug.Error = err.Error()
+				return msg, err
+			}
+		}
+	}
 	downloadPath := strings.Replace(MinioDownloadsFilePath, ":bucket", bucket, 1)
 	downloadPath = strings.Replace(downloadPath, ":object", fileNameSha, 1)
 	msg.Data = []interface{}{
@@ -176,8 +222,16 @@ func (m *Minio) GetObject(bucket, file string) (*evmsg.Message, error) {
 			"path":        downloadPath,
 			"cached":      cacheFilePath,
 			"description": meta["description"],
+			"checksum":    meta["checksum"],
+			"pages":       meta["pages"],
+			"text":        meta["text"],
 		},
 	}
+	for _, field := range mediaMetaFields {
+		if meta[field] != "" {
+			msg.Data.([]interface{})[0].(map[string]interface{})[field] = meta[field]
+		}
+	}
 	return msg, nil
 }
 
@@ -186,28 +240,323 @@ func (m *Minio) GetThumbnail(bucket, file string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	resp, err := os.Open(msg.Value("cached").(string))
+	resp, err := m.ReadCache(msg.Value("cached").(string))
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Close()
+	return renderThumbnail(file, resp)
+}
+
+// renderThumbnail renders the thumbnail of a file, the name tells how
+func renderThumbnail(file string, resp io.ReadCloser) ([]byte, error) {
+	// the download of the object is measured by the storage metrics, this is the rendering
+	start := time.Now()
+	defer thumbnailDuration.since(start)
+	if IsDocument(file) || IsMedia(file) {
+		r, size, err := readerAt(resp)
+		if err != nil {
+			return nil, err
+		}
+		if IsMedia(file) {
+			return MediaThumbnail(file, r, size)
+		}
+		return DocumentThumbnail(file, r, size)
+	}
 	image, _, err := image.Decode(resp)
-	newImage := resize.Resize(125, 0, image, resize.Lanczos3)
+	if err != nil {
+		return nil, err
+	}
+	return encodeThumbnail(image, filepath.Ext(file))
+}
+
+// encodeThumbnail scales an image down to the thumbnail width
+func encodeThumbnail(img image.Image, ext string) ([]byte, error) {
+	newImage := resize.Resize(125, 0, img, resize.Lanczos3)
 	//newImage := resize.Thumbnail(125, 0, image, resize.Lanczos3)
 	imgBuffer := bytes.NewBuffer(nil)
-	switch strings.ToLower(filepath.Ext(file)) {
+	switch strings.ToLower(ext) {
 	case ".jpg", ".jpeg":
 		err := jpeg.Encode(imgBuffer, newImage, nil)
 		if err != nil {
 			return nil, err
 		}
-	case ".png":
+	default:
 		err := png.Encode(imgBuffer, newImage)
 		if err != nil {
 			return nil, err
 		}
 	}
 	return imgBuffer.Bytes(), nil
+}
+
+// readerAt gives random access to a cache entry, encrypted entries are read into memory
+func readerAt(rc io.ReadCloser) (io.ReaderAt, int64, error) {
+	if fd, ok := rc.(*os.File); ok {
+		info, err := fd.Stat()
+		if err != nil {
+			return nil, 0, err
+		}
+		return fd, info.Size(), nil
+	}
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+func (m *Minio) ReadObject(bucket, file string) (io.ReadCloser, int64, error) {
+	obj, err := m.Client.GetObject(bucket, file, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, 0, err
+	}
+	if m.Crypt != nil && bucket != EncryptionKeysBucket {
+		key, err := m.Crypt.DataKey(bucket)
+		if err != nil {
+			obj.Close()
+			return nil, 0, err
+		}
+		dec, err := NewDecryptReader(obj, key)
+		if err != nil {
+			obj.Close()
+			return nil, 0, err
+		}
+		return readCloser{dec, obj}, DecryptedSize(info.Size), nil
+	}
+	return obj, info.Size, nil
+}
+
+// ReadCache opens a file of the local cache, encrypted cache entries are decrypted on the fly
+func (m *Minio) ReadCache(cached string) (io.ReadCloser, error) {
+	fd, err := os.Open(cached)
+	if err != nil {
+		return nil, err
+	}
+	if m.Crypt == nil {
+		return fd, nil
+	}
+	key, err := m.Crypt.DataKey(EncryptionCacheKey)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	dec, err := NewDecryptReader(fd, key)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return readCloser{dec, fd}, nil
+}
+
+func (m *Minio) verifyCache(cached, checksum string) error {
+	rc, err := m.ReadCache(cached)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return VerifyChecksum(checksum, rc)
+}
+
+// download fetches an object into the local cache, with encryption enabled
+// the object is re-encrypted with the cache key so no plaintext touches the disk
+func (m *Minio) download(ctx context.Context, bucket, file, cached string) error {
+	if m.Crypt == nil {
+		return m.Client.FGetObjectWithContext(ctx, bucket, file, cached, minio.GetObjectOptions{})
+	}
+	obj, err := m.Client.GetObjectWithContext(ctx, bucket, file, minio.GetObjectOptions{})
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	key, err := m.Crypt.DataKey(bucket)
+	if err != nil {
+		return err
+	}
+	dec, err := NewDecryptReader(obj, key)
+	if err != nil {
+		return err
+	}
+	return m.WriteCache(cached, dec)
+}
+
+// WriteCache stores r as a file of the local cache, encrypted with the cache key if enabled
+func (m *Minio) WriteCache(cached string, r io.Reader) error {
+	if m.Crypt != nil {
+		cacheKey, err := m.Crypt.DataKey(EncryptionCacheKey)
+		if err != nil {
+			return err
+		}
+		r, err = NewEncryptReader(r, cacheKey)
+		if err != nil {
+			return err
+		}
+	}
+	err := os.MkdirAll(filepath.Dir(cached), 0700)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(cached), ".download")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, r)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), cached)
+}
+
+// Close removes the partial downloads of the cache, the client keeps no connections to close
+func (m *Minio) Close() error {
+	return filepath.Walk(MinioFilesCacheDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() && strings.HasPrefix(info.Name(), ".download") {
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
 
+func (m *Minio) LoadKey(name string) ([]byte, error) {
+	obj, err := m.Client.GetObject(EncryptionKeysBucket, name+".key", minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	// the object is fetched lazily, stat it so a missing key fails with NoSuchKey here
+	if _, err := obj.Stat(); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(obj)
+}
+
+func (m *Minio) SaveKey(name string, wrapped []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(MinioUploadSecondsTimeout)*time.Second)
+	defer cancel()
+	_, err := m.Client.PutObjectWithContext(ctx, EncryptionKeysBucket, name+".key", bytes.NewReader(wrapped), int64(len(wrapped)), minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	return err
+}
+
+func (m *Minio) ListKeys() ([]string, error) {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	names := []string{}
+	for obj := range m.Client.ListObjects(EncryptionKeysBucket, "", true, doneCh) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		names = append(names, strings.TrimSuffix(obj.Key, ".key"))
+	}
+	return names, nil
+}
+
+// EncryptObjects encrypts the objects stored before the encryption was enabled, encrypted objects
+// are skipped so an interrupted run can be repeated
+func (m *Minio) EncryptObjects() (int, error) {
+	if m.Crypt == nil {
+		return 0, errors.New("the encryption is not enabled!")
+	}
+	msg, err := m.ListBuckets()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	list, _ := msg.Data.([]interface{})
+	for _, b := range list {
+		bucket := b.(map[string]interface{})["name"].(string)
+		if bucket == EncryptionKeysBucket {
+			continue
+		}
+		n, err := m.encryptBucket(bucket)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func (m *Minio) encryptBucket(bucket string) (int, error) {
+	key, err := m.Crypt.DataKey(bucket)
+	if err != nil {
+		return 0, err
+	}
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	count := 0
+	for obj := range m.Client.ListObjects(bucket, "", true, doneCh) {
+		if obj.Err != nil {
+			return count, obj.Err
+		}
+		encrypted, err := m.encryptObject(bucket, obj.Key, key)
+		if err != nil {
+			return count, err
+		}
+		if encrypted {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// encryptObject replaces a plaintext object with its encrypted version, the encrypted
+// data is staged in the cache so no plaintext touches the disk
+func (m *Minio) encryptObject(bucket, file string, key []byte) (bool, error) {
+	obj, err := m.Client.GetObject(bucket, file, minio.GetObjectOptions{})
+	if err != nil {
+		return false, err
+	}
+	defer obj.Close()
+	encrypted, err := IsEncrypted(obj, key)
+	if err != nil || encrypted {
+		return false, err
+	}
+	if _, err := obj.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	enc, err := NewEncryptReader(obj, key)
+	if err != nil {
+		return false, err
+	}
+	tmp, err := ioutil.TempFile(MinioFilesCacheDir, ".download")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, enc)
+	if err != nil {
+		return false, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(MinioUploadSecondsTimeout)*time.Second)
+	defer cancel()
+	_, err = m.Client.PutObjectWithContext(ctx, bucket, file, tmp, size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	return err == nil, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
 }
 
 func (m *Minio) PutObject(bucket string, file *multipart.FileHeader) error {
@@ -218,7 +567,20 @@ func (m *Minio) PutObject(bucket string, file *multipart.FileHeader) error {
 		return err
 	}
 	defer src.Close()
-	_, err = m.Client.PutObjectWithContext(ctx, bucket, file.Filename, src, file.Size, minio.PutObjectOptions{
+	var body io.Reader = src
+	size := file.Size
+	if m.Crypt != nil {
+		key, err := m.Crypt.DataKey(bucket)
+		if err != nil {
+			return err
+		}
+		body, err = NewEncryptReader(src, key)
+		if err != nil {
+			return err
+		}
+		size = EncryptedSize(file.Size)
+	}
+	_, err = m.Client.PutObjectWithContext(ctx, bucket, file.Filename, body, size, minio.PutObjectOptions{
 		ContentType: "application/octet-stream",
 	})
 	if err != nil {
@@ -262,6 +624,10 @@ func (m *Minio) RemoveObject(bucket, file string) (*evmsg.Message, error) {
 		return msg, err
 	}
 	err = m.Client.RemoveObject("meta", strings.Replace(file, filepath.Ext(file), ".json", 1))
+	if err == nil && !IsInternalBucket(bucket) {
+		// a stale scan state would block a later upload of the same key
+		err = m.Client.RemoveObject("meta", scanKey(bucket, file))
+	}
 	if err != nil {
 		msg.Debug.Error = err.Error()
 		return msg, err
@@ -271,10 +637,17 @@ func (m *Minio) RemoveObject(bucket, file string) (*evmsg.Message, error) {
 	hasher.Write([]byte(file))
 	fileNameSha := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
 	cacheFilePath := MinioFilesCacheDir + string(os.PathSeparator) + fileNameSha
-	metaFile := strings.Replace(file, filepath.Ext(file), ".json", 1)
+	metaFile := metaKey(file)
 	metaFilePath := MinioFilesCacheDir + string(os.PathSeparator) + metaFile
 	os.Remove(cacheFilePath)
 	os.Remove(metaFilePath)
 	return msg, nil
 
 }
+
+func metaKey(file string) string {
+	if filepath.Ext(file) == "" {
+		return file + ".json"
+	}
+	return strings.Replace(file, filepath.Ext(file), ".json", 1)
+}
@@ -0,0 +1,227 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"math/bits"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"evalgo.org/evmsg"
+	"github.com/minio/minio-go/v6"
+	"github.com/nfnt/resize"
+)
+
+var SimilarDefaultDistance int = 10
+
+func grayscale(img image.Image, width, height uint) [][]float64 {
+	small := resize.Resize(width, height, img, resize.Bilinear)
+	pixels := make([][]float64, height)
+	for y := 0; y < int(height); y++ {
+		pixels[y] = make([]float64, width)
+		for x := 0; x < int(width); x++ {
+			r, g, b, _ := small.At(small.Bounds().Min.X+x, small.Bounds().Min.Y+y).RGBA()
+			pixels[y][x] = 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+		}
+	}
+	return pixels
+}
+
+// DHash compares neighbouring pixels of a 9x8 grayscale version of the image
+func DHash(img image.Image) uint64 {
+	pixels := grayscale(img, 9, 8)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if pixels[y][x] < pixels[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// PHash compares the low frequencies of a 32x32 DCT with their median
+func PHash(img image.Image) uint64 {
+	const size, low = 32, 8
+	pixels := grayscale(img, size, size)
+	coeffs := make([][]float64, low)
+	for u := 0; u < low; u++ {
+		coeffs[u] = make([]float64, low)
+		for v := 0; v < low; v++ {
+			sum := 0.0
+			for y := 0; y < size; y++ {
+				for x := 0; x < size; x++ {
+					sum += pixels[y][x] *
+						math.Cos(float64(2*y+1)*float64(u)*math.Pi/(2*size)) *
+						math.Cos(float64(2*x+1)*float64(v)*math.Pi/(2*size))
+				}
+			}
+			coeffs[u][v] = sum
+		}
+	}
+	// the DC coefficient only reflects the brightness, leave it out of the median
+	values := []float64{}
+	for u := 0; u < low; u++ {
+		for v := 0; v < low; v++ {
+			if u != 0 || v != 0 {
+				values = append(values, coeffs[u][v])
+			}
+		}
+	}
+	sort.Float64s(values)
+	median := values[len(values)/2]
+	var hash uint64
+	for u := 0; u < low; u++ {
+		for v := 0; v < low; v++ {
+			hash <<= 1
+			if coeffs[u][v] > median {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// HashDistance returns the hamming distance of two hex encoded hashes
+func HashDistance(a, b string) (int, error) {
+	ha, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		return 0, err
+	}
+	hb, err := strconv.ParseUint(b, 16, 64)
+	if err != nil {
+		return 0, err
+	}
+	return bits.OnesCount64(ha ^ hb), nil
+}
+
+// AddImageHashMeta stores the perceptual hashes of an image in the meta information
+func AddImageHashMeta(meta map[string]string, file string, r io.Reader) {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".jpg", ".jpeg", ".png":
+	default:
+		return
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return
+	}
+	meta["phash"] = fmt.Sprintf("%016x", PHash(img))
+	meta["dhash"] = fmt.Sprintf("%016x", DHash(img))
+}
+
+type similarCandidate struct {
+	bucket string
+	key    string
+	meta   map[string]string
+}
+
+// similarCandidates collects the hashed objects, the search index is used if available
+func similarCandidates(s Storage, bucket string) ([]similarCandidate, error) {
+	candidates := []similarCandidate{}
+	if index, ok := SearchIndex(s); ok {
+		index.lock.RLock()
+		defer index.lock.RUnlock()
+		for _, doc := range index.Docs {
+			if bucket != "" && doc.Bucket != bucket {
+				continue
+			}
+			if meta := index.Metas[doc.Key]; meta["phash"] != "" {
+				candidates = append(candidates, similarCandidate{bucket: doc.Bucket, key: doc.Key, meta: meta})
+			}
+		}
+		return candidates, nil
+	}
+	buckets := []string{bucket}
+	if bucket == "" {
+		bMsg, err := s.ListBuckets()
+		if err != nil {
+			return nil, err
+		}
+		buckets = []string{}
+		list, _ := bMsg.Data.([]interface{})
+		for _, b := range list {
+			name := b.(map[string]interface{})["name"].(string)
+			if !IsInternalBucket(name) {
+				buckets = append(buckets, name)
+			}
+		}
+	}
+	for _, name := range buckets {
+		oMsg, err := s.ListObjects(minio.BucketInfo{Name: name}, "")
+		if err != nil {
+			return nil, err
+		}
+		list, _ := oMsg.Data.([]interface{})
+		for _, obj := range list {
+			key := obj.(map[string]interface{})["key"].(string)
+			if meta, err := GetMeta(s, key); err == nil && meta["phash"] != "" {
+				candidates = append(candidates, similarCandidate{bucket: name, key: key, meta: meta})
+			}
+		}
+	}
+	return candidates, nil
+}
+
+// FindSimilar returns the objects whose perceptual hash is within maxDistance of the given
+// object, an empty bucket searches across all buckets
+func FindSimilar(s Storage, bucket, file string, allBuckets bool, maxDistance int) (*evmsg.Message, error) {
+	msg := evmsg.NewMessage()
+	msg.State = "Response"
+	meta, err := GetMeta(s, file)
+	if err == nil && meta["phash"] == "" {
+		err = errors.New("the object <" + file + "> has no perceptual hash!")
+	}
+	if err != nil {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	scope := bucket
+	if allBuckets {
+		scope = ""
+	}
+	candidates, err := similarCandidates(s, scope)
+	if err != nil {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	similar := []map[string]interface{}{}
+	for _, c := range candidates {
+		if c.bucket == bucket && c.key == file {
+			continue
+		}
+		distance, err := HashDistance(meta["phash"], c.meta["phash"])
+		if err != nil || distance > maxDistance {
+			continue
+		}
+		entry := map[string]interface{}{
+			"bucket":      c.bucket,
+			"key":         c.key,
+			"distance":    distance,
+			"description": c.meta["description"],
+		}
+		if d, err := HashDistance(meta["dhash"], c.meta["dhash"]); err == nil {
+			entry["dhash_distance"] = d
+		}
+		similar = append(similar, entry)
+	}
+	sort.SliceStable(similar, func(a, b int) bool {
+		if similar[a]["distance"].(int) != similar[b]["distance"].(int) {
+			return similar[a]["distance"].(int) < similar[b]["distance"].(int)
+		}
+		return similar[a]["bucket"].(string)+"/"+similar[a]["key"].(string) < similar[b]["bucket"].(string)+"/"+similar[b]["key"].(string)
+	})
+	data := []interface{}{}
+	for _, entry := range similar {
+		data = append(data, entry)
+	}
+	msg.Data = data
+	return msg, nil
+}
@@ -0,0 +1,86 @@
+package files
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math/bits"
+	"math/rand"
+	"testing"
+)
+
+// testPattern draws the same random rectangles at any size, shift changes
+// the brightness and invert the tonality
+func testPattern(width, height int, shift int, invert bool) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{128}), image.Point{}, draw.Src)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 16; i++ {
+		x0, y0 := r.Float64(), r.Float64()
+		x1, y1 := x0+r.Float64()/2+0.125, y0+r.Float64()/2+0.125
+		rect := image.Rect(int(x0*float64(width)), int(y0*float64(height)), int(x1*float64(width)), int(y1*float64(height)))
+		v := r.Intn(200) + 20 + shift
+		if invert {
+			v = 255 - v
+		}
+		draw.Draw(img, rect, image.NewUniform(color.Gray{uint8(v)}), image.Point{}, draw.Src)
+	}
+	return img
+}
+
+func testPng(t *testing.T, img image.Image) []byte {
+	buff := bytes.NewBuffer(nil)
+	if err := png.Encode(buff, img); err != nil {
+		t.Fatal(err)
+	}
+	return buff.Bytes()
+}
+
+func Test_Unit_PerceptualHash(t *testing.T) {
+	original := testPattern(200, 150, 0, false)
+	edited := testPattern(400, 300, 10, false)
+	other := testPattern(200, 150, 0, true)
+	for name, hash := range map[string]func(image.Image) uint64{"phash": PHash, "dhash": DHash} {
+		near := bits.OnesCount64(hash(original) ^ hash(edited))
+		far := bits.OnesCount64(hash(original) ^ hash(other))
+		if near > SimilarDefaultDistance || far <= SimilarDefaultDistance {
+			t.Error("unexpected", name, "distances", near, far)
+		}
+	}
+}
+
+func Test_Unit_FindSimilar(t *testing.T) {
+	s := newMemStorage()
+	for _, obj := range []struct {
+		bucket, key string
+		img         image.Image
+	}{
+		{"test", "shot.png", testPattern(200, 150, 0, false)},
+		{"test", "shot-edit.png", testPattern(300, 225, 8, false)},
+		{"other", "shot-copy.png", testPattern(200, 150, 4, false)},
+		{"test", "negative.png", testPattern(200, 150, 0, true)},
+	} {
+		s.put(obj.bucket, obj.key, testPng(t, obj.img))
+		meta := map[string]string{"name": obj.key}
+		AddImageHashMeta(meta, obj.key, bytes.NewReader(testPng(t, obj.img)))
+		if err := PutMeta(s, obj.key, meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg, err := FindSimilar(s, "test", "shot.png", false, SimilarDefaultDistance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Data.([]interface{})) != 1 || msg.Value("key") != "shot-edit.png" {
+		t.Error("unexpected similar objects in the bucket", msg.Data)
+	}
+	msg, err = FindSimilar(s, "test", "shot.png", true, SimilarDefaultDistance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Data.([]interface{})) != 2 {
+		t.Error("unexpected similar objects across buckets", msg.Data)
+	}
+}
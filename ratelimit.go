@@ -0,0 +1,255 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+)
+
+// the classes of requests the rate limits apply to
+const (
+	RateUpload    = "upload"
+	RateDownload  = "download"
+	RateRendition = "rendition"
+	RateCommand   = "command"
+)
+
+// RateLimit allows Rate requests per second with bursts of Burst requests
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+var (
+	// RateLimits are the limits of the classes per identity or address, classes without a limit are not limited
+	RateLimits = map[string]RateLimit{}
+	// DownloadRate bounds the bytes per second an identity or an address downloads, 0 disables it
+	DownloadRate int64
+	// ImageWorkers bounds the thumbnails and renditions generated at the same time
+	ImageWorkers int = runtime.NumCPU()
+)
+
+// ParseRateLimits reads limits like upload=2:10,download=20:40, the rate per second and the burst
+func ParseRateLimits(s string) (map[string]RateLimit, error) {
+	limits := map[string]RateLimit{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		fail := errors.New("the rate limit <" + entry + "> has to look like class=rate:burst!")
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return nil, fail
+		}
+		switch kv[0] {
+		case RateUpload, RateDownload, RateRendition, RateCommand:
+		default:
+			return nil, errors.New("the rate limit class <" + kv[0] + "> is not known!")
+		}
+		rb := strings.SplitN(kv[1], ":", 2)
+		rate, err := strconv.ParseFloat(rb[0], 64)
+		if err != nil || rate <= 0 {
+			return nil, fail
+		}
+		burst := int(math.Ceil(rate))
+		if len(rb) == 2 {
+			burst, err = strconv.Atoi(rb[1])
+			if err != nil || burst < 1 {
+				return nil, fail
+			}
+		}
+		limits[kv[0]] = RateLimit{Rate: rate, Burst: burst}
+	}
+	return limits, nil
+}
+
+// tokenBucket refills rate tokens per second up to burst
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// take removes n tokens if they are available, otherwise it returns the time until they are
+func (b *tokenBucket) take(now time.Time, n float64) time.Duration {
+	b.refill(now)
+	if b.tokens >= n {
+		b.tokens -= n
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// reserve removes n tokens even if that leaves a debt, the caller waits for the returned time
+func (b *tokenBucket) reserve(now time.Time, n float64) time.Duration {
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// clientOf returns the client the limits count for, the identity or the address
+func (f *Files) clientOf(r *http.Request) string {
+	if identity := f.Identity(r); identity != "" {
+		return identity
+	}
+	return remoteAddr(r)
+}
+
+// bucketOf returns the bucket of a class and a client, buckets that refilled are forgotten now and then
+func (f *Files) bucketOf(class, client string, rate, burst float64, now time.Time) *tokenBucket {
+	if f.rlBuckets == nil {
+		f.rlBuckets = map[string]*tokenBucket{}
+		f.rlSwept = now
+	}
+	if now.Sub(f.rlSwept) > time.Minute {
+		for key, b := range f.rlBuckets {
+			if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst {
+				delete(f.rlBuckets, key)
+			}
+		}
+		f.rlSwept = now
+	}
+	key := class + "/" + client
+	b, ok := f.rlBuckets[key]
+	if !ok || b.rate != rate || b.burst != burst {
+		b = newTokenBucket(rate, burst, now)
+		f.rlBuckets[key] = b
+	}
+	return b
+}
+
+// Allow takes a request of a class from the bucket of a client, denied requests get the time to retry
+func (f *Files) Allow(class, client string) (bool, time.Duration) {
+	limit, ok := RateLimits[class]
+	if !ok || client == f.WSClient {
+		return true, 0
+	}
+	f.rlMu.Lock()
+	defer f.rlMu.Unlock()
+	now := time.Now()
+	wait := f.bucketOf(class, client, limit.Rate, float64(limit.Burst), now).take(now, 1)
+	return wait == 0, wait
+}
+
+// RateLimitError describes a denied request
+func RateLimitError(class string, wait time.Duration) error {
+	return errors.New("the rate limit of <" + class + "> is exceeded, retry in " + retryAfter(wait) + " seconds!")
+}
+
+// retryAfter rounds the wait up to whole seconds for the Retry-After header
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(wait.Seconds()))))
+}
+
+// limitRequest checks the limit of a class for a client, downloads are throttled as well
+func (f *Files) limitRequest(w http.ResponseWriter, r *http.Request, class, client string) (http.ResponseWriter, error) {
+	if ok, wait := f.Allow(class, client); !ok {
+		w.Header().Set("Retry-After", retryAfter(wait))
+		return w, RateLimitError(class, wait)
+	}
+	if class == RateDownload && DownloadRate > 0 && client != f.WSClient {
+		return &throttledWriter{ResponseWriter: w, f: f, client: client, ctx: r.Context()}, nil
+	}
+	return w, nil
+}
+
+// RateLimit is the echo middleware of a class of routes
+func (f *Files) RateLimit(class string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			w, err := f.limitRequest(c.Response().Writer, c.Request(), class, f.clientOf(c.Request()))
+			if err != nil {
+				return jsonError(c, http.StatusTooManyRequests, err)
+			}
+			c.Response().Writer = w
+			return next(c)
+		}
+	}
+}
+
+// throttledWriter shares the download rate of a client between its downloads
+type throttledWriter struct {
+	http.ResponseWriter
+	f      *Files
+	client string
+	ctx    context.Context
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	chunk := int(DownloadRate)
+	if chunk > 32*1024 {
+		chunk = 32 * 1024
+	}
+	for len(p) > 0 {
+		n := chunk
+		if n > len(p) {
+			n = len(p)
+		}
+		t.f.rlMu.Lock()
+		now := time.Now()
+		wait := t.f.bucketOf("bandwidth", t.client, float64(DownloadRate), float64(DownloadRate), now).reserve(now, float64(n))
+		t.f.rlMu.Unlock()
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-t.ctx.Done():
+				return written, t.ctx.Err()
+			}
+		}
+		m, err := t.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (t *throttledWriter) Flush() {
+	if flusher, ok := t.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// imageSlot waits for one of the ImageWorkers, the returned function frees it
+func (f *Files) imageSlot(ctx context.Context) (func(), error) {
+	f.rlMu.Lock()
+	if f.imageSlots == nil {
+		workers := ImageWorkers
+		if workers < 1 {
+			workers = 1
+		}
+		f.imageSlots = make(chan struct{}, workers)
+	}
+	slots := f.imageSlots
+	f.rlMu.Unlock()
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
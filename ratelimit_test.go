@@ -0,0 +1,101 @@
+package files
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+)
+
+func Test_Unit_ParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits("upload=2:10, download=0.5")
+	if err != nil || limits[RateUpload] != (RateLimit{Rate: 2, Burst: 10}) || limits[RateDownload] != (RateLimit{Rate: 0.5, Burst: 1}) {
+		t.Error("unexpected limits", limits, err)
+	}
+	for _, broken := range []string{"upload", "upload=fast", "upload=1:0", "teleport=1:1"} {
+		if _, err := ParseRateLimits(broken); err == nil {
+			t.Error("the limit has to be rejected", broken)
+		}
+	}
+}
+
+func Test_Unit_RateLimit(t *testing.T) {
+	limits := RateLimits
+	RateLimits = map[string]RateLimit{RateCommand: {Rate: 0.1, Burst: 2}}
+	defer func() { RateLimits = limits }()
+	f := &Files{WSStorage: newMemStorage(), WSClient: "files", WSSecret: "secret"}
+	e := echo.New()
+	e.GET("/limited", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, f.RateLimit(RateCommand))
+	do := func(remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/limited", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, r)
+		return w
+	}
+	for i := 0; i < 2; i++ {
+		if w := do("10.0.0.1:1234"); w.Code != http.StatusOK {
+			t.Fatal("the burst has to be allowed", w.Code)
+		}
+	}
+	w := do("10.0.0.1:1235")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "10" {
+		t.Error("the limit has to be enforced", w.Code, w.Header())
+	}
+	if w := do("10.0.0.2:1234"); w.Code != http.StatusOK {
+		t.Error("every address has its own bucket", w.Code)
+	}
+	if ok, _ := f.Allow(RateCommand, "files"); !ok {
+		t.Error("the service client is not limited")
+	}
+	if ok, _ := f.Allow(RateUpload, "10.0.0.1"); !ok {
+		t.Error("classes without a limit are not limited")
+	}
+}
+
+func Test_Unit_DownloadThrottle(t *testing.T) {
+	rate := DownloadRate
+	DownloadRate = 10000
+	defer func() { DownloadRate = rate }()
+	f := &Files{WSClient: "files"}
+	r := httptest.NewRequest("GET", "/", nil)
+	w, err := f.limitRequest(httptest.NewRecorder(), r, RateDownload, "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if n, err := w.Write(make([]byte, 15000)); n != 15000 || err != nil {
+		t.Fatal(n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Error("the download has to be throttled", elapsed)
+	}
+}
+
+func Test_Unit_ImageSlots(t *testing.T) {
+	workers := ImageWorkers
+	ImageWorkers = 1
+	defer func() { ImageWorkers = workers }()
+	f := &Files{}
+	release, err := f.imageSlot(httptest.NewRequest("GET", "/", nil).Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	ctx, cancel := context.WithTimeout(r.Context(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := f.imageSlot(ctx); err == nil {
+		t.Error("the image workers have to be bounded")
+	}
+	release()
+	if release, err := f.imageSlot(r.Context()); err != nil {
+		t.Error("a free worker has to be taken", err)
+	} else {
+		release()
+	}
+}
@@ -0,0 +1,213 @@
+package files
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"evalgo.org/evmsg"
+	echo "github.com/labstack/echo/v4"
+)
+
+var RESTPrefix string = "/v1"
+
+// RegisterREST adds the versioned REST API, the routes of the commands are generated
+// from the dispatcher so both transports run the same code
+func (f *Files) RegisterREST(e *echo.Echo) {
+	g := e.Group(RESTPrefix, f.restAuth)
+	for _, cmd := range Commands() {
+		if cmd.Path == "" {
+			continue
+		}
+		cmd := cmd
+		g.Add(cmd.Method, cmd.Path, func(c echo.Context) error {
+			msg := evmsg.NewMessage()
+			msg.Scope = cmd.Scope
+			msg.Command = cmd.Name
+			params, err := restParams(c)
+			if err != nil {
+				return jsonError(c, http.StatusBadRequest, err)
+			}
+			msg.Data = []interface{}{params}
+			nMsg, err := f.Dispatch(contextWithClient(c.Request().Context(), c.Request()), f.Identity(c.Request()), msg)
+			if err != nil {
+				c.Logger().Error(err)
+				status := http.StatusInternalServerError
+				if ce, ok := err.(*CommandError); ok {
+					status = ce.Status
+				}
+				return c.JSON(status, nMsg)
+			}
+			return c.JSON(http.StatusOK, nMsg)
+		}, f.RateLimit(RateCommand))
+	}
+	g.POST("/buckets/:bucket/objects", func(c echo.Context) error {
+		if !f.Allowed(f.Identity(c.Request()), PermissionWrite) {
+			return jsonError(c, http.StatusForbidden, errors.New("the upload needs the permission <"+PermissionWrite+">!"))
+		}
+		return f.handleUpload(c, c.Param("bucket"))
+	}, f.Audit("Object/upload"), f.RateLimit(RateUpload))
+	g.GET("/buckets/:bucket/objects/*", func(c echo.Context) error {
+		return f.serveObject(c, c.Param("bucket"), restFile(c))
+	}, f.Audit("Object/download"), f.RateLimit(RateDownload))
+	g.HEAD("/buckets/:bucket/objects/*", func(c echo.Context) error {
+		return f.headObject(c, c.Param("bucket"), restFile(c))
+	}, f.Audit("Object/head"), f.RateLimit(RateDownload))
+}
+
+// restAuth allows identities only, the REST API can change the buckets
+func (f *Files) restAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if f.Identity(c.Request()) == "" {
+			c.Response().Header().Set("WWW-Authenticate", "Basic realm=\"files\"")
+			return jsonError(c, http.StatusUnauthorized, errors.New("the REST API needs basic auth!"))
+		}
+		return next(c)
+	}
+}
+
+// restFile returns the key of the wildcard, echo keeps it escaped if the path needed escaping
+func restFile(c echo.Context) string {
+	file := c.Param("*")
+	if c.Request().URL.RawPath != "" {
+		if unescaped, err := url.PathUnescape(file); err == nil {
+			return unescaped
+		}
+	}
+	return file
+}
+
+// restParams merges the JSON body, the query and the path of a request, the path wins
+func restParams(c echo.Context) (map[string]interface{}, error) {
+	params := map[string]interface{}{}
+	if c.Request().ContentLength != 0 && c.Request().Body != nil {
+		err := json.NewDecoder(c.Request().Body).Decode(&params)
+		if err != nil && err != io.EOF {
+			return nil, errors.New("the body has to be a JSON object!")
+		}
+	}
+	for k, v := range c.QueryParams() {
+		params[k] = v[0]
+	}
+	for _, name := range c.ParamNames() {
+		if name == "*" {
+			params["file"] = restFile(c)
+			continue
+		}
+		params[name] = c.Param(name)
+	}
+	return params, nil
+}
+
+// serveObject sends the content of an object, non-owners of buckets with a watermark policy get a marked copy
+func (f *Files) serveObject(c echo.Context, bucket, file string) error {
+	s := f.storageOf(c.Request().Context())
+	err := CheckBucket(bucket)
+	if err == nil {
+		err = CheckScan(s, bucket, file)
+	}
+	if err != nil {
+		return jsonError(c, http.StatusForbidden, err)
+	}
+	policy, err := f.CheckWatermark(c.Request(), bucket)
+	if err != nil {
+		return jsonError(c, http.StatusInternalServerError, err)
+	}
+	if policy != nil {
+		if !CanWatermark(file) {
+			return jsonError(c, http.StatusForbidden, errors.New("the file <"+file+"> is only available to the owners of the bucket!"))
+		}
+		release, err := f.imageSlot(c.Request().Context())
+		if err != nil {
+			return err
+		}
+		rc, cType, err := Transform(s, bucket, file, []TransformOp{policy.Op()})
+		release()
+		if err != nil {
+			return jsonError(c, http.StatusInternalServerError, err)
+		}
+		defer rc.Close()
+		return c.Stream(http.StatusOK, cType, rc)
+	}
+	msg, err := s.GetObject(bucket, file)
+	if err != nil {
+		c.Response().WriteHeader(http.StatusInternalServerError)
+		c.Response().Write([]byte(err.Error()))
+		return err
+	}
+	c.Logger().Info(msg.Data.([]interface{})[0].(map[string]interface{})["path"].(string))
+	tmpFile := filepath.Base(msg.Data.([]interface{})[0].(map[string]interface{})["path"].(string))
+	cacheFilePath := MinioFilesCacheDir + string(os.PathSeparator) + tmpFile
+	resp, err := s.ReadCache(cacheFilePath)
+	if err != nil {
+		c.Response().WriteHeader(http.StatusInternalServerError)
+		c.Response().Write([]byte(err.Error()))
+		return err
+	}
+	defer resp.Close()
+	c.Response().WriteHeader(http.StatusOK)
+	io.Copy(c.Response(), resp)
+	return nil
+}
+
+// headObject answers with the size, the type and the checksum of an object
+func (f *Files) headObject(c echo.Context, bucket, file string) error {
+	s := f.storageOf(c.Request().Context())
+	if CheckBucket(bucket) != nil || CheckScan(s, bucket, file) != nil {
+		return c.NoContent(http.StatusForbidden)
+	}
+	rc, size, err := s.ReadObject(bucket, file)
+	if err != nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	rc.Close()
+	cType := mime.TypeByExtension(filepath.Ext(file))
+	if cType == "" {
+		cType = "application/octet-stream"
+	}
+	c.Response().Header().Set("Content-Type", cType)
+	c.Response().Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if meta, err := GetMeta(s, file); err == nil && meta["checksum"] != "" {
+		c.Response().Header().Set("ETag", "\""+meta["checksum"]+"\"")
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// handleUpload stores the file of a multipart form, archives are extracted on request
+func (f *Files) handleUpload(c echo.Context, bucket string) error {
+	ctx := c.Request().Context()
+	if err := CheckBucket(bucket); err != nil {
+		return jsonError(c, http.StatusForbidden, err)
+	}
+	_, span := StartSpan(ctx, "upload.form", SpanInternal)
+	file, err := c.FormFile("file")
+	span.Finish(err)
+	if err != nil {
+		return jsonError(c, http.StatusBadRequest, err)
+	}
+	if c.Request().FormValue("extract") == "true" && IsArchive(file.Filename) {
+		status := http.StatusOK
+		msg, err := ExtractArchive(f.storageOf(ctx), f.WSScanner, bucket, c.Request().FormValue("prefix"), c.Request().FormValue("description"), file)
+		if err != nil {
+			c.Logger().Error(err)
+			status = http.StatusBadRequest
+		}
+		return c.JSON(status, msg)
+	}
+	status, err := f.Upload(ctx, bucket, file, c.Request().FormValue("checksum"), c.Request().FormValue("description"), c.Request().FormValue("tags"))
+	if err != nil {
+		c.Logger().Error(err)
+		return jsonError(c, status, err)
+	}
+	msg, err := f.storageOf(ctx).GetObject(bucket, file.Filename)
+	if err != nil {
+		return jsonError(c, http.StatusInternalServerError, err)
+	}
+	return c.JSON(http.StatusOK, msg)
+}
@@ -0,0 +1,170 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"evalgo.org/evmsg"
+	echo "github.com/labstack/echo/v4"
+)
+
+func Test_Unit_Dispatch(t *testing.T) {
+	f := &Files{WSStorage: newMemStorage(), WSClient: "files"}
+	msg := &evmsg.Message{Scope: "Object", Command: "explode"}
+	nMsg, err := f.Dispatch(context.Background(), "files", msg)
+	if ce, ok := err.(*CommandError); !ok || ce.Status != http.StatusNotFound || ce.Code != "unknown_command" || nMsg.Value("code") != "unknown_command" {
+		t.Error("unknown commands have to fail with a structured error", err, nMsg.Data)
+	}
+	msg = &evmsg.Message{Scope: "Object", Command: "delete", Data: []interface{}{map[string]interface{}{"bucket": "test"}}}
+	if _, err := f.Dispatch(context.Background(), "files", msg); err == nil || err.(*CommandError).Status != http.StatusBadRequest {
+		t.Error("missing keys have to fail", err)
+	}
+	msg = &evmsg.Message{Scope: "Object", Command: "delete", Data: []interface{}{map[string]interface{}{"bucket": "test", "file": 42.0}}}
+	if _, err := f.Dispatch(context.Background(), "files", msg); err == nil || err.(*CommandError).Code != "invalid_parameter" {
+		t.Error("parameters of the wrong type have to fail instead of panicking", err)
+	}
+	msg = &evmsg.Message{Scope: "Object", Command: "similar", Data: []interface{}{map[string]interface{}{"bucket": "test", "file": "a.png", "distance": "99"}}}
+	if _, err := f.Dispatch(context.Background(), "files", msg); err == nil || err.(*CommandError).Code != "invalid_parameter" {
+		t.Error("the validation of the command has to run", err)
+	}
+	for _, cmd := range Commands() {
+		if cmd.Run == nil || (cmd.Path != "" && cmd.Method == "") || permissionLevels[cmd.Permission] == 0 {
+			t.Error("incomplete command", cmd.Scope, cmd.Name)
+		}
+	}
+}
+
+func Test_Unit_DispatchPermissions(t *testing.T) {
+	identities, permissions := Identities, IdentityPermissions
+	IdentityPermissions = map[string]string{"reader": PermissionRead}
+	defer func() { Identities, IdentityPermissions = identities, permissions }()
+	f := &Files{WSStorage: newMemStorage(), WSClient: "files"}
+	msg := &evmsg.Message{Scope: "Bucket", Command: "create", Data: []interface{}{map[string]interface{}{"bucket": "docs"}}}
+	if _, err := f.Dispatch(context.Background(), "reader", msg); err == nil || err.(*CommandError).Status != http.StatusForbidden {
+		t.Error("readers must not create buckets", err)
+	}
+	msg = &evmsg.Message{Scope: "Search", Command: "reindex"}
+	if _, err := f.Dispatch(context.Background(), "writer", msg); err == nil || err.(*CommandError).Code != "forbidden" {
+		t.Error("only administrators may rebuild the index", err)
+	}
+	msg = &evmsg.Message{Scope: "System", Command: "commands"}
+	nMsg, err := f.Dispatch(context.Background(), "reader", msg)
+	if err != nil || len(nMsg.Data.([]interface{})) != len(Commands()) {
+		t.Fatal("the commands have to be listed", err)
+	}
+	if _, err := f.Dispatch(context.Background(), "", msg); err == nil {
+		t.Error("anonymous identities must not run commands")
+	}
+
+	dir, err := ioutil.TempDir("", "identities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "identities.json")
+	ioutil.WriteFile(path, []byte(`{"alice":"wonderland","bob":{"secret":"builder","permission":"read"}}`), 0600)
+	secrets, perms, err := LoadIdentities(path)
+	if err != nil || secrets["alice"] != "wonderland" || secrets["bob"] != "builder" || perms["bob"] != PermissionRead || perms["alice"] != "" {
+		t.Error("unexpected identities", secrets, perms, err)
+	}
+	ioutil.WriteFile(path, []byte(`{"bob":{"secret":"builder","permission":"root"}}`), 0600)
+	if _, _, err := LoadIdentities(path); err == nil {
+		t.Error("unknown permissions have to fail")
+	}
+}
+
+func restDo(e *echo.Echo, method, target string, body []byte, contentType string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	r.SetBasicAuth("files", "secret")
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	return w
+}
+
+func Test_Unit_REST(t *testing.T) {
+	s := newMemStorage()
+	f := &Files{WSStorage: s, WSClient: "files", WSSecret: "secret"}
+	e := echo.New()
+	f.RegisterREST(e)
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/v1/buckets", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Error("anonymous requests have to be rejected", w.Code)
+	}
+	if w = restDo(e, "POST", "/v1/buckets", []byte(`{"bucket":"docs"}`), "application/json"); w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	body := bytes.NewBuffer(nil)
+	mw := multipart.NewWriter(body)
+	fw, _ := mw.CreateFormFile("file", "notes.txt")
+	fw.Write([]byte("hello"))
+	mw.WriteField("description", "first notes")
+	mw.Close()
+	if w = restDo(e, "POST", "/v1/buckets/docs/objects", body.Bytes(), mw.FormDataContentType()); w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = restDo(e, "GET", "/v1/buckets/docs/objects?prefix=notes", nil, "")
+	msg := evmsg.Message{}
+	if err := json.Unmarshal(w.Body.Bytes(), &msg); err != nil || msg.Value("key") != "notes.txt" {
+		t.Error("unexpected listing", w.Body.String())
+	}
+	if w = restDo(e, "PATCH", "/v1/buckets/docs/meta/notes.txt", []byte(`{"tags":"draft"}`), "application/json"); w.Code != http.StatusOK {
+		t.Error(w.Code, w.Body.String())
+	}
+	if meta, _ := GetMeta(s, "notes.txt"); meta["tags"] != "draft" || meta["description"] != "first notes" {
+		t.Error("unexpected meta", meta)
+	}
+	if w = restDo(e, "HEAD", "/v1/buckets/docs/objects/notes.txt", nil, ""); w.Code != http.StatusOK || w.Header().Get("Content-Length") != "5" {
+		t.Error("unexpected head", w.Code, w.Header())
+	}
+	if w = restDo(e, "DELETE", "/v1/buckets/docs/objects/notes.txt", nil, ""); w.Code != http.StatusOK || s.objects["docs"]["notes.txt"] != nil {
+		t.Error("unexpected delete", w.Code, w.Body.String())
+	}
+	if w = restDo(e, "GET", "/v1/buckets/docs/similar/notes.txt?distance=far", nil, ""); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_parameter") {
+		t.Error("the query has to be converted to the types of the parameters", w.Code, w.Body.String())
+	}
+	w = restDo(e, "GET", "/v1/search", nil, "")
+	if w.Code != http.StatusNotImplemented || !strings.Contains(w.Body.String(), "not enabled") {
+		t.Error("the errors have to use the message envelope", w.Code, w.Body.String())
+	}
+}
+
+func Test_Unit_InternalBuckets(t *testing.T) {
+	s := newMemStorage()
+	s.put(EncryptionKeysBucket, "keys/docs", []byte("wrapped"))
+	s.put(PolicyBucket, policyKey("docs"), []byte(`{"text":"preview"}`))
+	f := &Files{WSStorage: s, WSClient: "files", WSSecret: "secret"}
+	for _, cmd := range Commands() {
+		if cmd.Scope != "Object" {
+			continue
+		}
+		data := map[string]interface{}{"bucket": PolicyBucket, "file": policyKey("docs"), "pipeline": "grayscale"}
+		msg := &evmsg.Message{Scope: cmd.Scope, Command: cmd.Name, Data: []interface{}{data}}
+		if _, err := f.Dispatch(context.Background(), "files", msg); err == nil || !strings.Contains(err.Error(), "internal") {
+			t.Error("the command has to reject the internal buckets", cmd.Name, err)
+		}
+	}
+	if s.objects[PolicyBucket][policyKey("docs")] == nil {
+		t.Error("the policy must not be removed")
+	}
+	e := echo.New()
+	f.RegisterREST(e)
+	for _, method := range []string{"GET", "HEAD"} {
+		if w := restDo(e, method, "/v1/buckets/"+EncryptionKeysBucket+"/objects/keys/docs", nil, ""); w.Code != http.StatusForbidden {
+			t.Error("the internal objects must not be served", method, w.Code)
+		}
+	}
+}
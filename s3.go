@@ -0,0 +1,1039 @@
+package files
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v6"
+	"github.com/neko-neko/echo-logrus/v2/log"
+)
+
+var S3Address string = ""
+var S3Region string = "us-east-1"
+var S3MaxObjectSize int64 = 1 << 30
+var S3MaxSkew time.Duration = 15 * time.Minute
+var S3UploadExpiry time.Duration = 24 * time.Hour
+
+const s3Algorithm = "AWS4-HMAC-SHA256"
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+const s3StreamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+const s3EmptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+var s3Now = time.Now
+
+// S3Error is the error document of the S3 API
+type S3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+	Status   int      `xml:"-"`
+}
+
+func (e *S3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func s3Err(status int, code, message string) *S3Error {
+	return &S3Error{Code: code, Message: message, Status: status}
+}
+
+// secretOf returns the secret of an identity, the service client is always known
+func (f *Files) secretOf(name string) (string, bool) {
+	if name == f.WSClient {
+		return f.WSSecret, true
+	}
+	secret, ok := Identities[name]
+	return secret, ok
+}
+
+// s3Auth is a verified signature, streamed payloads are checked chunk by chunk with it
+type s3Auth struct {
+	identity  string
+	key       []byte
+	date      string
+	scope     string
+	signature string
+	payload   string
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3SigningKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// s3Encode is the URI encoding of SigV4, everything but the unreserved characters is escaped
+func s3Encode(s string, encodeSlash bool) string {
+	buff := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			buff.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&buff, "%%%02X", c)
+	}
+	return buff.String()
+}
+
+func s3CanonicalRequest(r *http.Request, signed []string, payload string) string {
+	type pair struct{ k, v string }
+	pairs := []pair{}
+	for k, vs := range r.URL.Query() {
+		if k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range vs {
+			pairs = append(pairs, pair{s3Encode(k, true), s3Encode(v, true)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].k != pairs[j].k {
+			return pairs[i].k < pairs[j].k
+		}
+		return pairs[i].v < pairs[j].v
+	})
+	query := make([]string, len(pairs))
+	for i, p := range pairs {
+		query[i] = p.k + "=" + p.v
+	}
+	headers := bytes.NewBuffer(nil)
+	for _, h := range signed {
+		v := strings.Join(r.Header.Values(h), ",")
+		switch h {
+		case "host":
+			v = r.Host
+		case "content-length":
+			if v == "" {
+				v = strconv.FormatInt(r.ContentLength, 10)
+			}
+		}
+		headers.WriteString(h + ":" + strings.Join(strings.Fields(v), " ") + "\n")
+	}
+	path := r.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	return strings.Join([]string{r.Method, s3Encode(path, false), strings.Join(query, "&"), headers.String(), strings.Join(signed, ";"), payload}, "\n")
+}
+
+// s3Authenticate verifies the SigV4 signature of a request, given in the
+// Authorization header or in the query of a presigned URL
+func (f *Files) s3Authenticate(r *http.Request) (*s3Auth, error) {
+	q := r.URL.Query()
+	var credential, signedHeaders, signature, amzDate, payload string
+	var expires int64
+	if q.Get("X-Amz-Algorithm") != "" {
+		if q.Get("X-Amz-Algorithm") != s3Algorithm {
+			return nil, s3Err(http.StatusBadRequest, "AuthorizationQueryParametersError", "the algorithm <"+q.Get("X-Amz-Algorithm")+"> is not supported!")
+		}
+		credential = q.Get("X-Amz-Credential")
+		signedHeaders = q.Get("X-Amz-SignedHeaders")
+		signature = q.Get("X-Amz-Signature")
+		amzDate = q.Get("X-Amz-Date")
+		payload = s3UnsignedPayload
+		var err error
+		expires, err = strconv.ParseInt(q.Get("X-Amz-Expires"), 10, 64)
+		if err != nil || expires <= 0 || expires > 7*24*3600 {
+			return nil, s3Err(http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires has to be between 1 and 604800 seconds!")
+		}
+	} else {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, s3Algorithm+" ") {
+			return nil, s3Err(http.StatusForbidden, "AccessDenied", "the request is not signed with "+s3Algorithm+"!")
+		}
+		for _, part := range strings.Split(strings.TrimPrefix(header, s3Algorithm+" "), ",") {
+			kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "Credential":
+				credential = kv[1]
+			case "SignedHeaders":
+				signedHeaders = kv[1]
+			case "Signature":
+				signature = kv[1]
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		payload = r.Header.Get("X-Amz-Content-Sha256")
+		if payload == "" {
+			return nil, s3Err(http.StatusBadRequest, "InvalidRequest", "the x-amz-content-sha256 header is missing!")
+		}
+	}
+	signed, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil {
+		return nil, s3Err(http.StatusForbidden, "AccessDenied", "the request has no valid date!")
+	}
+	now := s3Now()
+	if expires > 0 {
+		if now.After(signed.Add(time.Duration(expires)*time.Second)) || signed.After(now.Add(S3MaxSkew)) {
+			return nil, s3Err(http.StatusForbidden, "AccessDenied", "the presigned url is expired!")
+		}
+	} else if now.Sub(signed) > S3MaxSkew || signed.Sub(now) > S3MaxSkew {
+		return nil, s3Err(http.StatusForbidden, "RequestTimeTooSkewed", "the difference between the request time and the server time is too large!")
+	}
+	cred := strings.Split(credential, "/")
+	if len(cred) != 5 || cred[1] != amzDate[:8] || cred[3] != "s3" || cred[4] != "aws4_request" {
+		return nil, s3Err(http.StatusForbidden, "AuthorizationHeaderMalformed", "the credential <"+credential+"> is malformed!")
+	}
+	secret, ok := f.secretOf(cred[0])
+	if !ok {
+		return nil, s3Err(http.StatusForbidden, "InvalidAccessKeyId", "the access key <"+cred[0]+"> is not known!")
+	}
+	auth := &s3Auth{
+		identity:  cred[0],
+		key:       s3SigningKey(secret, cred[1], cred[2], cred[3]),
+		date:      amzDate,
+		scope:     strings.Join(cred[1:], "/"),
+		signature: signature,
+		payload:   payload,
+	}
+	canonical := sha256.Sum256([]byte(s3CanonicalRequest(r, strings.Split(signedHeaders, ";"), payload)))
+	expected := hex.EncodeToString(hmacSHA256(auth.key, s3Algorithm+"\n"+amzDate+"\n"+auth.scope+"\n"+hex.EncodeToString(canonical[:])))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, s3Err(http.StatusForbidden, "SignatureDoesNotMatch", "the request signature does not match!")
+	}
+	return auth, nil
+}
+
+// body reads the payload of a request and checks it against the signed hash
+func (a *s3Auth) body(r *http.Request) ([]byte, error) {
+	return ioutil.ReadAll(a.reader(r))
+}
+
+// reader streams the payload of a request, the signed hash is checked when the payload ends
+func (a *s3Auth) reader(r *http.Request) io.Reader {
+	if a.payload == s3StreamingPayload {
+		return a.chunks(r.Body)
+	}
+	return &s3Payload{r: r.Body, hash: sha256.New(), payload: a.payload}
+}
+
+func s3TooLarge() error {
+	return s3Err(http.StatusBadRequest, "EntityTooLarge", "the object is larger than "+strconv.FormatInt(S3MaxObjectSize, 10)+" bytes!")
+}
+
+// s3Payload is a payload signed with its sha256 hash or not signed at all
+type s3Payload struct {
+	r       io.Reader
+	hash    hash.Hash
+	payload string
+	size    int64
+}
+
+func (p *s3Payload) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.size += int64(n)
+	p.hash.Write(b[:n])
+	if p.size > S3MaxObjectSize {
+		return n, s3TooLarge()
+	}
+	if err != nil && err != io.EOF {
+		return n, s3Err(http.StatusBadRequest, "IncompleteBody", err.Error())
+	}
+	if err == io.EOF && p.payload != s3UnsignedPayload && hex.EncodeToString(p.hash.Sum(nil)) != p.payload {
+		return n, s3Err(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "the payload does not match the signed hash!")
+	}
+	return n, err
+}
+
+// s3Chunks decodes an aws-chunked payload, every chunk is signed with the signature of its predecessor
+type s3Chunks struct {
+	auth  *s3Auth
+	r     *bufio.Reader
+	prev  string
+	chunk []byte
+	size  int64
+	done  bool
+}
+
+func (a *s3Auth) chunks(r io.Reader) io.Reader {
+	return &s3Chunks{auth: a, r: bufio.NewReader(r), prev: a.signature}
+}
+
+func (c *s3Chunks) Read(b []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
+
+// next reads and verifies the following chunk
+func (c *s3Chunks) next() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return s3Err(http.StatusBadRequest, "IncompleteBody", "the chunked payload ended early!")
+	}
+	parts := strings.SplitN(strings.TrimRight(line, "\r\n"), ";chunk-signature=", 2)
+	if len(parts) != 2 {
+		return s3Err(http.StatusBadRequest, "InvalidRequest", "the chunk header is malformed!")
+	}
+	size, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil || size < 0 {
+		return s3Err(http.StatusBadRequest, "InvalidRequest", "the chunk size is malformed!")
+	}
+	if c.size+size > S3MaxObjectSize {
+		return s3TooLarge()
+	}
+	chunk := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, chunk); err != nil || string(chunk[size:]) != "\r\n" {
+		return s3Err(http.StatusBadRequest, "IncompleteBody", "the chunked payload ended early!")
+	}
+	chunk = chunk[:size]
+	a := c.auth
+	sum := sha256.Sum256(chunk)
+	sig := hex.EncodeToString(hmacSHA256(a.key, "AWS4-HMAC-SHA256-PAYLOAD\n"+a.date+"\n"+a.scope+"\n"+c.prev+"\n"+s3EmptySHA256+"\n"+hex.EncodeToString(sum[:])))
+	if !hmac.Equal([]byte(sig), []byte(parts[1])) {
+		return s3Err(http.StatusForbidden, "SignatureDoesNotMatch", "the chunk signature does not match!")
+	}
+	c.prev = sig
+	c.size += size
+	c.chunk = chunk
+	c.done = size == 0
+	return nil
+}
+
+func s3Time(v interface{}) string {
+	t, ok := v.(time.Time)
+	if !ok {
+		t = s3Now()
+	}
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func s3Size(v interface{}) int64 {
+	switch size := v.(type) {
+	case int64:
+		return size
+	case int:
+		return int64(size)
+	case float64:
+		return int64(size)
+	}
+	return 0
+}
+
+// s3ETag uses the checksum of the meta information, with md5 uploads it is the etag S3 clients expect
+func s3ETag(checksum interface{}, fallback interface{}) string {
+	if c, ok := checksum.(string); ok && c != "" {
+		parts := strings.SplitN(c, ":", 2)
+		return "\"" + parts[len(parts)-1] + "\""
+	}
+	if e, ok := fallback.(string); ok && e != "" {
+		return "\"" + strings.Trim(e, "\"") + "\""
+	}
+	return ""
+}
+
+func s3XML(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	return xml.NewEncoder(w).Encode(v)
+}
+
+type s3Server struct {
+	f *Files
+}
+
+// S3 returns the S3 compatible facade of the service, buckets are addressed path style
+func (f *Files) S3() http.Handler {
+	return &s3Server{f: f}
+}
+
+func (s *s3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := s.serve(w, r)
+	if err == nil {
+		return
+	}
+	s3e, ok := err.(*S3Error)
+	if !ok {
+		s3e = s3Err(http.StatusInternalServerError, "InternalError", err.Error())
+	}
+	s3e.Resource = r.URL.Path
+	log.Logger().Error(s3e)
+	if r.Method == http.MethodHead {
+		w.WriteHeader(s3e.Status)
+		return
+	}
+	s3XML(w, s3e.Status, s3e)
+}
+
+func (s *s3Server) serve(w http.ResponseWriter, r *http.Request) error {
+	auth, err := s.f.s3Authenticate(r)
+	if err != nil {
+		return err
+	}
+	auditIdentity(r.Context(), auth.identity)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !s.f.Allowed(auth.identity, PermissionWrite) {
+		return s3Err(http.StatusForbidden, "AccessDenied", "the request needs the permission <"+PermissionWrite+">!")
+	}
+	class := RateCommand
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		class = RateDownload
+	case http.MethodPut, http.MethodPost:
+		class = RateUpload
+	}
+	w, err = s.f.limitRequest(w, r, class, auth.identity)
+	if err != nil {
+		return s3Err(http.StatusTooManyRequests, "SlowDown", err.Error())
+	}
+	st := s.f.storageOf(r.Context())
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket, key := path[0], ""
+	if len(path) == 2 {
+		key = path[1]
+	}
+	if bucket == "" {
+		if r.Method == http.MethodGet {
+			return s.listBuckets(w, st)
+		}
+		return s3Err(http.StatusMethodNotAllowed, "MethodNotAllowed", "the method is not allowed on the service!")
+	}
+	if IsInternalBucket(bucket) {
+		return s3Err(http.StatusForbidden, "AccessDenied", "the bucket <"+bucket+"> is internal!")
+	}
+	if r.Method == http.MethodPut && key == "" {
+		return s.createBucket(w, st, bucket)
+	}
+	exists, err := HasBucket(st, bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return s3Err(http.StatusNotFound, "NoSuchBucket", "the bucket <"+bucket+"> does not exist!")
+	}
+	q := r.URL.Query()
+	_, uploads := q["uploads"]
+	_, upload := q["uploadId"]
+	_, hasLocation := q["location"]
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case key == "" && r.Method == http.MethodGet && hasLocation:
+		return s3XML(w, http.StatusOK, s3Location{Region: S3Region})
+	case key == "" && r.Method == http.MethodGet:
+		return s.listObjects(w, st, bucket, q)
+	case key == "":
+	case r.Method == http.MethodPost && uploads:
+		return s.initiateUpload(w, st, bucket, key)
+	case r.Method == http.MethodPut && upload:
+		return s.putPart(w, r, auth, bucket, key)
+	case r.Method == http.MethodPost && upload:
+		return s.completeUpload(w, r, auth, bucket, key)
+	case r.Method == http.MethodDelete && upload:
+		return s.abortUpload(w, st, bucket, key, q.Get("uploadId"))
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") == "":
+		return s.putObject(w, r, bucket, key, auth.reader(r))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return s.getObject(w, r, auth, bucket, key)
+	case r.Method == http.MethodDelete:
+		if _, err := st.RemoveObject(bucket, key); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return s3Err(http.StatusNotImplemented, "NotImplemented", "the operation is not supported!")
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListBucketsResult struct {
+	XMLName xml.Name   `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+func (s *s3Server) listBuckets(w http.ResponseWriter, st Storage) error {
+	msg, err := st.ListBuckets()
+	if err != nil {
+		return err
+	}
+	result := s3ListBucketsResult{Owner: s3Owner{ID: s.f.WSClient, DisplayName: s.f.WSClient}, Buckets: []s3Bucket{}}
+	list, _ := msg.Data.([]interface{})
+	for _, b := range list {
+		bucket := b.(map[string]interface{})
+		name := bucket["name"].(string)
+		if IsInternalBucket(name) {
+			continue
+		}
+		result.Buckets = append(result.Buckets, s3Bucket{Name: name, CreationDate: s3Time(bucket["created"])})
+	}
+	sort.Slice(result.Buckets, func(i, j int) bool { return result.Buckets[i].Name < result.Buckets[j].Name })
+	return s3XML(w, http.StatusOK, result)
+}
+
+func (s *s3Server) createBucket(w http.ResponseWriter, st Storage, bucket string) error {
+	exists, err := HasBucket(st, bucket)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return s3Err(http.StatusConflict, "BucketAlreadyOwnedByYou", "the bucket <"+bucket+"> already exists!")
+	}
+	if _, err := st.CreateBucket(bucket); err != nil {
+		return err
+	}
+	w.Header().Set("Location", "/"+bucket)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+type s3Location struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+	Region  string   `xml:",chardata"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3Prefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListObjectsResult struct {
+	XMLName               xml.Name   `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string     `xml:"Name"`
+	Prefix                string     `xml:"Prefix"`
+	Delimiter             string     `xml:"Delimiter,omitempty"`
+	MaxKeys               int        `xml:"MaxKeys"`
+	KeyCount              int        `xml:"KeyCount,omitempty"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	Marker                string     `xml:"Marker,omitempty"`
+	NextMarker            string     `xml:"NextMarker,omitempty"`
+	ContinuationToken     string     `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string     `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string     `xml:"StartAfter,omitempty"`
+	Contents              []s3Object `xml:"Contents"`
+	CommonPrefixes        []s3Prefix `xml:"CommonPrefixes"`
+}
+
+// listObjects answers ListObjectsV2 and the older ListObjects, the continuation token is the last key
+func (s *s3Server) listObjects(w http.ResponseWriter, st Storage, bucket string, q map[string][]string) error {
+	get := func(k string) string {
+		if v, ok := q[k]; ok && len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	v2 := get("list-type") == "2"
+	result := s3ListObjectsResult{Name: bucket, Prefix: get("prefix"), Delimiter: get("delimiter"), MaxKeys: 1000}
+	if get("max-keys") != "" {
+		max, err := strconv.Atoi(get("max-keys"))
+		if err != nil || max < 0 {
+			return s3Err(http.StatusBadRequest, "InvalidArgument", "max-keys has to be a positive number!")
+		}
+		if max < result.MaxKeys {
+			result.MaxKeys = max
+		}
+	}
+	after := get("marker")
+	if v2 {
+		result.StartAfter = get("start-after")
+		result.ContinuationToken = get("continuation-token")
+		after = result.StartAfter
+		if result.ContinuationToken != "" {
+			token, err := hex.DecodeString(result.ContinuationToken)
+			if err != nil {
+				return s3Err(http.StatusBadRequest, "InvalidArgument", "the continuation token is invalid!")
+			}
+			after = string(token)
+		}
+	} else {
+		result.Marker = after
+	}
+	msg, err := st.ListObjects(minio.BucketInfo{Name: bucket}, result.Prefix)
+	if err != nil {
+		return err
+	}
+	objects := []map[string]interface{}{}
+	list, _ := msg.Data.([]interface{})
+	for _, o := range list {
+		obj := o.(map[string]interface{})
+		key := obj["key"].(string)
+		// a marker ending with the delimiter stands for the whole common prefix
+		skipped := result.Delimiter != "" && strings.HasSuffix(after, result.Delimiter) && strings.HasPrefix(key, after)
+		if strings.HasPrefix(key, result.Prefix) && key > after && !skipped {
+			objects = append(objects, obj)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i]["key"].(string) < objects[j]["key"].(string) })
+	prefixes := map[string]bool{}
+	last := ""
+	for _, obj := range objects {
+		key := obj["key"].(string)
+		if result.Delimiter != "" {
+			if i := strings.Index(key[len(result.Prefix):], result.Delimiter); i >= 0 {
+				prefix := key[:len(result.Prefix)+i+len(result.Delimiter)]
+				if prefixes[prefix] {
+					continue
+				}
+				if len(result.Contents)+len(result.CommonPrefixes) >= result.MaxKeys {
+					result.IsTruncated = true
+					break
+				}
+				prefixes[prefix] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, s3Prefix{Prefix: prefix})
+				last = prefix
+				continue
+			}
+		}
+		if len(result.Contents)+len(result.CommonPrefixes) >= result.MaxKeys {
+			result.IsTruncated = true
+			break
+		}
+		result.Contents = append(result.Contents, s3Object{
+			Key:          key,
+			LastModified: s3Time(obj["modified"]),
+			ETag:         s3ETag(obj["checksum"], obj["etag"]),
+			Size:         s3Size(obj["size"]),
+			StorageClass: "STANDARD",
+		})
+		last = key
+	}
+	if result.IsTruncated {
+		if v2 {
+			result.NextContinuationToken = hex.EncodeToString([]byte(last))
+		} else {
+			result.NextMarker = last
+		}
+	}
+	if v2 {
+		result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	}
+	return s3XML(w, http.StatusOK, result)
+}
+
+// s3UploadError maps the failures of an upload to the error codes of S3
+func s3UploadError(status int, err error) error {
+	switch status {
+	case http.StatusBadRequest:
+		return s3Err(status, "BadDigest", err.Error())
+	case http.StatusUnprocessableEntity:
+		return s3Err(http.StatusForbidden, "AccessDenied", err.Error())
+	case http.StatusAccepted:
+		return s3Err(http.StatusServiceUnavailable, "ServiceUnavailable", err.Error())
+	}
+	return s3Err(http.StatusInternalServerError, "InternalError", err.Error())
+}
+
+// putObject stores an object through the same checks as the uploads of the objects route
+func (s *s3Server) putObject(w http.ResponseWriter, r *http.Request, bucket, key string, body io.Reader) error {
+	h := md5.New()
+	fh, form, err := NewFileHeaderFrom(key, io.TeeReader(body, h))
+	if err != nil {
+		return err
+	}
+	defer form.RemoveAll()
+	checksum := ""
+	if r.Header.Get("Content-Md5") != "" {
+		checksum = "md5:" + r.Header.Get("Content-Md5")
+	}
+	status, err := s.f.Upload(r.Context(), bucket, fh, checksum, r.Header.Get("X-Amz-Meta-Description"), r.Header.Get("X-Amz-Meta-Tags"))
+	if err != nil {
+		return s3UploadError(status, err)
+	}
+	w.Header().Set("ETag", "\""+hex.EncodeToString(h.Sum(nil))+"\"")
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// s3Range parses a single byte range, nil means the whole object
+func s3Range(header string, size int64) (*[2]int64, error) {
+	if header == "" {
+		return nil, nil
+	}
+	spec := strings.TrimPrefix(header, "bytes=")
+	parts := strings.SplitN(spec, "-", 2)
+	if spec == header || len(parts) != 2 || strings.Contains(spec, ",") {
+		return nil, s3Err(http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "the range <"+header+"> is not supported!")
+	}
+	var start, end int64
+	var err error
+	if parts[0] == "" {
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n <= 0 {
+			return nil, s3Err(http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "the range <"+header+"> is invalid!")
+		}
+		if n > size {
+			n = size
+		}
+		start, end = size-n, size-1
+	} else {
+		start, err = strconv.ParseInt(parts[0], 10, 64)
+		end = size - 1
+		if err == nil && parts[1] != "" {
+			end, err = strconv.ParseInt(parts[1], 10, 64)
+		}
+		if err != nil || start > end {
+			return nil, s3Err(http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "the range <"+header+"> is invalid!")
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return nil, s3Err(http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "the range <"+header+"> is outside of the object!")
+	}
+	return &[2]int64{start, end}, nil
+}
+
+// getObject serves an object with the scan and watermark checks of the objects route
+func (s *s3Server) getObject(w http.ResponseWriter, r *http.Request, auth *s3Auth, bucket, key string) error {
+	st := s.f.storageOf(r.Context())
+	err := CheckScan(st, bucket, key)
+	if err != nil {
+		return s3Err(http.StatusForbidden, "AccessDenied", err.Error())
+	}
+	policy, err := s.f.WatermarkFor(auth.identity, bucket)
+	if err != nil {
+		return err
+	}
+	var body io.ReadCloser
+	var size int64
+	cType := mime.TypeByExtension(filepath.Ext(key))
+	if policy != nil {
+		if !CanWatermark(key) {
+			return s3Err(http.StatusForbidden, "AccessDenied", "the file <"+key+"> is only available to the owners of the bucket!")
+		}
+		rc, mType, err := Transform(st, bucket, key, []TransformOp{policy.Op()})
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		body, size, cType = ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), mType
+	} else {
+		body, size, err = st.ReadObject(bucket, key)
+		if err != nil {
+			return s3Err(http.StatusNotFound, "NoSuchKey", "the key <"+key+"> does not exist!")
+		}
+	}
+	defer body.Close()
+	meta, _ := GetMeta(st, key)
+	if cType == "" {
+		cType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", cType)
+	w.Header().Set("Accept-Ranges", "bytes")
+	if etag := s3ETag(meta["checksum"], nil); etag != "" && policy == nil {
+		w.Header().Set("ETag", etag)
+	}
+	if meta["description"] != "" {
+		w.Header().Set("X-Amz-Meta-Description", meta["description"])
+	}
+	if meta["tags"] != "" {
+		w.Header().Set("X-Amz-Meta-Tags", meta["tags"])
+	}
+	rng, err := s3Range(r.Header.Get("Range"), size)
+	if err != nil {
+		return err
+	}
+	status := http.StatusOK
+	length := size
+	if rng != nil {
+		status = http.StatusPartialContent
+		length = rng[1] - rng[0] + 1
+		w.Header().Set("Content-Range", "bytes "+strconv.FormatInt(rng[0], 10)+"-"+strconv.FormatInt(rng[1], 10)+"/"+strconv.FormatInt(size, 10))
+		if _, err := io.CopyN(ioutil.Discard, body, rng[0]); err != nil {
+			return err
+		}
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err = io.CopyN(w, body, length)
+	if err != nil {
+		// the headers are already sent, the client receives a truncated object
+		log.Logger().Error(err)
+	}
+	return nil
+}
+
+type s3Upload struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+func s3UploadDir(uploadID string) string {
+	return filepath.Join(MinioFilesCacheDir, "multipart", uploadID)
+}
+
+// expireUploads removes the multipart uploads without activity for S3UploadExpiry, clients that give up
+// an upload rarely abort it
+func expireUploads() error {
+	root := filepath.Dir(s3UploadDir("-"))
+	dirs, err := ioutil.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, dir := range dirs {
+		// the directory changes with every part that gets added
+		if dir.IsDir() && s3Now().Sub(dir.ModTime()) > S3UploadExpiry {
+			if err := os.RemoveAll(filepath.Join(root, dir.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadUpload returns the directory of a multipart upload if it belongs to the object
+func (s *s3Server) loadUpload(st Storage, bucket, key, uploadID string) (string, error) {
+	if _, err := hex.DecodeString(uploadID); err != nil || uploadID == "" {
+		return "", s3Err(http.StatusNotFound, "NoSuchUpload", "the upload <"+uploadID+"> does not exist!")
+	}
+	dir := s3UploadDir(uploadID)
+	rc, err := st.ReadCache(filepath.Join(dir, "upload.json"))
+	if err != nil {
+		return "", s3Err(http.StatusNotFound, "NoSuchUpload", "the upload <"+uploadID+"> does not exist!")
+	}
+	defer rc.Close()
+	upload := s3Upload{}
+	if err := json.NewDecoder(rc).Decode(&upload); err != nil || upload.Bucket != bucket || upload.Key != key {
+		return "", s3Err(http.StatusNotFound, "NoSuchUpload", "the upload <"+uploadID+"> does not belong to <"+bucket+"/"+key+">!")
+	}
+	return dir, nil
+}
+
+type s3InitiateResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+func (s *s3Server) initiateUpload(w http.ResponseWriter, st Storage, bucket, key string) error {
+	if err := CheckUploadExtension(key); err != nil {
+		return s3Err(http.StatusBadRequest, "InvalidArgument", err.Error())
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	uploadID := hex.EncodeToString(id)
+	if err := expireUploads(); err != nil {
+		log.Logger().Error(err)
+	}
+	uB, _ := json.Marshal(s3Upload{Bucket: bucket, Key: key})
+	if err := st.WriteCache(filepath.Join(s3UploadDir(uploadID), "upload.json"), bytes.NewReader(uB)); err != nil {
+		return err
+	}
+	return s3XML(w, http.StatusOK, s3InitiateResult{Bucket: bucket, Key: key, UploadID: uploadID})
+}
+
+func s3PartFile(dir string, part int) string {
+	return filepath.Join(dir, fmt.Sprintf("part-%05d", part))
+}
+
+func (s *s3Server) putPart(w http.ResponseWriter, r *http.Request, auth *s3Auth, bucket, key string) error {
+	st := s.f.storageOf(r.Context())
+	dir, err := s.loadUpload(st, bucket, key, r.URL.Query().Get("uploadId"))
+	if err != nil {
+		return err
+	}
+	part, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || part < 1 || part > 10000 {
+		return s3Err(http.StatusBadRequest, "InvalidArgument", "the part number has to be between 1 and 10000!")
+	}
+	h := md5.New()
+	if err := st.WriteCache(s3PartFile(dir, part), io.TeeReader(auth.reader(r), h)); err != nil {
+		return err
+	}
+	w.Header().Set("ETag", "\""+hex.EncodeToString(h.Sum(nil))+"\"")
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+type s3CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteUpload struct {
+	Parts []s3CompletePart `xml:"Part"`
+}
+
+type s3CompleteResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+// s3Parts streams the parts of an upload one after the other and checks their etags on the way
+type s3Parts struct {
+	storage Storage
+	dir     string
+	parts   []int
+	etags   []string
+	rc      io.ReadCloser
+	hash    hash.Hash
+	size    int64
+	sums    []byte
+}
+
+func joinParts(st Storage, dir string, complete []s3CompletePart) *s3Parts {
+	p := &s3Parts{storage: st, dir: dir}
+	for _, part := range complete {
+		p.parts = append(p.parts, part.PartNumber)
+		p.etags = append(p.etags, strings.Trim(part.ETag, "\""))
+	}
+	return p
+}
+
+func (p *s3Parts) Read(b []byte) (int, error) {
+	for {
+		if p.rc == nil {
+			if len(p.parts) == 0 {
+				return 0, io.EOF
+			}
+			rc, err := p.storage.ReadCache(s3PartFile(p.dir, p.parts[0]))
+			if err != nil {
+				return 0, s3Err(http.StatusBadRequest, "InvalidPart", "the part <"+strconv.Itoa(p.parts[0])+"> was not uploaded!")
+			}
+			p.rc, p.hash = rc, md5.New()
+		}
+		n, err := p.rc.Read(b)
+		p.hash.Write(b[:n])
+		p.size += int64(n)
+		if p.size > S3MaxObjectSize {
+			return n, s3TooLarge()
+		}
+		if err != io.EOF {
+			return n, err
+		}
+		p.rc.Close()
+		p.rc = nil
+		sum := p.hash.Sum(nil)
+		if p.etags[0] != hex.EncodeToString(sum) {
+			return n, s3Err(http.StatusBadRequest, "InvalidPart", "the etag of the part <"+strconv.Itoa(p.parts[0])+"> does not match!")
+		}
+		p.sums = append(p.sums, sum...)
+		p.parts, p.etags = p.parts[1:], p.etags[1:]
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (p *s3Parts) Close() error {
+	if p.rc != nil {
+		return p.rc.Close()
+	}
+	return nil
+}
+
+// completeUpload joins the parts and stores the object like a single upload
+func (s *s3Server) completeUpload(w http.ResponseWriter, r *http.Request, auth *s3Auth, bucket, key string) error {
+	st := s.f.storageOf(r.Context())
+	dir, err := s.loadUpload(st, bucket, key, r.URL.Query().Get("uploadId"))
+	if err != nil {
+		return err
+	}
+	body, err := auth.body(r)
+	if err != nil {
+		return err
+	}
+	complete := s3CompleteUpload{}
+	if err := xml.Unmarshal(body, &complete); err != nil || len(complete.Parts) == 0 {
+		return s3Err(http.StatusBadRequest, "MalformedXML", "the list of parts is malformed!")
+	}
+	for i, part := range complete.Parts {
+		if i > 0 && part.PartNumber <= complete.Parts[i-1].PartNumber {
+			return s3Err(http.StatusBadRequest, "InvalidPartOrder", "the parts have to be in ascending order!")
+		}
+	}
+	parts := joinParts(st, dir, complete.Parts)
+	defer parts.Close()
+	fh, form, err := NewFileHeaderFrom(key, parts)
+	if err != nil {
+		return err
+	}
+	defer form.RemoveAll()
+	status, err := s.f.Upload(r.Context(), bucket, fh, "", r.Header.Get("X-Amz-Meta-Description"), r.Header.Get("X-Amz-Meta-Tags"))
+	if err != nil {
+		return s3UploadError(status, err)
+	}
+	os.RemoveAll(dir)
+	sum := md5.Sum(parts.sums)
+	return s3XML(w, http.StatusOK, s3CompleteResult{
+		Location: "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     "\"" + hex.EncodeToString(sum[:]) + "-" + strconv.Itoa(len(complete.Parts)) + "\"",
+	})
+}
+
+func (s *s3Server) abortUpload(w http.ResponseWriter, st Storage, bucket, key, uploadID string) error {
+	dir, err := s.loadUpload(st, bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
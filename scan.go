@@ -0,0 +1,184 @@
+package files
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ScanSecondsTimeout int64 = 60
+var ScanChunkSize int = 64 << 10
+
+// the scan states recorded in the meta information of an object
+const (
+	ScanPending  = "pending"
+	ScanClean    = "clean"
+	ScanInfected = "infected"
+)
+
+// ScanResult is the verdict of a scanner
+type ScanResult struct {
+	Infected  bool
+	Signature string
+}
+
+// Scanner inspects uploads before they become visible
+type Scanner interface {
+	Scan(r io.Reader) (*ScanResult, error)
+}
+
+// Clamd talks the clamd protocol over tcp or a unix socket
+type Clamd struct {
+	Network string
+	Address string
+}
+
+// NewClamd accepts addresses like tcp://127.0.0.1:3310 or unix:///var/run/clamav/clamd.ctl
+func NewClamd(address string) (*Clamd, error) {
+	cURL, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	switch cURL.Scheme {
+	case "tcp":
+		return &Clamd{Network: "tcp", Address: cURL.Host}, nil
+	case "unix":
+		return &Clamd{Network: "unix", Address: cURL.Path}, nil
+	}
+	return nil, errors.New("the given clamd address <" + address + "> is not supported!")
+}
+
+// Scan streams r with the INSTREAM command to clamd
+func (c *Clamd) Scan(r io.Reader) (*ScanResult, error) {
+	conn, err := net.DialTimeout(c.Network, c.Address, time.Duration(ScanSecondsTimeout)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Duration(ScanSecondsTimeout) * time.Second))
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, err
+	}
+	chunk := make([]byte, ScanChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(size); err != nil {
+				return nil, err
+			}
+			if _, err := conn.Write(chunk[:n]); err != nil {
+				return nil, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return nil, err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+func parseClamdReply(reply string) (*ScanResult, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return &ScanResult{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return &ScanResult{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	}
+	return nil, errors.New("clamd replied <" + reply + ">!")
+}
+
+// scanKey is the key of the scan state of an object in the meta bucket. Unlike the meta
+// information it is kept per bucket and full key, so an upload of the same name in
+// another bucket or with another extension never clears it. Uploads never end with
+// .json, the key can not collide with meta information
+func scanKey(bucket, file string) string {
+	return "scans/" + bucket + "/" + file
+}
+
+// PutScanState records the scan state of an object
+func PutScanState(s Storage, bucket, file string, meta map[string]string) error {
+	state := map[string]string{"scan": meta["scan"], "scan_signature": meta["scan_signature"], "scanned": meta["scanned"]}
+	sB, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	fh, err := NewFileHeader(scanKey(bucket, file), sB)
+	if err != nil {
+		return err
+	}
+	return s.PutObject("meta", fh)
+}
+
+// RemoveScanState forgets the scan state of an object, a later upload of the same key
+// must not inherit it
+func RemoveScanState(s Storage, bucket, file string) error {
+	_, err := s.RemoveObject("meta", scanKey(bucket, file))
+	if IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// ScanObject runs the scanner over an upload and records the verdict in the scan state and
+// the meta information of the object, the object stays pending if the scan fails
+func ScanObject(scanner Scanner, s Storage, bucket, file string, src io.Reader, meta map[string]string) (*ScanResult, error) {
+	result, err := scanner.Scan(src)
+	if err != nil {
+		return nil, err
+	}
+	meta["scan"] = ScanClean
+	meta["scan_signature"] = ""
+	if result.Infected {
+		meta["scan"] = ScanInfected
+		meta["scan_signature"] = result.Signature
+	}
+	meta["scanned"] = time.Now().UTC().Format(time.RFC3339)
+	if err := PutScanState(s, bucket, file, meta); err != nil {
+		return result, err
+	}
+	return result, PutMeta(s, file, meta)
+}
+
+// CheckScan blocks the download of objects that are quarantined, a scan state that
+// can not be read blocks them too
+func CheckScan(s Storage, bucket, file string) error {
+	state := map[string]string{}
+	obj, _, err := s.ReadObject("meta", scanKey(bucket, file))
+	if err == nil {
+		err = json.NewDecoder(obj).Decode(&state)
+		obj.Close()
+	} else if IsNotFound(err) {
+		// objects without a scan state were never scanned
+		return nil
+	}
+	if err != nil {
+		return errors.New("the scan state of <" + file + "> can not be read: " + err.Error())
+	}
+	switch state["scan"] {
+	case ScanPending:
+		return errors.New("the object <" + file + "> is quarantined until its scan finished!")
+	case ScanInfected:
+		return errors.New("the object <" + file + "> is infected with <" + state["scan_signature"] + ">!")
+	}
+	return nil
+}
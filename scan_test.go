@@ -0,0 +1,171 @@
+package files
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// clamdStub answers INSTREAM requests like clamd, everything containing EICAR is infected
+func clamdStub(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			cmd, _ := r.ReadString(0)
+			if cmd != "zINSTREAM\x00" {
+				conn.Write([]byte("UNKNOWN COMMAND\x00"))
+				conn.Close()
+				continue
+			}
+			data := bytes.NewBuffer(nil)
+			size := make([]byte, 4)
+			for {
+				if _, err := io.ReadFull(r, size); err != nil {
+					break
+				}
+				n := binary.BigEndian.Uint32(size)
+				if n == 0 {
+					break
+				}
+				io.CopyN(data, r, int64(n))
+			}
+			if strings.Contains(data.String(), "EICAR") {
+				conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			} else {
+				conn.Write([]byte("stream: OK\x00"))
+			}
+			conn.Close()
+		}
+	}()
+	return "tcp://" + l.Addr().String()
+}
+
+func Test_Unit_Clamd(t *testing.T) {
+	clamd, err := NewClamd(clamdStub(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := clamd.Scan(strings.NewReader("a harmless picture"))
+	if err != nil || result.Infected {
+		t.Error("expected a clean verdict", result, err)
+	}
+	result, err = clamd.Scan(strings.NewReader("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*"))
+	if err != nil || !result.Infected || result.Signature != "Eicar-Test-Signature" {
+		t.Error("expected an infected verdict", result, err)
+	}
+}
+
+func Test_Unit_ScanObject(t *testing.T) {
+	clamd, _ := NewClamd(clamdStub(t))
+	s := newMemStorage()
+	meta := map[string]string{"name": "virus.jpg", "scan": ScanPending}
+	if err := PutScanState(s, "docs", "virus.jpg", meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckScan(s, "docs", "virus.jpg"); err == nil {
+		t.Error("expected a pending object to be blocked")
+	}
+	_, err := ScanObject(clamd, s, "docs", "virus.jpg", strings.NewReader("EICAR"), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckScan(s, "docs", "virus.jpg"); err == nil || !strings.Contains(err.Error(), "Eicar-Test-Signature") {
+		t.Error("expected an infected object to be blocked", err)
+	}
+	// clean objects of the same name in another bucket or with another extension share the meta information
+	for _, target := range [][2]string{{"docs", "virus.png"}, {"other", "virus.jpg"}} {
+		if _, err := ScanObject(clamd, s, target[0], target[1], strings.NewReader("clean"), map[string]string{"name": target[1]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := CheckScan(s, "docs", "virus.jpg"); err == nil {
+		t.Error("a clean object of another bucket or extension must not release an infected one")
+	}
+	_, err = ScanObject(clamd, s, "docs", "virus.jpg", strings.NewReader("clean"), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckScan(s, "docs", "virus.jpg"); err != nil {
+		t.Error("expected a clean object to be served", err)
+	}
+}
+
+// brokenMetaStorage fails reading the meta bucket
+type brokenMetaStorage struct {
+	*memStorage
+}
+
+func (s brokenMetaStorage) ReadObject(bucket, file string) (io.ReadCloser, int64, error) {
+	if bucket == "meta" {
+		return nil, 0, errors.New("connection reset")
+	}
+	return s.memStorage.ReadObject(bucket, file)
+}
+
+func Test_Unit_CheckScanFailsClosed(t *testing.T) {
+	s := newMemStorage()
+	if err := CheckScan(s, "docs", "never.jpg"); err != nil {
+		t.Error("objects that were never scanned have to be served", err)
+	}
+	// the meta information is shared by the buckets, it must not decide about the scan state
+	PutMeta(s, "other.jpg", map[string]string{"name": "other.jpg", "scan": ScanInfected})
+	if err := CheckScan(s, "docs", "other.jpg"); err != nil {
+		t.Error("only the scan state of the bucket counts", err)
+	}
+	if err := CheckScan(brokenMetaStorage{s}, "docs", "never.jpg"); err == nil {
+		t.Error("a scan state that can not be read has to block the object")
+	}
+}
+
+func Test_Unit_ScanStateCleared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheDir := MinioFilesCacheDir
+	MinioFilesCacheDir = dir
+	defer func() { MinioFilesCacheDir = cacheDir }()
+	s := newMemStorage()
+	if err := PutScanState(s, "docs", "a.txt", map[string]string{"scan": ScanInfected}); err != nil {
+		t.Fatal(err)
+	}
+	// a clean upload of the same key without a scanner must not inherit the stale state
+	f := &Files{WSStorage: s, WSClient: "files"}
+	fh, _ := NewFileHeader("a.txt", []byte("clean"))
+	if status, err := f.Upload(context.Background(), "docs", fh, "", "", ""); err != nil {
+		t.Fatal(status, err)
+	}
+	if err := CheckScan(s, "docs", "a.txt"); err != nil {
+		t.Error("the re-upload has to clear the scan state", err)
+	}
+	if err := PutScanState(s, "docs", "b.txt", map[string]string{"scan": ScanPending}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveScanState(s, "docs", "b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckScan(s, "docs", "b.txt"); err != nil {
+		t.Error("the removed scan state must not block the key", err)
+	}
+	if err := RemoveScanState(s, "docs", "never.txt"); err != nil {
+		t.Error("removing a missing scan state is no error", err)
+	}
+}
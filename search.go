@@ -0,0 +1,511 @@
+package files
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"evalgo.org/evmsg"
+	"github.com/minio/minio-go/v6"
+	"github.com/neko-neko/echo-logrus/v2/log"
+)
+
+var SearchIndexFile string = "/tmp/files/search/index.json"
+var SearchDefaultLimit int = 50
+
+// SearchSaveDelay batches the writes of the index, the changes of this time are written at once
+var SearchSaveDelay time.Duration = 5 * time.Second
+
+// searchReserved are the fields of a hit the meta information can not replace
+var searchReserved = map[string]bool{"bucket": true, "key": true, "size": true, "modified": true, "score": true, "text": true}
+
+// SearchDoc is an indexed object of a bucket
+type SearchDoc struct {
+	Bucket   string    `json:"bucket"`
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// Index keeps an inverted index of every object, it wraps a storage and
+// updates itself whenever objects or their meta information are written
+type Index struct {
+	Storage Storage                      `json:"-"`
+	File    string                       `json:"-"`
+	Docs    map[string]*SearchDoc        `json:"docs"`
+	Metas   map[string]map[string]string `json:"metas"`
+	terms   map[string]map[string]int
+	lock    sync.RWMutex
+	// dirty and timer are guarded by lock, saveMu orders the writes of the file
+	dirty  bool
+	timer  *time.Timer
+	saveMu sync.Mutex
+}
+
+// SearchQuery selects, sorts and pages search results
+type SearchQuery struct {
+	Query   string
+	Bucket  string
+	Prefix  string
+	Tags    []string
+	Filters map[string]string
+	Sort    string
+	Order   string
+	Offset  int
+	Limit   int
+}
+
+func NewIndex(s Storage, file string) *Index {
+	return &Index{Storage: s, File: file, Docs: map[string]*SearchDoc{}, Metas: map[string]map[string]string{}, terms: map[string]map[string]int{}}
+}
+
+// Load reads the persisted index, a missing file is an empty index
+func (i *Index) Load() error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	iB, err := ioutil.ReadFile(i.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(iB, i)
+	if err != nil {
+		return err
+	}
+	i.terms = map[string]map[string]int{}
+	for id := range i.Docs {
+		i.index(id)
+	}
+	return nil
+}
+
+// changed schedules a write of the index, the caller holds the lock
+func (i *Index) changed() {
+	i.dirty = true
+	if i.timer == nil && i.File != "" {
+		i.timer = time.AfterFunc(SearchSaveDelay, func() {
+			if err := i.Flush(); err != nil {
+				log.Logger().Error(err)
+			}
+		})
+	}
+}
+
+// Flush writes the index if it changed since the last write
+func (i *Index) Flush() error {
+	i.saveMu.Lock()
+	defer i.saveMu.Unlock()
+	i.lock.Lock()
+	if i.timer != nil {
+		i.timer.Stop()
+		i.timer = nil
+	}
+	if !i.dirty || i.File == "" {
+		i.lock.Unlock()
+		return nil
+	}
+	i.dirty = false
+	iB, err := json.Marshal(i)
+	i.lock.Unlock()
+	if err == nil {
+		err = i.write(iB)
+	}
+	if err != nil {
+		// try again with the next change
+		i.lock.Lock()
+		i.dirty = true
+		i.lock.Unlock()
+	}
+	return err
+}
+
+func (i *Index) write(iB []byte) error {
+	err := os.MkdirAll(filepath.Dir(i.File), 0700)
+	if err != nil {
+		return err
+	}
+	tmp := i.File + ".tmp"
+	err = ioutil.WriteFile(tmp, iB, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, i.File)
+}
+
+func searchTokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// index adds the terms of a document, the weights favour the key and the description
+func (i *Index) index(id string) {
+	doc := i.Docs[id]
+	weights := map[string]int{}
+	add := func(text string, weight int) {
+		for _, token := range searchTokens(text) {
+			weights[token] += weight
+		}
+	}
+	add(doc.Key, 5)
+	for field, value := range i.Metas[doc.Key] {
+		switch {
+		case field == "description":
+			add(value, 3)
+		case field == "tags":
+			add(value, 4)
+		case field == "text":
+			add(value, 1)
+		case strings.HasPrefix(field, "exif_"):
+			add(value, 2)
+		}
+	}
+	for token, weight := range weights {
+		if _, ok := i.terms[token]; !ok {
+			i.terms[token] = map[string]int{}
+		}
+		i.terms[token][id] = weight
+	}
+}
+
+func (i *Index) unindex(id string) {
+	for token, ids := range i.terms {
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(i.terms, token)
+		}
+	}
+}
+
+func (i *Index) reindexKey(key string) {
+	for id, doc := range i.Docs {
+		if doc.Key == key {
+			i.unindex(id)
+			i.index(id)
+		}
+	}
+}
+
+// Close writes the index a last time and closes the wrapped storage
+func (i *Index) Close() error {
+	i.lock.Lock()
+	i.dirty = true
+	i.lock.Unlock()
+	err := i.Flush()
+	if cErr := CloseStorage(i.Storage); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// Put adds or replaces an object
+func (i *Index) Put(bucket, key string, size int64, modified time.Time) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	id := bucket + "/" + key
+	i.unindex(id)
+	i.Docs[id] = &SearchDoc{Bucket: bucket, Key: key, Size: size, Modified: modified}
+	i.index(id)
+	i.changed()
+	return nil
+}
+
+// PutMeta replaces the meta information of every object with the given key
+func (i *Index) PutMeta(key string, meta map[string]string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.Metas[key] = meta
+	i.reindexKey(key)
+	i.changed()
+	return nil
+}
+
+// Remove drops an object
+func (i *Index) Remove(bucket, key string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	id := bucket + "/" + key
+	i.unindex(id)
+	delete(i.Docs, id)
+	used := false
+	for _, doc := range i.Docs {
+		if doc.Key == key {
+			used = true
+		}
+	}
+	if !used {
+		delete(i.Metas, key)
+	}
+	i.changed()
+	return nil
+}
+
+// Search runs a query against the index
+func (i *Index) Search(q SearchQuery) (*evmsg.Message, error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	msg := evmsg.NewMessage()
+	msg.State = "Response"
+	scores := map[string]int{}
+	tokens := searchTokens(q.Query)
+	if len(tokens) == 0 {
+		for id := range i.Docs {
+			scores[id] = 0
+		}
+	}
+	for n, token := range tokens {
+		matches := map[string]int{}
+		// every token is a prefix match, all tokens have to match
+		for term, ids := range i.terms {
+			if !strings.HasPrefix(term, token) {
+				continue
+			}
+			for id, weight := range ids {
+				if n == 0 {
+					matches[id] += weight
+				} else if _, ok := scores[id]; ok {
+					matches[id] = scores[id] + weight
+				}
+			}
+		}
+		scores = matches
+	}
+	hits := []map[string]interface{}{}
+	for id, score := range scores {
+		doc := i.Docs[id]
+		meta := i.Metas[doc.Key]
+		if !q.matches(doc, meta) {
+			continue
+		}
+		hit := map[string]interface{}{
+			"bucket":   doc.Bucket,
+			"key":      doc.Key,
+			"size":     doc.Size,
+			"modified": doc.Modified,
+			"score":    score,
+		}
+		for field, value := range meta {
+			// user meta can not replace the fields the hits are sorted by
+			if !searchReserved[field] {
+				hit[field] = value
+			}
+		}
+		hits = append(hits, hit)
+	}
+	sortHits(hits, q.Sort, q.Order)
+	total := len(hits)
+	limit := q.Limit
+	if limit <= 0 {
+		limit = SearchDefaultLimit
+	}
+	start := q.Offset
+	if start < 0 {
+		start = 0
+	}
+	if start > total {
+		start = total
+	}
+	end := start + limit
+	if end > total {
+		end = total
+	}
+	page := []interface{}{}
+	for _, hit := range hits[start:end] {
+		page = append(page, hit)
+	}
+	msg.Data = []interface{}{
+		map[string]interface{}{
+			"total":  total,
+			"offset": start,
+			"limit":  limit,
+			"hits":   page,
+		},
+	}
+	return msg, nil
+}
+
+func (q SearchQuery) matches(doc *SearchDoc, meta map[string]string) bool {
+	if q.Bucket != "" && doc.Bucket != q.Bucket {
+		return false
+	}
+	if q.Prefix != "" && !strings.HasPrefix(doc.Key, q.Prefix) {
+		return false
+	}
+	tags := map[string]bool{}
+	for _, tag := range strings.Split(meta["tags"], ",") {
+		tags[strings.ToLower(strings.TrimSpace(tag))] = true
+	}
+	for _, tag := range q.Tags {
+		if !tags[strings.ToLower(tag)] {
+			return false
+		}
+	}
+	for field, value := range q.Filters {
+		if !strings.EqualFold(meta[field], value) {
+			return false
+		}
+	}
+	return true
+}
+
+func sortHits(hits []map[string]interface{}, field, order string) {
+	if field == "" {
+		field = "score"
+	}
+	desc := order == "desc" || (order == "" && field == "score")
+	sort.SliceStable(hits, func(a, b int) bool {
+		if desc {
+			a, b = b, a
+		}
+		switch field {
+		case "size":
+			return hits[a]["size"].(int64) < hits[b]["size"].(int64)
+		case "modified":
+			return hits[a]["modified"].(time.Time).Before(hits[b]["modified"].(time.Time))
+		case "score":
+			if hits[a]["score"].(int) != hits[b]["score"].(int) {
+				return hits[a]["score"].(int) < hits[b]["score"].(int)
+			}
+		}
+		return hits[a]["bucket"].(string)+"/"+hits[a]["key"].(string) < hits[b]["bucket"].(string)+"/"+hits[b]["key"].(string)
+	})
+}
+
+// Rebuild indexes every object of every bucket from scratch
+func (i *Index) Rebuild() (*evmsg.Message, error) {
+	bMsg, err := i.Storage.ListBuckets()
+	if err != nil {
+		return bMsg, err
+	}
+	docs := map[string]*SearchDoc{}
+	metas := map[string]map[string]string{}
+	buckets, _ := bMsg.Data.([]interface{})
+	for _, bucket := range buckets {
+		name := bucket.(map[string]interface{})["name"].(string)
+		if IsInternalBucket(name) {
+			continue
+		}
+		oMsg, err := i.Storage.ListObjects(minio.BucketInfo{Name: name}, "")
+		if err != nil {
+			return oMsg, err
+		}
+		objects, _ := oMsg.Data.([]interface{})
+		for _, obj := range objects {
+			mObj := obj.(map[string]interface{})
+			doc := &SearchDoc{Bucket: name, Key: mObj["key"].(string)}
+			doc.Size, _ = mObj["size"].(int64)
+			doc.Modified, _ = mObj["modified"].(time.Time)
+			docs[name+"/"+doc.Key] = doc
+			if _, ok := metas[doc.Key]; !ok {
+				if meta, err := GetMeta(i.Storage, doc.Key); err == nil {
+					metas[doc.Key] = meta
+				}
+			}
+		}
+	}
+	i.lock.Lock()
+	i.Docs = docs
+	i.Metas = metas
+	i.terms = map[string]map[string]int{}
+	for id := range i.Docs {
+		i.index(id)
+	}
+	i.dirty = true
+	i.lock.Unlock()
+	msg := evmsg.NewMessage()
+	msg.State = "Response"
+	msg.Data = []interface{}{map[string]interface{}{"objects": len(docs)}}
+	if err := i.Flush(); err != nil {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	return msg, nil
+}
+
+func (i *Index) CreateBucket(bucket string) (*evmsg.Message, error) {
+	return i.Storage.CreateBucket(bucket)
+}
+
+func (i *Index) ListBuckets() (*evmsg.Message, error) {
+	return i.Storage.ListBuckets()
+}
+
+func (i *Index) ListObjects(bucket minio.BucketInfo, prefix string) (*evmsg.Message, error) {
+	return i.Storage.ListObjects(bucket, prefix)
+}
+
+func (i *Index) GetObject(bucket, file string) (*evmsg.Message, error) {
+	return i.Storage.GetObject(bucket, file)
+}
+
+func (i *Index) GetThumbnail(bucket, file string) ([]byte, error) {
+	return i.Storage.GetThumbnail(bucket, file)
+}
+
+func (i *Index) ReadObject(bucket, file string) (io.ReadCloser, int64, error) {
+	return i.Storage.ReadObject(bucket, file)
+}
+
+func (i *Index) ReadCache(cached string) (io.ReadCloser, error) {
+	return i.Storage.ReadCache(cached)
+}
+
+func (i *Index) WriteCache(cached string, r io.Reader) error {
+	return i.Storage.WriteCache(cached, r)
+}
+
+func (i *Index) PutObject(bucket string, file *multipart.FileHeader) error {
+	err := i.Storage.PutObject(bucket, file)
+	if err != nil {
+		return err
+	}
+	if bucket != "meta" {
+		if IsInternalBucket(bucket) {
+			return nil
+		}
+		return i.Put(bucket, file.Filename, file.Size, time.Now())
+	}
+	// meta information is written through PutMeta, keep the index in sync with it
+	src, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	meta := map[string]string{}
+	if err := json.NewDecoder(src).Decode(&meta); err != nil {
+		return nil
+	}
+	name := meta["name"]
+	if name == "" {
+		return nil
+	}
+	return i.PutMeta(name, meta)
+}
+
+func (i *Index) RemoveObject(bucket, file string) (*evmsg.Message, error) {
+	msg, err := i.Storage.RemoveObject(bucket, file)
+	if err != nil {
+		return msg, err
+	}
+	if err := i.Remove(bucket, file); err != nil {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	return msg, nil
+}
+
+// SearchIndex returns the index of a storage if the search is enabled
+func SearchIndex(s Storage) (*Index, bool) {
+	i, ok := s.(*Index)
+	return i, ok
+}
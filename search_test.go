@@ -0,0 +1,135 @@
+package files
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testIndex(t *testing.T) *Index {
+	dir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := NewIndex(newMemStorage(), filepath.Join(dir, "index.json"))
+	for _, obj := range [][4]string{
+		{"test", "beach/sunset.jpg", "sunset at the beach", "holiday,sea"},
+		{"test", "beach/dunes.jpg", "dunes in the evening", "holiday"},
+		{"work", "office.png", "the new office", "work"},
+	} {
+		fh, err := NewFileHeader(obj[1], []byte(obj[2]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := i.PutObject(obj[0], fh); err != nil {
+			t.Fatal(err)
+		}
+		if err := PutMeta(i, obj[1], map[string]string{"name": obj[1], "description": obj[2], "tags": obj[3], "exif_model": "EOS 5D"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return i
+}
+
+func searchKeys(t *testing.T, i *Index, q SearchQuery) ([]string, int) {
+	msg, err := i.Search(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := msg.Data.([]interface{})[0].(map[string]interface{})
+	keys := []string{}
+	for _, hit := range result["hits"].([]interface{}) {
+		keys = append(keys, hit.(map[string]interface{})["key"].(string))
+	}
+	return keys, result["total"].(int)
+}
+
+func Test_Unit_IndexSearch(t *testing.T) {
+	i := testIndex(t)
+	keys, _ := searchKeys(t, i, SearchQuery{Query: "sun beach"})
+	if len(keys) != 1 || keys[0] != "beach/sunset.jpg" {
+		t.Error("unexpected hits for sun beach", keys)
+	}
+	keys, _ = searchKeys(t, i, SearchQuery{Query: "eos", Tags: []string{"holiday"}, Sort: "key"})
+	if len(keys) != 2 || keys[0] != "beach/dunes.jpg" {
+		t.Error("unexpected hits for the holiday tag", keys)
+	}
+	keys, total := searchKeys(t, i, SearchQuery{Sort: "key", Order: "desc", Offset: 1, Limit: 1})
+	if total != 3 || len(keys) != 1 || keys[0] != "beach/sunset.jpg" {
+		t.Error("unexpected page", keys, total)
+	}
+	keys, _ = searchKeys(t, i, SearchQuery{Bucket: "work", Filters: map[string]string{"exif_model": "eos 5d"}})
+	if len(keys) != 1 || keys[0] != "office.png" {
+		t.Error("unexpected hits for the work bucket", keys)
+	}
+}
+
+func Test_Unit_IndexUpdate(t *testing.T) {
+	i := testIndex(t)
+	if _, err := UpdateMeta(i, "office.png", map[string]string{"description": "meeting room"}); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := searchKeys(t, i, SearchQuery{Query: "meeting"}); len(keys) != 1 {
+		t.Error("expected the meta edit to be indexed", keys)
+	}
+	if _, err := i.RemoveObject("test", "beach/dunes.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewIndex(i.Storage, i.File)
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := searchKeys(t, loaded, SearchQuery{Query: "holiday"}); len(keys) != 1 || keys[0] != "beach/sunset.jpg" {
+		t.Error("expected the persisted index without the removed object", keys)
+	}
+}
+
+func Test_Unit_IndexPaging(t *testing.T) {
+	i := testIndex(t)
+	if keys, total := searchKeys(t, i, SearchQuery{Offset: -1}); total != 3 || len(keys) != 3 {
+		t.Error("a negative offset has to start at the first hit", keys)
+	}
+	// meta information can not replace the fields of the hits
+	PutMeta(i, "office.png", map[string]string{"name": "office.png", "size": "huge", "modified": "yesterday", "bucket": "test"})
+	msg, err := i.Search(SearchQuery{Sort: "size"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hit := range msg.Data.([]interface{})[0].(map[string]interface{})["hits"].([]interface{}) {
+		if h := hit.(map[string]interface{}); h["key"] == "office.png" && h["bucket"] != "work" {
+			t.Error("the reserved fields have to be kept", h)
+		}
+	}
+	searchKeys(t, i, SearchQuery{Sort: "modified"})
+}
+
+func Test_Unit_IndexBatchedWrites(t *testing.T) {
+	delay := SearchSaveDelay
+	SearchSaveDelay = time.Hour
+	defer func() { SearchSaveDelay = delay }()
+	i := testIndex(t)
+	defer os.RemoveAll(filepath.Dir(i.File))
+	if _, err := os.Stat(i.File); !os.IsNotExist(err) {
+		t.Error("the changes have to be batched", err)
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewIndex(i.Storage, i.File)
+	if err := loaded.Load(); err != nil || len(loaded.Docs) != 3 {
+		t.Error("closing the index has to write the changes", len(loaded.Docs), err)
+	}
+	SearchSaveDelay = 10 * time.Millisecond
+	fh, _ := NewFileHeader("late.jpg", []byte("late"))
+	loaded.PutObject("test", fh)
+	time.Sleep(200 * time.Millisecond)
+	again := NewIndex(i.Storage, i.File)
+	if err := again.Load(); err != nil || len(again.Docs) != 4 {
+		t.Error("the changes have to be written after the delay", len(again.Docs), err)
+	}
+}
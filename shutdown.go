@@ -0,0 +1,65 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/neko-neko/echo-logrus/v2/log"
+)
+
+// ShutdownTimeout bounds the time the requests in flight get to finish on shutdown
+var ShutdownTimeout time.Duration = 30 * time.Second
+
+// Shutdown stops accepting connections and lets the requests and the websockets drain,
+// then the storage flushes its state and closes, the scanner last
+func (f *Files) Shutdown(servers ...*http.Server) error {
+	log.Logger().Info("shutting down the files service")
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	var (
+		mu   sync.Mutex
+		errs []string
+		wg   sync.WaitGroup
+	)
+	record := func(err error) {
+		if err == nil {
+			return
+		}
+		log.Logger().Error(err)
+		mu.Lock()
+		errs = append(errs, err.Error())
+		mu.Unlock()
+	}
+	// the websockets are hijacked, the servers do not wait for them
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		record(f.CloseWebsockets(ctx))
+	}()
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			record(server.Shutdown(ctx))
+		}(server)
+	}
+	wg.Wait()
+	if f.WSStorage != nil {
+		record(CloseStorage(f.WSStorage))
+	}
+	if closer, ok := f.WSScanner.(io.Closer); ok {
+		record(closer.Close())
+	}
+	record(f.WSAudit.Close())
+	record(StopTracing(ctx))
+	if len(errs) > 0 {
+		return errors.New("the shutdown failed: " + strings.Join(errs, "; "))
+	}
+	log.Logger().Info("the files service is shut down")
+	return nil
+}
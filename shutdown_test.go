@@ -0,0 +1,61 @@
+package files
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_Unit_Shutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shutdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	index := NewIndex(newMemStorage(), filepath.Join(dir, "index.json"))
+	f := &Files{WSStorage: index}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- f.Start(ctx, "127.0.0.1:0", "files", "secret", dir)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the service has to stop with its context")
+	}
+	if _, err := os.Stat(index.File); err != nil {
+		t.Error("the index has to be written on shutdown", err)
+	}
+}
+
+func Test_Unit_MinioClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheDir := MinioFilesCacheDir
+	MinioFilesCacheDir = dir
+	defer func() { MinioFilesCacheDir = cacheDir }()
+	os.MkdirAll(filepath.Join(dir, "renditions"), 0700)
+	ioutil.WriteFile(filepath.Join(dir, "renditions", ".download123"), []byte("partial"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "photo.jpg"), []byte("cached"), 0600)
+	if err := NewMinio().Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "renditions", ".download123")); !os.IsNotExist(err) {
+		t.Error("partial downloads have to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "photo.jpg")); err != nil {
+		t.Error("the cache has to be kept", err)
+	}
+}
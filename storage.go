@@ -1,9 +1,12 @@
 package files
 
 import (
+	"errors"
 	"evalgo.org/evmsg"
 	"github.com/minio/minio-go/v6"
+	"io"
 	"mime/multipart"
+	"os"
 )
 
 type Storage interface {
@@ -12,6 +15,54 @@ type Storage interface {
 	ListObjects(bucket minio.BucketInfo, prefix string) (*evmsg.Message, error)
 	GetObject(bucket, file string) (*evmsg.Message, error)
 	GetThumbnail(bucket, file string) ([]byte, error)
+	ReadObject(bucket, file string) (io.ReadCloser, int64, error)
+	ReadCache(cached string) (io.ReadCloser, error)
+	WriteCache(cached string, r io.Reader) error
 	PutObject(bucket string, file *multipart.FileHeader) error
 	RemoveObject(bucket string, file string) (*evmsg.Message, error)
 }
+
+// IsInternalBucket reports the buckets the service keeps its own state in
+func IsInternalBucket(bucket string) bool {
+	return bucket == "meta" || bucket == DedupBucket || bucket == EncryptionKeysBucket || bucket == PolicyBucket
+}
+
+// CheckBucket rejects the internal buckets, their objects are not for the clients
+func CheckBucket(bucket string) error {
+	if IsInternalBucket(bucket) {
+		return errors.New("the bucket <" + bucket + "> is internal!")
+	}
+	return nil
+}
+
+// HasBucket reports if a bucket exists, the interface only knows the list of buckets
+func HasBucket(s Storage, bucket string) (bool, error) {
+	msg, err := s.ListBuckets()
+	if err != nil {
+		return false, err
+	}
+	list, _ := msg.Data.([]interface{})
+	for _, b := range list {
+		if b.(map[string]interface{})["name"] == bucket {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CloseStorage flushes and closes a storage, storages without state to flush need no Close
+func CloseStorage(s Storage) error {
+	if closer, ok := s.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// IsNotFound reports if a storage error means that the object does not exist, every
+// other error may be transient and must not be taken for a missing object
+func IsNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	return os.IsNotExist(err) || minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
@@ -0,0 +1,178 @@
+package files
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/neko-neko/echo-logrus/v2/log"
+)
+
+var (
+	// TLSCertFile and TLSKeyFile enable TLS, the files are reloaded when they change
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile enables the authentication with client certificates signed by these CAs
+	TLSClientCAFile string
+	// TLSSubjects maps the subjects of client certificates to identities
+	TLSSubjects = map[string]string{}
+	// TLSRedirectAddress serves redirects from plain HTTP to the TLS address
+	TLSRedirectAddress string
+)
+
+// certReloader serves the certificate of the files and loads them again once they change
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time
+	checked  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	modified, err := r.lastModified()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	r.cert, r.modified, r.checked = &cert, modified, time.Now()
+	return r, nil
+}
+
+func (r *certReloader) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return last, err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
+
+// GetCertificate looks for changed files at most once a second, a broken
+// pair is logged and the certificate loaded before is kept
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) < time.Second {
+		return r.cert, nil
+	}
+	r.checked = time.Now()
+	modified, err := r.lastModified()
+	if err != nil || !modified.After(r.modified) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		log.Logger().Error(err)
+		return r.cert, nil
+	}
+	log.Logger().Info("reloaded the certificate " + r.certFile)
+	r.cert, r.modified = &cert, modified
+	return r.cert, nil
+}
+
+// TLSConfig returns the TLS configuration of the service with modern defaults
+func TLSConfig() (*tls.Config, error) {
+	reloader, err := newCertReloader(TLSCertFile, TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: true,
+		CurvePreferences:         []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		},
+		GetCertificate: reloader.GetCertificate,
+		// the websockets hijack their connections, HTTP/2 can not hand them over
+		NextProtos: []string{"http/1.1"},
+	}
+	if TLSClientCAFile != "" {
+		caB, err := ioutil.ReadFile(TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caB) {
+			return nil, errors.New("the file <" + TLSClientCAFile + "> has no PEM certificates!")
+		}
+		config.ClientCAs = pool
+		// clients without a certificate still authenticate with basic auth
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// LoadTLSSubjects reads a JSON file of certificate subjects and their identities
+func LoadTLSSubjects(path string) (map[string]string, error) {
+	subjects := map[string]string{}
+	sB, err := ioutil.ReadFile(path)
+	if err != nil {
+		return subjects, err
+	}
+	err = json.Unmarshal(sB, &subjects)
+	return subjects, err
+}
+
+// tlsIdentity returns the identity of a verified client certificate, the subject is looked up
+// as a whole and by its common name, without subjects the common name has to be an identity
+func (f *Files) tlsIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if identity, ok := TLSSubjects[subject.String()]; ok {
+		return identity
+	}
+	if identity, ok := TLSSubjects[subject.CommonName]; ok {
+		return identity
+	}
+	if len(TLSSubjects) == 0 {
+		if _, known := f.secretOf(subject.CommonName); known {
+			return subject.CommonName
+		}
+	}
+	return ""
+}
+
+// RedirectHandler sends plain HTTP requests to the TLS address of the service
+func RedirectHandler(tlsAddress string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddress)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
@@ -0,0 +1,158 @@
+package files
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert issues a certificate, a nil parent makes it a self signed CA
+func testCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"files"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func Test_Unit_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey, caPEM, _ := testCert(t, "files ca", nil, nil)
+	_, _, serverPEM, serverKeyPEM := testCert(t, "127.0.0.1", ca, caKey)
+	_, _, clientPEM, clientKeyPEM := testCert(t, "alice", ca, caKey)
+	for name, data := range map[string][]byte{"ca.pem": caPEM, "server.pem": serverPEM, "server.key": serverKeyPEM} {
+		ioutil.WriteFile(filepath.Join(dir, name), data, 0600)
+	}
+	certFile, keyFile, caFile, subjects, identities := TLSCertFile, TLSKeyFile, TLSClientCAFile, TLSSubjects, Identities
+	TLSCertFile, TLSKeyFile, TLSClientCAFile = filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.pem")
+	TLSSubjects, Identities = map[string]string{}, map[string]string{"alice": "wonderland"}
+	defer func() {
+		TLSCertFile, TLSKeyFile, TLSClientCAFile, TLSSubjects, Identities = certFile, keyFile, caFile, subjects, identities
+	}()
+	config, err := TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS12 {
+		t.Error("old protocol versions have to be disabled")
+	}
+	f := &Files{WSClient: "files", WSSecret: "secret"}
+	// httptest adds its own certificate, it would win over GetCertificate without SNI
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(f.Identity(r)))
+	})}
+	go server.Serve(ln)
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+	identityOf := func(certs ...tls.Certificate) string {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: certs}}}
+		resp, err := client.Get("https://" + ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+	clientCert, err := tls.X509KeyPair(clientPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity := identityOf(clientCert); identity != "alice" {
+		t.Error("the common name of a known identity has to authenticate", identity)
+	}
+	if identity := identityOf(); identity != "" {
+		t.Error("clients without a certificate are anonymous", identity)
+	}
+	TLSSubjects = map[string]string{"CN=alice,O=files": "bob"}
+	if identity := identityOf(clientCert); identity != "bob" {
+		t.Error("the subjects have to map to identities", identity)
+	}
+}
+
+func Test_Unit_CertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	_, _, certPEM, keyPEM := testCert(t, "first", nil, nil)
+	ioutil.WriteFile(certFile, certPEM, 0600)
+	ioutil.WriteFile(keyFile, keyPEM, 0600)
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, certPEM, keyPEM = testCert(t, "second", nil, nil)
+	ioutil.WriteFile(certFile, certPEM, 0600)
+	ioutil.WriteFile(keyFile, keyPEM, 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	r.checked = time.Time{}
+	cert, _ := r.GetCertificate(nil)
+	if leaf, _ := x509.ParseCertificate(cert.Certificate[0]); leaf.Subject.CommonName != "second" {
+		t.Error("changed files have to be loaded", leaf.Subject.CommonName)
+	}
+	ioutil.WriteFile(keyFile, []byte("broken"), 0600)
+	os.Chtimes(keyFile, later.Add(time.Minute), later.Add(time.Minute))
+	r.checked = time.Time{}
+	if cert, _ := r.GetCertificate(nil); cert == nil {
+		t.Error("a broken pair has to keep the loaded certificate")
+	}
+}
+
+func Test_Unit_TLSRedirect(t *testing.T) {
+	w := httptest.NewRecorder()
+	RedirectHandler("0.0.0.0:8443").ServeHTTP(w, httptest.NewRequest("GET", "http://files.example.com/v1/buckets?prefix=a", nil))
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "https://files.example.com:8443/v1/buckets?prefix=a" {
+		t.Error("unexpected redirect", w.Code, w.Header())
+	}
+	w = httptest.NewRecorder()
+	RedirectHandler(":443").ServeHTTP(w, httptest.NewRequest("PUT", "http://files.example.com:80/x", nil))
+	if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != "https://files.example.com/x" {
+		t.Error("unexpected redirect", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,503 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"evalgo.org/evmsg"
+	echo "github.com/labstack/echo/v4"
+	"github.com/minio/minio-go/v6"
+	"github.com/neko-neko/echo-logrus/v2/log"
+)
+
+var (
+	// TraceOTLPEndpoint exports the spans with OTLP over HTTP, e.g. http://collector:4318
+	TraceOTLPEndpoint string
+	// TraceFile appends the spans as OTLP JSON lines to a local file
+	TraceFile string
+	// TraceServiceName is the service.name of the exported spans
+	TraceServiceName string = "files"
+)
+
+// the kinds of the spans as OTLP numbers them
+const (
+	SpanInternal = 1
+	SpanServer   = 2
+	SpanClient   = 3
+)
+
+// Span is a timed stage of a request, spans of one request share the trace id
+type Span struct {
+	TraceID  [16]byte
+	SpanID   [8]byte
+	ParentID [8]byte
+	Name     string
+	Kind     int
+	Start    time.Time
+	End      time.Time
+	Err      string
+	mu       sync.Mutex
+	attrs    map[string]interface{}
+	t        *tracer
+}
+
+// SetAttribute describes the span, values are strings, bools and numbers
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// Finish ends the span and hands it to the exporter, a failed stage records the error
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	if err != nil {
+		s.Err = err.Error()
+	}
+	s.t.queue(s)
+}
+
+// Traceparent formats the span as W3C trace context for the next hop
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.TraceID[:]) + "-" + hex.EncodeToString(s.SpanID[:]) + "-01"
+}
+
+type spanKey struct{}
+
+// remoteParent is a span of the caller taken from a traceparent
+type remoteParent struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+// ParseTraceparent reads a W3C traceparent like 00-<trace id>-<span id>-<flags>
+func ParseTraceparent(header string) (traceID [16]byte, spanID [8]byte, err error) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, spanID, errors.New("the traceparent <" + header + "> is not valid!")
+	}
+	if _, err = hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, spanID, err
+	}
+	if _, err = hex.Decode(spanID[:], []byte(parts[2])); err != nil {
+		return traceID, spanID, err
+	}
+	if traceID == ([16]byte{}) || spanID == ([8]byte{}) {
+		return traceID, spanID, errors.New("the traceparent <" + header + "> is not valid!")
+	}
+	return traceID, spanID, nil
+}
+
+// ContextWithTraceparent continues the trace of a caller, broken or missing headers start a new trace
+func ContextWithTraceparent(ctx context.Context, header string) context.Context {
+	if header == "" {
+		return ctx
+	}
+	traceID, spanID, err := ParseTraceparent(header)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, &remoteParent{traceID: traceID, spanID: spanID})
+}
+
+// SpanFromContext returns the span a context belongs to or nil
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// StartSpan starts a child of the span or the traceparent of the context, without
+// tracing it returns a nil span whose methods do nothing
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	t := currentTracer()
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{Name: name, Kind: kind, Start: time.Now(), attrs: map[string]interface{}{}, t: t}
+	switch parent := ctx.Value(spanKey{}).(type) {
+	case *Span:
+		s.TraceID, s.ParentID = parent.TraceID, parent.SpanID
+	case *remoteParent:
+		s.TraceID, s.ParentID = parent.traceID, parent.spanID
+	default:
+		rand.Read(s.TraceID[:])
+	}
+	rand.Read(s.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// spanExporter sends batches of finished spans
+type spanExporter interface {
+	Export(spans []*Span) error
+	Close() error
+}
+
+// tracer batches the finished spans for its exporter, spans are dropped while the queue is full
+type tracer struct {
+	exporter spanExporter
+	spans    chan *Span
+	done     chan struct{}
+	mu       sync.RWMutex
+	closed   bool
+}
+
+var (
+	tracerMu     sync.RWMutex
+	activeTracer *tracer
+)
+
+func currentTracer() *tracer {
+	tracerMu.RLock()
+	defer tracerMu.RUnlock()
+	return activeTracer
+}
+
+func (t *tracer) queue(s *Span) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+	}
+}
+
+func (t *tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	batch := []*Span{}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil {
+			log.Logger().Error(err)
+		}
+		batch = []*Span{}
+	}
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= 256 {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// StartTracing exports the spans to the configured OTLP endpoint or file, without one spans are not recorded
+func StartTracing() error {
+	var exporter spanExporter
+	switch {
+	case TraceOTLPEndpoint != "":
+		exporter = &otlpExporter{endpoint: strings.TrimSuffix(TraceOTLPEndpoint, "/") + "/v1/traces", client: &http.Client{Timeout: 10 * time.Second}}
+	case TraceFile != "":
+		fd, err := os.OpenFile(TraceFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		exporter = &fileExporter{w: fd}
+	default:
+		return nil
+	}
+	startTracer(exporter)
+	return nil
+}
+
+func startTracer(exporter spanExporter) {
+	t := &tracer{exporter: exporter, spans: make(chan *Span, 4096), done: make(chan struct{})}
+	go t.run()
+	tracerMu.Lock()
+	activeTracer = t
+	tracerMu.Unlock()
+}
+
+// StopTracing exports the spans still queued and closes the exporter
+func StopTracing(ctx context.Context) error {
+	tracerMu.Lock()
+	t := activeTracer
+	activeTracer = nil
+	tracerMu.Unlock()
+	if t == nil {
+		return nil
+	}
+	// spans started before still finish, they are dropped from now on
+	t.mu.Lock()
+	t.closed = true
+	close(t.spans)
+	t.mu.Unlock()
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return t.exporter.Close()
+}
+
+// otlpRequest renders spans as an ExportTraceServiceRequest in the JSON encoding of OTLP
+func otlpRequest(spans []*Span) map[string]interface{} {
+	list := make([]interface{}, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		attrs := otlpAttributes(s.attrs)
+		s.mu.Unlock()
+		span := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.TraceID[:]),
+			"spanId":            hex.EncodeToString(s.SpanID[:]),
+			"name":              s.Name,
+			"kind":              s.Kind,
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        attrs,
+			"status":            map[string]interface{}{"code": 1},
+		}
+		if s.ParentID != ([8]byte{}) {
+			span["parentSpanId"] = hex.EncodeToString(s.ParentID[:])
+		}
+		if s.Err != "" {
+			span["status"] = map[string]interface{}{"code": 2, "message": s.Err}
+		}
+		list = append(list, span)
+	}
+	return map[string]interface{}{"resourceSpans": []interface{}{map[string]interface{}{
+		"resource":   map[string]interface{}{"attributes": otlpAttributes(map[string]interface{}{"service.name": TraceServiceName})},
+		"scopeSpans": []interface{}{map[string]interface{}{"scope": map[string]interface{}{"name": "files"}, "spans": list}},
+	}}}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []interface{} {
+	list := make([]interface{}, 0, len(attrs))
+	for key, value := range attrs {
+		var v map[string]interface{}
+		switch value := value.(type) {
+		case bool:
+			v = map[string]interface{}{"boolValue": value}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": value}
+		case string:
+			v = map[string]interface{}{"stringValue": value}
+		default:
+			vB, _ := json.Marshal(value)
+			v = map[string]interface{}{"stringValue": string(vB)}
+		}
+		list = append(list, map[string]interface{}{"key": key, "value": v})
+	}
+	return list
+}
+
+// otlpExporter posts the spans to an OTLP/HTTP collector
+type otlpExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (e *otlpExporter) Export(spans []*Span) error {
+	rB, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(rB))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("the collector <" + e.endpoint + "> rejected the spans with " + resp.Status)
+	}
+	return nil
+}
+
+func (e *otlpExporter) Close() error {
+	return nil
+}
+
+// fileExporter appends every batch as one line of OTLP JSON
+type fileExporter struct {
+	w io.WriteCloser
+}
+
+func (e *fileExporter) Export(spans []*Span) error {
+	rB, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(append(rB, '\n'))
+	return err
+}
+
+func (e *fileExporter) Close() error {
+	return e.w.Close()
+}
+
+// Tracing is the echo middleware starting a server span per request, it continues the traceparent of the client
+func Tracing(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if currentTracer() == nil || c.IsWebSocket() {
+			// every websocket message gets its own span
+			return next(c)
+		}
+		r := c.Request()
+		ctx := ContextWithTraceparent(r.Context(), r.Header.Get("traceparent"))
+		ctx, span := StartSpan(ctx, r.Method+" "+c.Path(), SpanServer)
+		c.SetRequest(r.WithContext(ctx))
+		err := next(c)
+		status := c.Response().Status
+		if he, ok := err.(*echo.HTTPError); ok {
+			status = he.Code
+		}
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", c.Path())
+		span.SetAttribute("http.status_code", status)
+		span.Finish(err)
+		return err
+	}
+}
+
+// traced starts the server spans of the handlers outside of the echo routes
+func traced(route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentTracer() == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ctx := ContextWithTraceparent(r.Context(), r.Header.Get("traceparent"))
+		ctx, span := StartSpan(ctx, r.Method+" "+route, SpanServer)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("http.target", r.URL.Path)
+		h.ServeHTTP(w, r.WithContext(ctx))
+		span.Finish(nil)
+	})
+}
+
+// storageOf returns the storage whose calls are spans of the context, without tracing it is the storage itself
+func (f *Files) storageOf(ctx context.Context) Storage {
+	if ctx == nil || SpanFromContext(ctx) == nil {
+		return f.WSStorage
+	}
+	return &TracedStorage{Storage: f.WSStorage, ctx: ctx}
+}
+
+// TracedStorage records every call of the storage it wraps as a span of its context
+type TracedStorage struct {
+	Storage Storage
+	ctx     context.Context
+}
+
+func (t *TracedStorage) span(method, bucket, file string) *Span {
+	_, span := StartSpan(t.ctx, "storage."+method, SpanClient)
+	if bucket != "" {
+		span.SetAttribute("files.bucket", bucket)
+	}
+	if file != "" {
+		span.SetAttribute("files.key", file)
+	}
+	return span
+}
+
+func (t *TracedStorage) CreateBucket(bucket string) (*evmsg.Message, error) {
+	span := t.span("CreateBucket", bucket, "")
+	msg, err := t.Storage.CreateBucket(bucket)
+	span.Finish(err)
+	return msg, err
+}
+
+func (t *TracedStorage) ListBuckets() (*evmsg.Message, error) {
+	span := t.span("ListBuckets", "", "")
+	msg, err := t.Storage.ListBuckets()
+	span.Finish(err)
+	return msg, err
+}
+
+func (t *TracedStorage) ListObjects(bucket minio.BucketInfo, prefix string) (*evmsg.Message, error) {
+	span := t.span("ListObjects", bucket.Name, prefix)
+	msg, err := t.Storage.ListObjects(bucket, prefix)
+	span.Finish(err)
+	return msg, err
+}
+
+func (t *TracedStorage) GetObject(bucket, file string) (*evmsg.Message, error) {
+	span := t.span("GetObject", bucket, file)
+	msg, err := t.Storage.GetObject(bucket, file)
+	span.Finish(err)
+	return msg, err
+}
+
+func (t *TracedStorage) GetThumbnail(bucket, file string) ([]byte, error) {
+	span := t.span("GetThumbnail", bucket, file)
+	tBytes, err := t.Storage.GetThumbnail(bucket, file)
+	span.Finish(err)
+	return tBytes, err
+}
+
+func (t *TracedStorage) ReadObject(bucket, file string) (io.ReadCloser, int64, error) {
+	span := t.span("ReadObject", bucket, file)
+	rc, size, err := t.Storage.ReadObject(bucket, file)
+	span.SetAttribute("files.size", size)
+	span.Finish(err)
+	return rc, size, err
+}
+
+func (t *TracedStorage) ReadCache(cached string) (io.ReadCloser, error) {
+	span := t.span("ReadCache", "", "")
+	rc, err := t.Storage.ReadCache(cached)
+	span.Finish(err)
+	return rc, err
+}
+
+func (t *TracedStorage) WriteCache(cached string, r io.Reader) error {
+	span := t.span("WriteCache", "", "")
+	err := t.Storage.WriteCache(cached, r)
+	span.Finish(err)
+	return err
+}
+
+func (t *TracedStorage) PutObject(bucket string, file *multipart.FileHeader) error {
+	span := t.span("PutObject", bucket, file.Filename)
+	span.SetAttribute("files.size", file.Size)
+	err := t.Storage.PutObject(bucket, file)
+	span.Finish(err)
+	return err
+}
+
+func (t *TracedStorage) RemoveObject(bucket string, file string) (*evmsg.Message, error) {
+	span := t.span("RemoveObject", bucket, file)
+	msg, err := t.Storage.RemoveObject(bucket, file)
+	span.Finish(err)
+	return msg, err
+}
@@ -0,0 +1,202 @@
+package files
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"evalgo.org/evmsg"
+	echo "github.com/labstack/echo/v4"
+)
+
+// memExporter keeps the exported spans for the tests
+type memExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (e *memExporter) Export(spans []*Span) error {
+	e.mu.Lock()
+	e.spans = append(e.spans, spans...)
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *memExporter) Close() error {
+	return nil
+}
+
+func Test_Unit_Traceparent(t *testing.T) {
+	traceID, spanID, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil || hex.EncodeToString(traceID[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" || hex.EncodeToString(spanID[:]) != "00f067aa0ba902b7" {
+		t.Error("unexpected trace context", traceID, spanID, err)
+	}
+	for _, broken := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "00-xyz-00f067aa0ba902b7-01"} {
+		if _, _, err := ParseTraceparent(broken); err == nil {
+			t.Error("the traceparent has to be rejected", broken)
+		}
+	}
+	if _, span := StartSpan(context.Background(), "untraced", SpanInternal); span != nil {
+		t.Error("without tracing no spans are recorded")
+	}
+}
+
+func Test_Unit_Tracing(t *testing.T) {
+	exporter := &memExporter{}
+	startTracer(exporter)
+	s := newMemStorage()
+	f := &Files{WSStorage: s, WSClient: "files", WSSecret: "secret"}
+	e := echo.New()
+	e.Use(Tracing)
+	f.RegisterREST(e)
+	restDo(e, "POST", "/v1/buckets", []byte(`{"bucket":"docs"}`), "application/json")
+
+	body := bytes.NewBuffer(nil)
+	mw := multipart.NewWriter(body)
+	fw, _ := mw.CreateFormFile("file", "notes.txt")
+	fw.Write([]byte("hello"))
+	mw.Close()
+	r := httptest.NewRequest("POST", "/v1/buckets/docs/objects", body)
+	r.SetBasicAuth("files", "secret")
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	msg := evmsg.NewMessage()
+	msg.Scope, msg.Command = "Object", "get"
+	msg.Data = []interface{}{map[string]interface{}{"bucket": "docs", "file": "notes.txt"}}
+	f.Dispatch(ContextWithTraceparent(context.Background(), "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"), "files", msg)
+	e.GET(ArchiveFilePath, f.serveArchive)
+	r = httptest.NewRequest("GET", strings.Replace(ArchiveFilePath, ":bucket", "docs", 1)+"?keys=notes.txt", nil)
+	r.Header.Set("traceparent", "00-5bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if w = s3Do(t, traced("s3", f.S3()), "GET", "/docs/notes.txt", nil, nil); w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	davPath := WebDAVPath
+	WebDAVPath = "/dav"
+	defer func() { WebDAVPath = davPath }()
+	if w = davDo(traced("webdav", f.WebDAV()), "GET", "/dav/docs/notes.txt", "", nil); w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if err := StopTracing(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	byName := map[string][]*Span{}
+	for _, span := range exporter.spans {
+		byName[span.Name] = append(byName[span.Name], span)
+	}
+	server := byName["POST /v1/buckets/:bucket/objects"]
+	if len(server) != 1 || hex.EncodeToString(server[0].ParentID[:]) != "00f067aa0ba902b7" {
+		t.Fatal("the server span has to continue the traceparent", byName)
+	}
+	for _, name := range []string{"upload.form", "upload", "upload.checksum", "upload.analyze", "storage.PutObject", "storage.GetObject"} {
+		if len(byName[name]) == 0 || byName[name][0].TraceID != server[0].TraceID {
+			t.Error("the stage has to be a span of the upload trace", name)
+		}
+	}
+	buckets := map[interface{}]bool{}
+	for _, span := range byName["storage.PutObject"] {
+		buckets[span.attrs["files.bucket"]] = true
+	}
+	if !buckets["docs"] || !buckets["meta"] {
+		t.Error("the data and the meta writes have to be spans", buckets)
+	}
+	command := byName["command Object/get"]
+	if len(command) != 1 || hex.EncodeToString(command[0].TraceID[:]) != "0af7651916cd43dd8448eb211c80319c" {
+		t.Fatal("the command span has to continue the traceparent of the message", byName)
+	}
+	get := byName["storage.GetObject"]
+	if get[len(get)-1].ParentID != command[0].SpanID {
+		t.Error("the storage call has to be a child of the command")
+	}
+	for _, route := range []string{"GET " + ArchiveFilePath, "GET s3", "GET webdav"} {
+		if len(byName[route]) != 1 {
+			t.Fatal("the request has to be a span", route, byName)
+		}
+		reads := 0
+		for _, span := range byName["storage.ReadObject"] {
+			if span.TraceID == byName[route][0].TraceID {
+				reads++
+			}
+		}
+		if reads == 0 {
+			t.Error("the reads of the request have to be spans of its trace", route)
+		}
+	}
+	if _, span := StartSpan(context.Background(), "stopped", SpanInternal); span != nil {
+		t.Error("a stopped tracer records no spans")
+	}
+}
+
+func Test_Unit_TraceFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "traces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := TraceFile
+	TraceFile = filepath.Join(dir, "spans.jsonl")
+	defer func() { TraceFile = file }()
+	if err := StartTracing(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, parent := StartSpan(context.Background(), "parent", SpanServer)
+	_, child := StartSpan(ctx, "child", SpanInternal)
+	child.SetAttribute("files.size", 5)
+	child.Finish(os.ErrNotExist)
+	parent.Finish(nil)
+	if err := StopTracing(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.Open(TraceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	lines := bufio.NewScanner(fd)
+	if !lines.Scan() {
+		t.Fatal("the spans have to be written")
+	}
+	request := struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string `json:"name"`
+					Status       struct {
+						Code    int    `json:"code"`
+						Message string `json:"message"`
+					} `json:"status"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}{}
+	if err := json.Unmarshal(lines.Bytes(), &request); err != nil || len(request.ResourceSpans) != 1 {
+		t.Fatal("the line has to be an OTLP export request", err, lines.Text())
+	}
+	spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 || spans[0].Name != "child" || spans[0].Status.Code != 2 || spans[0].TraceID != spans[1].TraceID || spans[0].ParentSpanID == "" || spans[1].ParentSpanID != "" {
+		t.Error("unexpected spans", lines.Text())
+	}
+}
@@ -0,0 +1,567 @@
+package files
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"evalgo.org/evmsg"
+	"github.com/nfnt/resize"
+)
+
+var TransformFilePath string = "/v0.0.1/files/buckets/:bucket/images/:object"
+var TransformSigningKey string = ""
+var TransformMaxOps int = 16
+var TransformMaxSize int = 4096
+
+// TransformUnsignedMaxOps and TransformUnsignedMaxSize bound the pipelines served without a
+// signing key, zero steps allow no unsigned pipelines at all
+var TransformUnsignedMaxOps int = 4
+var TransformUnsignedMaxSize int = 1024
+
+// TransformOp is a single step of an image pipeline
+type TransformOp struct {
+	Op        string  `json:"op"`
+	X         int     `json:"x,omitempty"`
+	Y         int     `json:"y,omitempty"`
+	Width     int     `json:"width,omitempty"`
+	Height    int     `json:"height,omitempty"`
+	Angle     int     `json:"angle,omitempty"`
+	Direction string  `json:"direction,omitempty"`
+	Radius    float64 `json:"radius,omitempty"`
+	Amount    float64 `json:"amount,omitempty"`
+	Bucket    string  `json:"bucket,omitempty"`
+	Key       string  `json:"key,omitempty"`
+	Text      string  `json:"text,omitempty"`
+	Position  string  `json:"position,omitempty"`
+	Opacity   float64 `json:"opacity,omitempty"`
+	Format    string  `json:"format,omitempty"`
+	Quality   int     `json:"quality,omitempty"`
+}
+
+// ParseTransformOps reads the compact URL form, e.g. resize:300,0;rotate:90;format:png
+func ParseTransformOps(ops string) ([]TransformOp, error) {
+	pipeline := []TransformOp{}
+	for _, step := range strings.Split(ops, ";") {
+		if step == "" {
+			continue
+		}
+		parts := strings.SplitN(step, ":", 2)
+		op := TransformOp{Op: parts[0]}
+		args := []string{}
+		if len(parts) == 2 {
+			args = strings.Split(parts[1], ",")
+		}
+		ints := func(n int) ([]int, error) {
+			if len(args) != n {
+				return nil, errors.New("the transformation <" + op.Op + "> expects " + strconv.Itoa(n) + " arguments!")
+			}
+			values := make([]int, n)
+			for i, arg := range args {
+				v, err := strconv.Atoi(arg)
+				if err != nil {
+					return nil, errors.New("the transformation <" + op.Op + "> expects numbers!")
+				}
+				values[i] = v
+			}
+			return values, nil
+		}
+		switch op.Op {
+		case "resize":
+			v, err := ints(2)
+			if err != nil {
+				return nil, err
+			}
+			op.Width, op.Height = v[0], v[1]
+		case "crop":
+			v, err := ints(4)
+			if err != nil {
+				return nil, err
+			}
+			op.X, op.Y, op.Width, op.Height = v[0], v[1], v[2], v[3]
+		case "rotate":
+			v, err := ints(1)
+			if err != nil {
+				return nil, err
+			}
+			op.Angle = v[0]
+		case "flip":
+			if len(args) != 1 {
+				return nil, errors.New("the transformation <flip> expects h or v!")
+			}
+			op.Direction = args[0]
+		case "blur", "sharpen":
+			if len(args) != 1 {
+				return nil, errors.New("the transformation <" + op.Op + "> expects one argument!")
+			}
+			v, err := strconv.ParseFloat(args[0], 64)
+			if err != nil {
+				return nil, err
+			}
+			op.Radius, op.Amount = v, v
+		case "watermark":
+			// watermark:bucket/key,position,opacity
+			if len(args) != 3 {
+				return nil, errors.New("the transformation <watermark> expects bucket/key,position,opacity!")
+			}
+			ref := strings.SplitN(args[0], "/", 2)
+			if len(ref) != 2 {
+				return nil, errors.New("the watermark has to be given as bucket/key!")
+			}
+			op.Bucket, op.Key, op.Position = ref[0], ref[1], args[1]
+			v, err := strconv.ParseFloat(args[2], 64)
+			if err != nil {
+				return nil, err
+			}
+			op.Opacity = v
+		case "format":
+			if len(args) < 1 || len(args) > 2 {
+				return nil, errors.New("the transformation <format> expects a format and an optional quality!")
+			}
+			op.Format = args[0]
+			if len(args) == 2 {
+				q, err := strconv.Atoi(args[1])
+				if err != nil {
+					return nil, err
+				}
+				op.Quality = q
+			}
+		case "grayscale":
+		}
+		pipeline = append(pipeline, op)
+	}
+	return pipeline, ValidateTransform(pipeline)
+}
+
+// ParseTransformPipeline reads the JSON form of a pipeline, either a string or decoded JSON
+func ParseTransformPipeline(pipeline interface{}) ([]TransformOp, error) {
+	var pB []byte
+	if str, ok := pipeline.(string); ok {
+		pB = []byte(str)
+	} else {
+		pB, _ = json.Marshal(pipeline)
+	}
+	steps := []json.RawMessage{}
+	err := json.Unmarshal(pB, &steps)
+	if err != nil {
+		return nil, errors.New("the pipeline has to be a list of transformations!")
+	}
+	ops := make([]TransformOp, len(steps))
+	for i, step := range steps {
+		err = json.Unmarshal(step, &ops[i])
+		if err == nil && ops[i].Op == "watermark" {
+			// a watermark without an opacity gets the default one
+			ops[i] = TransformOp{Opacity: WatermarkOpacity}
+			err = json.Unmarshal(step, &ops[i])
+		}
+		if err != nil {
+			return nil, errors.New("the pipeline has to be a list of transformations!")
+		}
+	}
+	return ops, ValidateTransform(ops)
+}
+
+// ValidateTransform rejects unknown operations and oversized results
+func ValidateTransform(pipeline []TransformOp) error {
+	if len(pipeline) > TransformMaxOps {
+		return errors.New("the pipeline has more than " + strconv.Itoa(TransformMaxOps) + " steps!")
+	}
+	for _, op := range pipeline {
+		switch op.Op {
+		case "resize":
+			if op.Width < 0 || op.Height < 0 || op.Width > TransformMaxSize || op.Height > TransformMaxSize || op.Width+op.Height == 0 {
+				return errors.New("the resize dimensions are out of range!")
+			}
+		case "crop":
+			if op.Width <= 0 || op.Height <= 0 {
+				return errors.New("the crop dimensions are out of range!")
+			}
+		case "rotate":
+			if op.Angle%90 != 0 {
+				return errors.New("only rotations by multiples of 90 degrees are supported!")
+			}
+		case "flip":
+			if op.Direction != "h" && op.Direction != "v" {
+				return errors.New("the flip direction has to be h or v!")
+			}
+		case "blur", "sharpen":
+			if op.Radius <= 0 || op.Radius > 20 {
+				return errors.New("the " + op.Op + " radius has to be between 0 and 20!")
+			}
+		case "watermark":
+			if op.Text == "" && (op.Bucket == "" || op.Key == "") {
+				return errors.New("the watermark needs a text or an image!")
+			}
+			if op.Opacity <= 0 || op.Opacity > 1 {
+				return errors.New("the watermark opacity has to be between 0 and 1!")
+			}
+		case "format":
+			if _, err := transformFormat(op.Format); err != nil {
+				return err
+			}
+		case "grayscale":
+		default:
+			return errors.New("the transformation <" + op.Op + "> is not supported!")
+		}
+	}
+	return nil
+}
+
+func transformFormat(format string) (string, error) {
+	switch strings.ToLower(format) {
+	case "jpg", "jpeg":
+		return "jpeg", nil
+	case "png":
+		return "png", nil
+	case "gif":
+		return "gif", nil
+	}
+	return "", errors.New("the format <" + format + "> is not supported!")
+}
+
+// TransformKey is the canonical form of a pipeline, it names cache entries and gets signed
+func TransformKey(bucket, file, checksum string, pipeline []TransformOp) string {
+	pB, _ := json.Marshal(pipeline)
+	hasher := sha256.New()
+	hasher.Write([]byte(bucket + "/" + file + "\n" + checksum + "\n"))
+	hasher.Write(pB)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// SignTransform signs a pipeline of an object, expires is a unix timestamp or 0
+func SignTransform(bucket, file string, pipeline []TransformOp, expires int64) string {
+	pB, _ := json.Marshal(pipeline)
+	mac := hmac.New(sha256.New, []byte(TransformSigningKey))
+	mac.Write([]byte(bucket + "/" + file + "\n" + strconv.FormatInt(expires, 10) + "\n"))
+	mac.Write(pB)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CheckTransformSources allows watermark images of the bucket itself or of the policies bucket only
+func CheckTransformSources(bucket string, pipeline []TransformOp) error {
+	for _, op := range pipeline {
+		if op.Op == "watermark" && op.Text == "" && op.Bucket != bucket && op.Bucket != PolicyBucket {
+			return errors.New("the watermark has to be an image of the bucket <" + bucket + "> or <" + PolicyBucket + ">!")
+		}
+	}
+	return nil
+}
+
+// limitUnsigned keeps the pipelines anybody can request cheap
+func limitUnsigned(pipeline []TransformOp) error {
+	if len(pipeline) > TransformUnsignedMaxOps {
+		return errors.New("unsigned pipelines are limited to " + strconv.Itoa(TransformUnsignedMaxOps) + " steps!")
+	}
+	for _, op := range pipeline {
+		switch op.Op {
+		case "resize":
+			if op.Width > TransformUnsignedMaxSize || op.Height > TransformUnsignedMaxSize {
+				return errors.New("unsigned pipelines can not resize beyond " + strconv.Itoa(TransformUnsignedMaxSize) + " pixels!")
+			}
+		case "blur", "sharpen":
+			return errors.New("the transformation <" + op.Op + "> needs a signed url!")
+		}
+	}
+	return nil
+}
+
+// VerifyTransform checks the signature of a transformation request, without a signing
+// key the unsigned limits apply
+func VerifyTransform(bucket, file string, pipeline []TransformOp, expires int64, signature string) error {
+	if TransformSigningKey == "" {
+		return limitUnsigned(pipeline)
+	}
+	if expires > 0 && time.Now().Unix() > expires {
+		return errors.New("the signed transformation url is expired!")
+	}
+	expected := SignTransform(bucket, file, pipeline, expires)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errors.New("the transformation url is not signed!")
+	}
+	return nil
+}
+
+// TransformURL returns a signed URL of a pipeline for the websocket clients
+func TransformURL(bucket, file string, pipeline []TransformOp, ttl int64) (*evmsg.Message, error) {
+	msg := evmsg.NewMessage()
+	msg.State = "Response"
+	err := ValidateTransform(pipeline)
+	if err == nil {
+		err = CheckTransformSources(bucket, pipeline)
+	}
+	if err == nil && TransformSigningKey == "" {
+		err = limitUnsigned(pipeline)
+	}
+	if err != nil {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	var expires int64
+	if ttl > 0 {
+		expires = time.Now().Unix() + ttl
+	}
+	pB, _ := json.Marshal(pipeline)
+	q := url.Values{}
+	q.Set("pipeline", string(pB))
+	if expires > 0 {
+		q.Set("expires", strconv.FormatInt(expires, 10))
+	}
+	if TransformSigningKey != "" {
+		q.Set("sig", SignTransform(bucket, file, pipeline, expires))
+	}
+	path := strings.Replace(TransformFilePath, ":bucket", bucket, 1)
+	path = strings.Replace(path, ":object", url.PathEscape(file), 1)
+	msg.Data = []interface{}{map[string]interface{}{"path": path + "?" + q.Encode()}}
+	return msg, nil
+}
+
+// ApplyTransform runs the pipeline and returns the encoded image with its content type
+func ApplyTransform(s Storage, img image.Image, file string, pipeline []TransformOp) ([]byte, string, error) {
+	format, err := transformFormat(strings.TrimPrefix(filepath.Ext(file), "."))
+	if err != nil {
+		format = "png"
+	}
+	quality := jpeg.DefaultQuality
+	for _, op := range pipeline {
+		switch op.Op {
+		case "resize":
+			img = resize.Resize(uint(op.Width), uint(op.Height), img, resize.Lanczos3)
+		case "crop":
+			rect := image.Rect(op.X, op.Y, op.X+op.Width, op.Y+op.Height).Add(img.Bounds().Min).Intersect(img.Bounds())
+			if rect.Empty() {
+				return nil, "", errors.New("the crop area is outside of the image!")
+			}
+			dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+			draw.Draw(dst, dst.Bounds(), img, rect.Min, draw.Src)
+			img = dst
+		case "rotate":
+			for turns := ((op.Angle/90)%4 + 4) % 4; turns > 0; turns-- {
+				img = rotate90(img)
+			}
+		case "flip":
+			img = flip(img, op.Direction == "h")
+		case "grayscale":
+			dst := image.NewGray(img.Bounds())
+			draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+			img = dst
+		case "blur":
+			img = boxBlur(img, int(math.Ceil(op.Radius)))
+		case "sharpen":
+			img = sharpen(img, op.Amount)
+		case "watermark":
+			img, err = Watermark(s, img, op)
+			if err != nil {
+				return nil, "", err
+			}
+		case "format":
+			format, _ = transformFormat(op.Format)
+			if op.Quality > 0 {
+				quality = op.Quality
+			}
+		}
+	}
+	buff := bytes.NewBuffer(nil)
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(buff, img, &jpeg.Options{Quality: quality})
+	case "gif":
+		err = gif.Encode(buff, img, nil)
+	default:
+		err = png.Encode(buff, img)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buff.Bytes(), "image/" + format, nil
+}
+
+func loadImage(s Storage, bucket, file string) (image.Image, error) {
+	rc, _, err := s.ReadObject(bucket, file)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	img, _, err := image.Decode(rc)
+	return img, err
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Bounds().Min == (image.Point{}) {
+		return rgba
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+	return dst
+}
+
+func rotate90(img image.Image) image.Image {
+	src := toRGBA(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, h, w))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dst.Set(h-1-y, x, src.At(x, y))
+		}
+	}
+	return dst
+}
+
+func flip(img image.Image, horizontal bool) image.Image {
+	src := toRGBA(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(src.Bounds())
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if horizontal {
+				dst.Set(w-1-x, y, src.At(x, y))
+			} else {
+				dst.Set(x, h-1-y, src.At(x, y))
+			}
+		}
+	}
+	return dst
+}
+
+// boxBlur blurs horizontally and vertically with a running sum
+func boxBlur(img image.Image, radius int) *image.RGBA {
+	src := toRGBA(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	tmp := image.NewRGBA(src.Bounds())
+	dst := image.NewRGBA(src.Bounds())
+	pass := func(in, out *image.RGBA, length, lines int, offset func(line, i int) int) {
+		for line := 0; line < lines; line++ {
+			for i := 0; i < length; i++ {
+				var sum [4]int
+				n := 0
+				for k := i - radius; k <= i+radius; k++ {
+					if k < 0 || k >= length {
+						continue
+					}
+					o := offset(line, k)
+					for c := 0; c < 4; c++ {
+						sum[c] += int(in.Pix[o+c])
+					}
+					n++
+				}
+				o := offset(line, i)
+				for c := 0; c < 4; c++ {
+					out.Pix[o+c] = uint8(sum[c] / n)
+				}
+			}
+		}
+	}
+	pass(src, tmp, w, h, func(y, x int) int { return y*src.Stride + x*4 })
+	pass(tmp, dst, h, w, func(x, y int) int { return y*src.Stride + x*4 })
+	return dst
+}
+
+// sharpen applies an unsharp mask, amount scales the difference to the blurred image
+func sharpen(img image.Image, amount float64) *image.RGBA {
+	src := toRGBA(img)
+	blurred := boxBlur(src, 1)
+	dst := image.NewRGBA(src.Bounds())
+	for i := range src.Pix {
+		if i%4 == 3 {
+			dst.Pix[i] = src.Pix[i]
+			continue
+		}
+		v := float64(src.Pix[i]) + amount*(float64(src.Pix[i])-float64(blurred.Pix[i]))
+		dst.Pix[i] = uint8(math.Max(0, math.Min(255, v)))
+	}
+	return dst
+}
+
+// Overlay draws mark onto img at one of the positions top-left, top-right, bottom-left,
+// bottom-right, center or tile with the given opacity
+func Overlay(img, mark image.Image, position string, opacity float64) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+	mask := image.NewUniform(color.Alpha{uint8(opacity * 255)})
+	w, h := dst.Bounds().Dx(), dst.Bounds().Dy()
+	mw, mh := mark.Bounds().Dx(), mark.Bounds().Dy()
+	margin := w / 50
+	points := []image.Point{}
+	switch position {
+	case "top-left":
+		points = append(points, image.Pt(margin, margin))
+	case "top-right":
+		points = append(points, image.Pt(w-mw-margin, margin))
+	case "bottom-left":
+		points = append(points, image.Pt(margin, h-mh-margin))
+	case "center":
+		points = append(points, image.Pt((w-mw)/2, (h-mh)/2))
+	case "tile":
+		for y := 0; y < h; y += mh * 2 {
+			for x := (y / (mh * 2) % 2) * mw; x < w; x += mw * 2 {
+				points = append(points, image.Pt(x, y))
+			}
+		}
+	default:
+		points = append(points, image.Pt(w-mw-margin, h-mh-margin))
+	}
+	for _, p := range points {
+		rect := image.Rectangle{Min: p, Max: p.Add(image.Pt(mw, mh))}
+		draw.DrawMask(dst, rect, mark, mark.Bounds().Min, mask, image.Point{}, draw.Over)
+	}
+	return dst
+}
+
+// Transform serves a cached rendition of an object or renders and caches it, objects
+// without a checksum are rendered on every request since changes can not be detected
+func Transform(s Storage, bucket, file string, pipeline []TransformOp) (io.ReadCloser, string, error) {
+	meta, _ := GetMeta(s, file)
+	format, err := transformFormat(strings.TrimPrefix(filepath.Ext(file), "."))
+	if err != nil {
+		format = "png"
+	}
+	for _, op := range pipeline {
+		if op.Op == "format" {
+			format, _ = transformFormat(op.Format)
+		}
+	}
+	cached := ""
+	if meta["checksum"] != "" {
+		cached = filepath.Join(MinioFilesCacheDir, "renditions", TransformKey(bucket, file, meta["checksum"], pipeline)+"."+format)
+		if _, err := os.Stat(cached); err == nil {
+			rc, err := s.ReadCache(cached)
+			if err == nil {
+				cacheLookup("renditions", true)
+				return rc, "image/" + format, nil
+			}
+		}
+		cacheLookup("renditions", false)
+	}
+	img, err := loadImage(s, bucket, file)
+	if err != nil {
+		return nil, "", err
+	}
+	data, cType, err := ApplyTransform(s, img, file, pipeline)
+	if err != nil {
+		return nil, "", err
+	}
+	if cached != "" {
+		err = s.WriteCache(cached, bytes.NewReader(data))
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), cType, nil
+}
@@ -0,0 +1,166 @@
+package files
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_Unit_ParseTransformOps(t *testing.T) {
+	ops, err := ParseTransformOps("crop:10,10,100,50;rotate:90;flip:h;grayscale;blur:2;sharpen:1;watermark:marks/logo.png,center,0.5;format:jpg,80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 8 || ops[0].Width != 100 || ops[6].Bucket != "marks" || ops[6].Key != "logo.png" || ops[7].Quality != 80 {
+		t.Error("unexpected pipeline", ops)
+	}
+	for _, bad := range []string{"rotate:45", "flip:x", "crop:1,2", "format:bmp", "emboss", "blur:50"} {
+		if _, err := ParseTransformOps(bad); err == nil {
+			t.Error("expected an error for", bad)
+		}
+	}
+	fromJSON, err := ParseTransformPipeline(`[{"op":"crop","x":10,"y":10,"width":100,"height":50}]`)
+	if err != nil || TransformKey("b", "f", "c", fromJSON) != TransformKey("b", "f", "c", ops[:1]) {
+		t.Error("the JSON and the URL form have to produce the same canonical pipeline", err)
+	}
+}
+
+func Test_Unit_ApplyTransform(t *testing.T) {
+	s := newMemStorage()
+	src := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	src.Set(0, 0, color.RGBA{255, 0, 0, 255})
+	ops, _ := ParseTransformOps("rotate:90;format:png")
+	data, cType, err := ApplyTransform(s, src, "test.jpg", ops)
+	if err != nil || cType != "image/png" {
+		t.Fatal(cType, err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 20 || img.Bounds().Dy() != 40 {
+		t.Error("unexpected size after rotation", img.Bounds())
+	}
+	if r, _, _, _ := img.At(19, 0).RGBA(); r>>8 != 255 {
+		t.Error("the top left pixel has to move to the top right")
+	}
+	ops, _ = ParseTransformOps("flip:h;crop:0,0,10,10")
+	data, _, err = ApplyTransform(s, src, "test.png", ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _ = png.Decode(bytes.NewReader(data))
+	if img.Bounds().Dx() != 10 {
+		t.Error("unexpected size after crop", img.Bounds())
+	}
+}
+
+func Test_Unit_TransformCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "renditions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheDir := MinioFilesCacheDir
+	MinioFilesCacheDir = dir
+	defer func() { MinioFilesCacheDir = cacheDir }()
+	s := newMemStorage()
+	s.objects["test"] = map[string][]byte{"shot.png": testPng(t, testPattern(64, 48, 0, false))}
+	if err := PutMeta(s, "shot.png", map[string]string{"checksum": "sha256:abc"}); err != nil {
+		t.Fatal(err)
+	}
+	ops, _ := ParseTransformOps("resize:32,0;grayscale")
+	rc, cType, err := Transform(s, "test", "shot.png", ops)
+	if err != nil || cType != "image/png" {
+		t.Fatal(cType, err)
+	}
+	rc.Close()
+	// the rendition is served from the cache even if the original is gone
+	delete(s.objects["test"], "shot.png")
+	rc, _, err = Transform(s, "test", "shot.png", ops)
+	if err != nil {
+		t.Fatal("expected a cached rendition", err)
+	}
+	img, err := png.Decode(rc)
+	rc.Close()
+	if err != nil || img.Bounds().Dx() != 32 {
+		t.Error("unexpected rendition", err)
+	}
+}
+
+func Test_Unit_SignTransform(t *testing.T) {
+	key := TransformSigningKey
+	TransformSigningKey = "signing"
+	defer func() { TransformSigningKey = key }()
+	ops, _ := ParseTransformOps("grayscale")
+	sig := SignTransform("test", "shot.png", ops, 0)
+	if err := VerifyTransform("test", "shot.png", ops, 0, sig); err != nil {
+		t.Error(err)
+	}
+	if err := VerifyTransform("test", "other.png", ops, 0, sig); err == nil {
+		t.Error("the signature must not be valid for other objects")
+	}
+	if err := VerifyTransform("test", "shot.png", ops, 0, ""); err == nil {
+		t.Error("unsigned requests have to be rejected")
+	}
+	expired := time.Now().Unix() - 1
+	if err := VerifyTransform("test", "shot.png", ops, expired, SignTransform("test", "shot.png", ops, expired)); err == nil {
+		t.Error("expired urls have to be rejected")
+	}
+}
+
+func Test_Unit_UnsignedTransform(t *testing.T) {
+	key, maxOps := TransformSigningKey, TransformUnsignedMaxOps
+	TransformSigningKey = ""
+	defer func() { TransformSigningKey, TransformUnsignedMaxOps = key, maxOps }()
+	cases := []struct {
+		ops     string
+		allowed bool
+	}{
+		{"resize:300,0;grayscale;format:png", true},
+		{"rotate:90;rotate:90;rotate:90;rotate:90;rotate:90", false},
+		{"resize:4000,0", false},
+		{"blur:20", false},
+		{"sharpen:1", false},
+	}
+	for _, c := range cases {
+		ops, err := ParseTransformOps(c.ops)
+		if err != nil {
+			t.Fatal(c.ops, err)
+		}
+		if err := VerifyTransform("test", "shot.png", ops, 0, ""); (err == nil) != c.allowed {
+			t.Error("unexpected verification of", c.ops, err)
+		}
+	}
+	TransformUnsignedMaxOps = 0
+	ops, _ := ParseTransformOps("grayscale")
+	if err := VerifyTransform("test", "shot.png", ops, 0, ""); err == nil {
+		t.Error("unsigned pipelines have to be disabled")
+	}
+}
+
+func Test_Unit_TransformSources(t *testing.T) {
+	for ops, allowed := range map[string]bool{
+		"watermark:test/logo.png,center,0.5":                 true,
+		"watermark:" + PolicyBucket + "/logo.png,center,0.5": true,
+		"watermark:private/logo.png,center,0.5":              false,
+		"watermark:meta/shot.png.json,center,0.5":            false,
+	} {
+		pipeline, err := ParseTransformOps(ops)
+		if err != nil {
+			t.Fatal(ops, err)
+		}
+		if err := CheckTransformSources("test", pipeline); (err == nil) != allowed {
+			t.Error("unexpected source check of", ops, err)
+		}
+	}
+	s := newMemStorage()
+	if _, err := PutWatermarkPolicy(s, "test", &WatermarkPolicy{Bucket: "private", Key: "logo.png", Opacity: 0.5}); err == nil {
+		t.Error("a policy must not mark with images of other buckets")
+	}
+}
@@ -0,0 +1,226 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"evalgo.org/evmsg"
+)
+
+// CheckUploadExtension enforces the content policy of the objects route
+func CheckUploadExtension(file string) error {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".jpg", ".jpeg", ".png":
+		// found the right extensions that are supported
+		return nil
+	case ".pdf", ".docx", ".odt", ".txt":
+		// documents get their text extracted
+		return nil
+	case ".mp4", ".m4v", ".m4a", ".mov", ".webm", ".mkv", ".mp3":
+		// media files get probed
+		return nil
+	}
+	// everything else is not supported
+	return errors.New("the given extension <" + strings.ToLower(filepath.Ext(file)) + "> is not supported!")
+}
+
+// NewFileHeader wraps data into a multipart file header that can be handed to Storage.PutObject
+func NewFileHeader(file string, data []byte) (*multipart.FileHeader, error) {
+	buff := bytes.NewBuffer(nil)
+	// the random boundary of the writer, a fixed one could be part of the data
+	mw := multipart.NewWriter(buff)
+	mf, err := mw.CreateFormFile("file", file)
+	if err != nil {
+		return nil, err
+	}
+	mf.Write(data)
+	mw.Close()
+	mr := multipart.NewReader(buff, mw.Boundary())
+	form, err := mr.ReadForm(int64(len(data)) + (32 << 20))
+	if err != nil {
+		return nil, err
+	}
+	fh := form.File["file"][0]
+	// multipart strips directories from the file name, keys may contain a prefix
+	fh.Filename = file
+	return fh, nil
+}
+
+// NewFileHeaderFrom streams r into a multipart file header, content larger than 32 MB is kept in a
+// temporary file that form.RemoveAll deletes
+func NewFileHeaderFrom(file string, r io.Reader) (*multipart.FileHeader, *multipart.Form, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	written := make(chan error, 1)
+	go func() {
+		mf, err := mw.CreateFormFile("file", file)
+		if err == nil {
+			_, err = io.Copy(mf, r)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+		written <- err
+	}()
+	form, err := multipart.NewReader(pr, mw.Boundary()).ReadForm(32 << 20)
+	// unblocks the writer if the form ended early
+	pr.Close()
+	if werr := <-written; werr != nil && werr != io.ErrClosedPipe {
+		err = werr
+	}
+	if err != nil {
+		if form != nil {
+			form.RemoveAll()
+		}
+		return nil, nil, err
+	}
+	fh := form.File["file"][0]
+	fh.Filename = file
+	return fh, form, nil
+}
+
+// GetMeta reads the meta information of a file from the meta bucket
+func GetMeta(s Storage, file string) (map[string]string, error) {
+	meta := map[string]string{}
+	obj, _, err := s.ReadObject("meta", metaKey(file))
+	if err != nil {
+		return meta, err
+	}
+	defer obj.Close()
+	err = json.NewDecoder(obj).Decode(&meta)
+	return meta, err
+}
+
+// PutMeta stores the meta information of a file in the meta bucket
+func PutMeta(s Storage, file string, meta map[string]string) error {
+	iB, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	fh, err := NewFileHeader(metaKey(file), iB)
+	if err != nil {
+		return err
+	}
+	return s.PutObject("meta", fh)
+}
+
+// UpdateMeta changes the editable meta information of a file
+func UpdateMeta(s Storage, file string, changes map[string]string) (*evmsg.Message, error) {
+	msg := evmsg.NewMessage()
+	msg.State = "Response"
+	meta, err := GetMeta(s, file)
+	if err != nil {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	for field, value := range changes {
+		switch field {
+		case "description", "tags":
+			meta[field] = value
+		default:
+			err = errors.New("the meta information <" + field + "> can not be changed!")
+			msg.Debug.Error = err.Error()
+			return msg, err
+		}
+	}
+	err = PutMeta(s, file, meta)
+	if err != nil {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	data := map[string]interface{}{}
+	for field, value := range meta {
+		data[field] = value
+	}
+	msg.Data = []interface{}{data}
+	return msg, nil
+}
+
+// Upload checks, describes, stores and scans an uploaded file, the status tells
+// the clients why an upload failed
+func (f *Files) Upload(ctx context.Context, bucket string, file *multipart.FileHeader, expected, description, tags string) (int, error) {
+	ctx, span := StartSpan(ctx, "upload", SpanInternal)
+	span.SetAttribute("files.bucket", bucket)
+	span.SetAttribute("files.key", file.Filename)
+	span.SetAttribute("files.size", file.Size)
+	status, err := f.upload(ctx, bucket, file, expected, description, tags)
+	span.SetAttribute("http.status_code", status)
+	span.Finish(err)
+	return status, err
+}
+
+func (f *Files) upload(ctx context.Context, bucket string, file *multipart.FileHeader, expected, description, tags string) (int, error) {
+	s := f.storageOf(ctx)
+	err := CheckUploadExtension(file.Filename)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	src, err := file.Open()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	_, span := StartSpan(ctx, "upload.checksum", SpanInternal)
+	checksum, err := UploadChecksum(src, expected)
+	span.Finish(err)
+	src.Close()
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	meta := map[string]string{"name": file.Filename, "description": description, "tags": tags, "checksum": checksum}
+	src, err = file.Open()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	_, span = StartSpan(ctx, "upload.analyze", SpanInternal)
+	AddExifMeta(meta, src)
+	AddTextMeta(meta, file.Filename, src, file.Size)
+	AddMediaMeta(meta, file.Filename, src, file.Size)
+	src.Seek(0, io.SeekStart)
+	AddImageHashMeta(meta, file.Filename, src)
+	span.Finish(nil)
+	src.Close()
+	if f.WSScanner != nil {
+		// quarantine the object before it becomes visible
+		meta["scan"] = ScanPending
+		err = PutScanState(s, bucket, file.Filename, meta)
+	} else {
+		err = RemoveScanState(s, bucket, file.Filename)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = s.PutObject(bucket, file)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	uploadBytes.add(float64(file.Size))
+	err = PutMeta(s, file.Filename, meta)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if f.WSScanner != nil {
+		src, err := file.Open()
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		_, span := StartSpan(ctx, "upload.scan", SpanInternal)
+		result, err := ScanObject(f.WSScanner, s, bucket, file.Filename, src, meta)
+		span.Finish(err)
+		src.Close()
+		if err != nil {
+			return http.StatusAccepted, errors.New("the object <" + file.Filename + "> stays quarantined, the scan failed: " + err.Error())
+		}
+		if result.Infected {
+			return http.StatusUnprocessableEntity, errors.New("the object <" + file.Filename + "> is infected with <" + result.Signature + ">!")
+		}
+	}
+	return http.StatusOK, nil
+}
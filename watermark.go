@@ -0,0 +1,274 @@
+package files
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"evalgo.org/evmsg"
+	"github.com/minio/minio-go/v6"
+	"github.com/nfnt/resize"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+var PolicyBucket string = "policies"
+
+// WatermarkOpacity is used for watermarks that do not give an opacity
+var WatermarkOpacity float64 = 0.5
+
+// Identities maps the names of the identities to their secrets, the service client is always known
+var Identities = map[string]string{}
+
+// WatermarkPolicy marks everything non-owners download from a bucket
+type WatermarkPolicy struct {
+	Text     string   `json:"text,omitempty"`
+	Bucket   string   `json:"bucket,omitempty"`
+	Key      string   `json:"key,omitempty"`
+	Position string   `json:"position,omitempty"`
+	Opacity  float64  `json:"opacity"`
+	Owners   []string `json:"owners"`
+}
+
+// LoadIdentities reads a JSON file of identity names and their secrets, an identity can
+// also be an object with a secret and a permission
+func LoadIdentities(path string) (map[string]string, map[string]string, error) {
+	identities := map[string]string{}
+	permissions := map[string]string{}
+	iB, err := ioutil.ReadFile(path)
+	if err != nil {
+		return identities, permissions, err
+	}
+	entries := map[string]json.RawMessage{}
+	err = json.Unmarshal(iB, &entries)
+	if err != nil {
+		return identities, permissions, err
+	}
+	for name, raw := range entries {
+		var secret string
+		if json.Unmarshal(raw, &secret) == nil {
+			identities[name] = secret
+			continue
+		}
+		entry := struct {
+			Secret     string `json:"secret"`
+			Permission string `json:"permission"`
+		}{}
+		err = json.Unmarshal(raw, &entry)
+		if err != nil {
+			return identities, permissions, err
+		}
+		if _, ok := permissionLevels[entry.Permission]; !ok && entry.Permission != "" {
+			return identities, permissions, errors.New("the permission <" + entry.Permission + "> of the identity <" + name + "> is not known!")
+		}
+		identities[name] = entry.Secret
+		if entry.Permission != "" {
+			permissions[name] = entry.Permission
+		}
+	}
+	return identities, permissions, nil
+}
+
+// Identity returns the identity of a request authenticated with a client certificate
+// or with basic auth, anonymous requests have none
+func (f *Files) Identity(r *http.Request) string {
+	if identity := f.tlsIdentity(r); identity != "" {
+		return identity
+	}
+	name, secret, ok := r.BasicAuth()
+	if !ok {
+		return ""
+	}
+	expected, known := f.secretOf(name)
+	if !known || subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) != 1 {
+		return ""
+	}
+	return name
+}
+
+// IsOwner reports if an identity gets the clean files of a bucket with this policy
+func (f *Files) IsOwner(identity string, policy *WatermarkPolicy) bool {
+	if identity == "" {
+		return false
+	}
+	if identity == f.WSClient {
+		return true
+	}
+	for _, owner := range policy.Owners {
+		if owner == identity {
+			return true
+		}
+	}
+	return false
+}
+
+func policyKey(bucket string) string {
+	return "watermark/" + bucket + ".json"
+}
+
+// GetWatermarkPolicy returns the policy of a bucket or nil if the bucket has none, a
+// policy that can not be read fails the request instead of serving clean files
+func GetWatermarkPolicy(s Storage, bucket string) (*WatermarkPolicy, error) {
+	obj, _, err := s.ReadObject(PolicyBucket, policyKey(bucket))
+	// the policies bucket is created with the first policy
+	if IsNotFound(err) || minio.ToErrorResponse(err).Code == "NoSuchBucket" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	policy := &WatermarkPolicy{}
+	err = json.NewDecoder(obj).Decode(policy)
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// PutWatermarkPolicy validates and stores the policy of a bucket
+func PutWatermarkPolicy(s Storage, bucket string, policy *WatermarkPolicy) (*evmsg.Message, error) {
+	msg := evmsg.NewMessage()
+	msg.State = "Response"
+	err := ValidateTransform([]TransformOp{policy.Op()})
+	if err == nil {
+		err = CheckTransformSources(bucket, []TransformOp{policy.Op()})
+	}
+	if err != nil {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	exists, err := HasBucket(s, PolicyBucket)
+	if err != nil {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	if !exists {
+		if _, err := s.CreateBucket(PolicyBucket); err != nil {
+			msg.Debug.Error = err.Error()
+			return msg, err
+		}
+	}
+	pB, err := json.Marshal(policy)
+	if err != nil {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	fh, err := NewFileHeader(policyKey(bucket), pB)
+	if err != nil {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	err = s.PutObject(PolicyBucket, fh)
+	if err != nil {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	msg.Data = []interface{}{map[string]interface{}{"bucket": bucket, "policy": policy}}
+	return msg, nil
+}
+
+// WatermarkPolicyMessage returns the policy of a bucket for the websocket clients
+func WatermarkPolicyMessage(s Storage, bucket string) (*evmsg.Message, error) {
+	msg := evmsg.NewMessage()
+	msg.State = "Response"
+	policy, err := GetWatermarkPolicy(s, bucket)
+	if err != nil {
+		msg.Debug.Error = err.Error()
+		return msg, err
+	}
+	msg.Data = []interface{}{map[string]interface{}{"bucket": bucket, "policy": policy}}
+	return msg, nil
+}
+
+// RemoveWatermarkPolicy lets a bucket serve clean files again
+func RemoveWatermarkPolicy(s Storage, bucket string) (*evmsg.Message, error) {
+	return s.RemoveObject(PolicyBucket, policyKey(bucket))
+}
+
+// Op returns the transformation step that applies the policy
+func (p *WatermarkPolicy) Op() TransformOp {
+	return TransformOp{Op: "watermark", Text: p.Text, Bucket: p.Bucket, Key: p.Key, Position: p.Position, Opacity: p.Opacity}
+}
+
+// Watermark draws the text or the image of a watermark step onto img
+func Watermark(s Storage, img image.Image, op TransformOp) (image.Image, error) {
+	if op.Text != "" {
+		return Overlay(img, TextMark(op.Text, img.Bounds().Dx()/3), op.Position, op.Opacity), nil
+	}
+	mark, err := loadImage(s, op.Bucket, op.Key)
+	if err != nil {
+		return nil, err
+	}
+	return Overlay(img, mark, op.Position, op.Opacity), nil
+}
+
+// TextMark renders a text with a light outline, scaled to the given width
+func TextMark(text string, width int) image.Image {
+	face := basicfont.Face7x13
+	d := &font.Drawer{Face: face}
+	w := d.MeasureString(text).Ceil() + 2
+	h := face.Metrics().Height.Ceil() + 2
+	mark := image.NewRGBA(image.Rect(0, 0, w, h))
+	for _, o := range []struct {
+		dx, dy int
+		c      color.Color
+	}{{0, 1, color.White}, {2, 1, color.White}, {1, 0, color.White}, {1, 2, color.White}, {1, 1, color.Black}} {
+		d = &font.Drawer{Dst: mark, Src: image.NewUniform(o.c), Face: face}
+		d.Dot = fixed.P(o.dx, o.dy+face.Metrics().Ascent.Ceil())
+		d.DrawString(text)
+	}
+	if width < w {
+		return mark
+	}
+	return resize.Resize(uint(width), 0, mark, resize.NearestNeighbor)
+}
+
+// WatermarkThumbnail marks an encoded thumbnail
+func WatermarkThumbnail(s Storage, thumbnail []byte, file string, policy *WatermarkPolicy) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(thumbnail))
+	if err != nil {
+		return nil, err
+	}
+	marked, err := Watermark(s, img, policy.Op())
+	if err != nil {
+		return nil, err
+	}
+	ext := filepath.Ext(file)
+	if IsDocument(file) || IsMedia(file) {
+		ext = ".png"
+	}
+	return encodeThumbnail(marked, ext)
+}
+
+// CanWatermark reports if the downloads of a file can be marked, other files
+// of buckets with a policy are only served to the owners
+func CanWatermark(file string) bool {
+	_, err := transformFormat(strings.TrimPrefix(filepath.Ext(file), "."))
+	return err == nil
+}
+
+// CheckWatermark returns the policy the downloads of a request have to follow or nil for owners
+func (f *Files) CheckWatermark(r *http.Request, bucket string) (*WatermarkPolicy, error) {
+	return f.WatermarkFor(f.Identity(r), bucket)
+}
+
+// WatermarkFor returns the policy the downloads of an identity have to follow or nil for owners
+func (f *Files) WatermarkFor(identity, bucket string) (*WatermarkPolicy, error) {
+	policy, err := GetWatermarkPolicy(f.WSStorage, bucket)
+	if err != nil || policy == nil {
+		return nil, err
+	}
+	if f.IsOwner(identity, policy) {
+		return nil, nil
+	}
+	return policy, nil
+}
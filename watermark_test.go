@@ -0,0 +1,110 @@
+package files
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_Unit_WatermarkOwners(t *testing.T) {
+	identities := Identities
+	Identities = map[string]string{"alice": "wonderland"}
+	defer func() { Identities = identities }()
+	f := &Files{WSClient: "files", WSSecret: "secret"}
+	policy := &WatermarkPolicy{Text: "preview", Opacity: 0.5, Owners: []string{"alice"}}
+	for _, c := range []struct {
+		name, secret string
+		owner        bool
+	}{
+		{"", "", false},
+		{"alice", "wonderland", true},
+		{"alice", "wrong", false},
+		{"bob", "", false},
+		{"files", "secret", true},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if c.name != "" {
+			r.SetBasicAuth(c.name, c.secret)
+		}
+		if f.IsOwner(f.Identity(r), policy) != c.owner {
+			t.Error("unexpected owner check for", c.name, c.secret)
+		}
+	}
+}
+
+func Test_Unit_WatermarkPolicy(t *testing.T) {
+	s := newMemStorage()
+	policy, err := GetWatermarkPolicy(s, "previews")
+	if err != nil || policy != nil {
+		t.Fatal("a bucket without policy has to serve clean files", err)
+	}
+	if _, err := PutWatermarkPolicy(s, "previews", &WatermarkPolicy{Opacity: 0.5}); err == nil {
+		t.Error("a policy needs a text or an image")
+	}
+	if _, err := PutWatermarkPolicy(s, "previews", &WatermarkPolicy{Text: "preview", Position: "center", Opacity: 0.5}); err != nil {
+		t.Fatal(err)
+	}
+	policy, err = GetWatermarkPolicy(s, "previews")
+	if err != nil || policy == nil || policy.Text != "preview" {
+		t.Fatal("unexpected policy", policy, err)
+	}
+	if !IsInternalBucket(PolicyBucket) {
+		t.Error("the policies must not be listed as a bucket")
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{128}), image.Point{}, draw.Src)
+	marked, err := Watermark(s, img, policy.Op())
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := 0
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 300; x++ {
+			if marked.At(x, y) != img.At(x, y) {
+				changed++
+			}
+		}
+	}
+	if changed == 0 {
+		t.Error("the watermark was not drawn")
+	}
+	if !CanWatermark("shot.JPG") || CanWatermark("report.pdf") {
+		t.Error("only images can be marked")
+	}
+}
+
+// brokenPolicyStorage fails reading the policies bucket
+type brokenPolicyStorage struct {
+	*memStorage
+}
+
+func (s brokenPolicyStorage) ReadObject(bucket, file string) (io.ReadCloser, int64, error) {
+	if bucket == PolicyBucket {
+		return nil, 0, errors.New("connection reset")
+	}
+	return s.memStorage.ReadObject(bucket, file)
+}
+
+func Test_Unit_WatermarkOpacity(t *testing.T) {
+	s := newMemStorage()
+	if _, err := PutWatermarkPolicy(s, "previews", &WatermarkPolicy{Text: "preview", Opacity: 0}); err == nil {
+		t.Error("a policy without opacity draws nothing and has to be rejected")
+	}
+	ops, err := ParseTransformPipeline(`[{"op":"watermark","text":"preview"},{"op":"grayscale"}]`)
+	if err != nil || ops[0].Opacity != WatermarkOpacity || ops[1].Opacity != 0 {
+		t.Error("a watermark without opacity has to get the default", ops, err)
+	}
+	if _, err := ParseTransformPipeline(`[{"op":"watermark","text":"preview","opacity":0}]`); err == nil {
+		t.Error("an opacity of 0 has to be rejected")
+	}
+	if _, err := ParseTransformOps("watermark:previews/logo.png,center,0"); err == nil {
+		t.Error("an opacity of 0 has to be rejected")
+	}
+	if _, err := GetWatermarkPolicy(brokenPolicyStorage{s}, "previews"); err == nil {
+		t.Error("a policy that can not be read must not serve clean files")
+	}
+}
@@ -0,0 +1,515 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v6"
+	"github.com/neko-neko/echo-logrus/v2/log"
+	"golang.org/x/net/webdav"
+)
+
+var WebDAVPath string = ""
+var WebDAVMaxObjectSize int64 = 1 << 30
+
+// WebDAVFolderMarker keeps empty folders alive, object stores only know keys
+const WebDAVFolderMarker = ".folder"
+
+type davIdentity struct{}
+
+// WebDAV returns the WebDAV handler, buckets are the top level collections and
+// prefixes of the keys the folders below them
+func (f *Files) WebDAV() http.Handler {
+	h := &webdav.Handler{
+		Prefix:     WebDAVPath,
+		FileSystem: &davFS{f: f},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Logger().Error(r.Method+" "+r.URL.Path+": ", err)
+			}
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := f.Identity(r)
+		if identity == "" {
+			w.Header().Set("WWW-Authenticate", "Basic realm=\"files\"")
+			http.Error(w, "the WebDAV endpoint needs basic auth!", http.StatusUnauthorized)
+			return
+		}
+		auditIdentity(r.Context(), identity)
+		class := ""
+		switch r.Method {
+		case http.MethodGet:
+			class = RateDownload
+		case http.MethodPut:
+			class = RateUpload
+		}
+		if class != "" {
+			var err error
+			w, err = f.limitRequest(w, r, class, identity)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusTooManyRequests)
+				return
+			}
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		default:
+			if !f.Allowed(identity, PermissionWrite) {
+				http.Error(w, "the request needs the permission <"+PermissionWrite+">!", http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), davIdentity{}, identity)))
+	})
+}
+
+type davInfo struct {
+	name string
+	size int64
+	mod  time.Time
+	dir  bool
+}
+
+func (i *davInfo) Name() string       { return i.name }
+func (i *davInfo) Size() int64        { return i.size }
+func (i *davInfo) ModTime() time.Time { return i.mod }
+func (i *davInfo) IsDir() bool        { return i.dir }
+func (i *davInfo) Sys() interface{}   { return nil }
+
+func (i *davInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ContentType spares the handler to open every file of a PROPFIND
+func (i *davInfo) ContentType(ctx context.Context) (string, error) {
+	if cType := mime.TypeByExtension(path.Ext(i.name)); cType != "" {
+		return cType, nil
+	}
+	return "", webdav.ErrNotImplemented
+}
+
+type davFS struct {
+	f *Files
+}
+
+func davSplit(name string) (string, string) {
+	parts := strings.SplitN(strings.Trim(path.Clean("/"+name), "/"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func davObjectInfo(name string, obj map[string]interface{}) *davInfo {
+	info := &davInfo{name: name, size: s3Size(obj["size"]), mod: time.Now()}
+	if mod, ok := obj["modified"].(time.Time); ok {
+		info.mod = mod
+	}
+	return info
+}
+
+// list returns the objects of a bucket below a prefix
+func (d *davFS) list(ctx context.Context, bucket, prefix string) ([]map[string]interface{}, error) {
+	msg, err := d.f.storageOf(ctx).ListObjects(minio.BucketInfo{Name: bucket}, prefix)
+	if err != nil {
+		return nil, err
+	}
+	objects := []map[string]interface{}{}
+	list, _ := msg.Data.([]interface{})
+	for _, o := range list {
+		obj := o.(map[string]interface{})
+		if strings.HasPrefix(obj["key"].(string), prefix) {
+			objects = append(objects, obj)
+		}
+	}
+	return objects, nil
+}
+
+func (d *davFS) bucket(ctx context.Context, bucket string) error {
+	if IsInternalBucket(bucket) {
+		return os.ErrNotExist
+	}
+	exists, err := HasBucket(d.f.storageOf(ctx), bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	bucket, key := davSplit(name)
+	if bucket == "" {
+		return &davInfo{name: "/", mod: time.Now(), dir: true}, nil
+	}
+	if err := d.bucket(ctx, bucket); err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return &davInfo{name: bucket, mod: time.Now(), dir: true}, nil
+	}
+	objects, err := d.list(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range objects {
+		if obj["key"].(string) == key {
+			return davObjectInfo(path.Base(key), obj), nil
+		}
+	}
+	for _, obj := range objects {
+		if strings.HasPrefix(obj["key"].(string), key+"/") {
+			return &davInfo{name: path.Base(key), mod: time.Now(), dir: true}, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	bucket, key := davSplit(name)
+	if bucket == "" || IsInternalBucket(bucket) {
+		return os.ErrPermission
+	}
+	if _, err := d.Stat(ctx, name); err == nil {
+		return os.ErrExist
+	}
+	if key == "" {
+		_, err := d.f.storageOf(ctx).CreateBucket(bucket)
+		return err
+	}
+	if err := d.bucket(ctx, bucket); err != nil {
+		return err
+	}
+	fh, err := NewFileHeader(key+"/"+WebDAVFolderMarker, []byte{})
+	if err != nil {
+		return err
+	}
+	return d.f.storageOf(ctx).PutObject(bucket, fh)
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	bucket, key := davSplit(name)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		if bucket == "" || key == "" || path.Base(key) == WebDAVFolderMarker {
+			return nil, os.ErrPermission
+		}
+		if err := d.bucket(ctx, bucket); err != nil {
+			return nil, err
+		}
+		info := &davInfo{name: path.Base(key), mod: time.Now()}
+		return &davFile{fs: d, bucket: bucket, key: key, info: info, buff: bytes.NewBuffer(nil), ctx: ctx}, nil
+	}
+	fi, err := d.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	info := fi.(*davInfo)
+	file := &davFile{fs: d, bucket: bucket, key: key, info: info, ctx: ctx}
+	if info.dir {
+		return file, nil
+	}
+	st := d.f.storageOf(ctx)
+	if err := CheckScan(st, bucket, key); err != nil {
+		return nil, os.ErrPermission
+	}
+	identity, _ := ctx.Value(davIdentity{}).(string)
+	policy, err := d.f.WatermarkFor(identity, bucket)
+	if err != nil {
+		return nil, err
+	}
+	if policy != nil {
+		if !CanWatermark(key) {
+			return nil, os.ErrPermission
+		}
+		rc, _, err := Transform(st, bucket, key, []TransformOp{policy.Op()})
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		file.memory, err = ioutil.ReadAll(rc)
+		if err != nil {
+			return nil, err
+		}
+		file.info = &davInfo{name: info.name, size: int64(len(file.memory)), mod: info.mod}
+	}
+	return file, nil
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	bucket, key := davSplit(name)
+	if key == "" {
+		// the storage can not remove buckets
+		return os.ErrPermission
+	}
+	if err := d.bucket(ctx, bucket); err != nil {
+		return err
+	}
+	objects, err := d.list(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	st := d.f.storageOf(ctx)
+	removed := false
+	for _, obj := range objects {
+		k := obj["key"].(string)
+		if k == key || strings.HasPrefix(k, key+"/") {
+			if _, err := st.RemoveObject(bucket, k); err != nil {
+				return err
+			}
+			removed = true
+		}
+	}
+	if !removed {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	srcBucket, srcKey := davSplit(oldName)
+	dstBucket, dstKey := davSplit(newName)
+	if srcKey == "" || dstKey == "" {
+		return os.ErrPermission
+	}
+	if err := d.bucket(ctx, srcBucket); err != nil {
+		return err
+	}
+	if err := d.bucket(ctx, dstBucket); err != nil {
+		return err
+	}
+	objects, err := d.list(ctx, srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+	moved := false
+	for _, obj := range objects {
+		k := obj["key"].(string)
+		switch {
+		case k == srcKey:
+			err = d.move(ctx, srcBucket, k, dstBucket, dstKey)
+		case strings.HasPrefix(k, srcKey+"/"):
+			err = d.move(ctx, srcBucket, k, dstBucket, dstKey+k[len(srcKey):])
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		moved = true
+	}
+	if !moved {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// move stores an object under its new name with its description and tags and removes the old one,
+// non-owners can not move the clean originals out of a bucket with a watermark policy
+func (d *davFS) move(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string) error {
+	s := d.f.storageOf(ctx)
+	if path.Base(srcKey) != WebDAVFolderMarker {
+		if err := CheckScan(s, srcBucket, srcKey); err != nil {
+			return os.ErrPermission
+		}
+	}
+	if srcBucket != dstBucket {
+		identity, _ := ctx.Value(davIdentity{}).(string)
+		policy, err := d.f.WatermarkFor(identity, srcBucket)
+		if err != nil {
+			return err
+		}
+		if policy != nil {
+			return os.ErrPermission
+		}
+	}
+	rc, _, err := s.ReadObject(srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	fh, err := NewFileHeader(dstKey, data)
+	if err != nil {
+		return err
+	}
+	if path.Base(dstKey) == WebDAVFolderMarker {
+		err = s.PutObject(dstBucket, fh)
+	} else {
+		meta, _ := GetMeta(s, srcKey)
+		_, err = d.f.Upload(ctx, dstBucket, fh, "", meta["description"], meta["tags"])
+	}
+	if err != nil {
+		return err
+	}
+	meta, _ := GetMeta(s, dstKey)
+	if _, err := s.RemoveObject(srcBucket, srcKey); err != nil {
+		return err
+	}
+	if srcKey == dstKey && len(meta) > 0 {
+		// the meta information is stored by key, the removal took it with it
+		return PutMeta(s, dstKey, meta)
+	}
+	return nil
+}
+
+// davFile is a folder, an object opened for reading or a new object buffered until it is closed
+type davFile struct {
+	fs     *davFS
+	bucket string
+	key    string
+	info   *davInfo
+	buff   *bytes.Buffer
+	memory []byte
+	rc     io.ReadCloser
+	pos    int64
+	rpos   int64
+	// ctx is the request that opened the file, it traces the reads and the upload on Close
+	ctx context.Context
+}
+
+func (d *davFile) Stat() (os.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.info.dir {
+		return nil, os.ErrInvalid
+	}
+	infos := []os.FileInfo{}
+	if d.bucket == "" {
+		msg, err := d.fs.f.storageOf(d.ctx).ListBuckets()
+		if err != nil {
+			return nil, err
+		}
+		list, _ := msg.Data.([]interface{})
+		for _, b := range list {
+			name := b.(map[string]interface{})["name"].(string)
+			if !IsInternalBucket(name) {
+				infos = append(infos, &davInfo{name: name, mod: time.Now(), dir: true})
+			}
+		}
+	} else {
+		prefix := ""
+		if d.key != "" {
+			prefix = d.key + "/"
+		}
+		objects, err := d.fs.list(d.ctx, d.bucket, prefix)
+		if err != nil {
+			return nil, err
+		}
+		folders := map[string]bool{}
+		for _, obj := range objects {
+			rest := obj["key"].(string)[len(prefix):]
+			if i := strings.Index(rest, "/"); i >= 0 {
+				if !folders[rest[:i]] {
+					folders[rest[:i]] = true
+					infos = append(infos, &davInfo{name: rest[:i], mod: time.Now(), dir: true})
+				}
+				continue
+			}
+			if rest != WebDAVFolderMarker {
+				infos = append(infos, davObjectInfo(rest, obj))
+			}
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	if count > 0 && len(infos) > count {
+		infos = infos[:count]
+	}
+	return infos, nil
+}
+
+func (d *davFile) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos += d.pos
+	case io.SeekEnd:
+		pos += d.info.size
+	}
+	if pos < 0 {
+		return d.pos, errors.New("the position <" + path.Base(d.key) + "> is before the start of the file!")
+	}
+	d.pos = pos
+	return pos, nil
+}
+
+// Read streams the object, seeking reopens the stream at the new position
+func (d *davFile) Read(p []byte) (int, error) {
+	if d.info.dir || d.buff != nil {
+		return 0, os.ErrInvalid
+	}
+	if d.memory != nil {
+		if d.pos >= int64(len(d.memory)) {
+			return 0, io.EOF
+		}
+		n := copy(p, d.memory[d.pos:])
+		d.pos += int64(n)
+		return n, nil
+	}
+	if d.rc == nil || d.rpos != d.pos {
+		if d.rc != nil {
+			d.rc.Close()
+		}
+		rc, _, err := d.fs.f.storageOf(d.ctx).ReadObject(d.bucket, d.key)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := io.CopyN(ioutil.Discard, rc, d.pos); err != nil {
+			rc.Close()
+			return 0, err
+		}
+		d.rc, d.rpos = rc, d.pos
+	}
+	n, err := d.rc.Read(p)
+	d.pos += int64(n)
+	d.rpos += int64(n)
+	return n, err
+}
+
+func (d *davFile) Write(p []byte) (int, error) {
+	if d.buff == nil {
+		return 0, os.ErrInvalid
+	}
+	if int64(d.buff.Len()+len(p)) > WebDAVMaxObjectSize {
+		return 0, errors.New("the file <" + d.key + "> is too large!")
+	}
+	return d.buff.Write(p)
+}
+
+// Close uploads a written file through the same checks as the objects route
+func (d *davFile) Close() error {
+	if d.rc != nil {
+		return d.rc.Close()
+	}
+	if d.buff == nil {
+		return nil
+	}
+	fh, err := NewFileHeader(d.key, d.buff.Bytes())
+	if err != nil {
+		return err
+	}
+	meta, _ := GetMeta(d.fs.f.storageOf(d.ctx), d.key)
+	_, err = d.fs.f.Upload(d.ctx, d.bucket, fh, "", meta["description"], meta["tags"])
+	return err
+}
@@ -0,0 +1,120 @@
+package files
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func davDo(h http.Handler, method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.SetBasicAuth("files", "secret")
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func Test_Unit_WebDAV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheDir, davPath := MinioFilesCacheDir, WebDAVPath
+	MinioFilesCacheDir, WebDAVPath = dir, "/dav"
+	defer func() { MinioFilesCacheDir, WebDAVPath = cacheDir, davPath }()
+	s := newMemStorage()
+	h := (&Files{WSStorage: s, WSClient: "files", WSSecret: "secret"}).WebDAV()
+
+	r := httptest.NewRequest("PROPFIND", "/dav/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Error("anonymous requests have to be rejected", w.Code)
+	}
+	for _, c := range []struct {
+		method, target, body string
+		header               map[string]string
+		status               int
+	}{
+		{"MKCOL", "/dav/docs", "", nil, http.StatusCreated},
+		{"MKCOL", "/dav/docs/drafts", "", nil, http.StatusCreated},
+		{"PUT", "/dav/docs/drafts/a.txt", "hello", nil, http.StatusCreated},
+		{"PUT", "/dav/docs/tool.exe", "MZ", nil, http.StatusMethodNotAllowed},
+		{"MOVE", "/dav/docs/drafts/a.txt", "", map[string]string{"Destination": "/dav/docs/final/a.txt"}, http.StatusCreated},
+		{"COPY", "/dav/docs/final/a.txt", "", map[string]string{"Destination": "/dav/docs/b.txt"}, http.StatusCreated},
+	} {
+		if w := davDo(h, c.method, c.target, c.body, c.header); w.Code != c.status {
+			t.Fatal(c.method, c.target, w.Code, w.Body.String())
+		}
+	}
+	if string(s.objects["docs"]["final/a.txt"]) != "hello" || s.objects["docs"]["drafts/a.txt"] != nil {
+		t.Error("the object was not moved", s.objects["docs"])
+	}
+	w = davDo(h, "PROPFIND", "/dav/docs/", "", map[string]string{"Depth": "1"})
+	if w.Code != http.StatusMultiStatus {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	for _, href := range []string{"/dav/docs/drafts/", "/dav/docs/final/", "/dav/docs/b.txt"} {
+		if !strings.Contains(w.Body.String(), "<D:href>"+href+"</D:href>") {
+			t.Error("missing", href, "in", w.Body.String())
+		}
+	}
+	if strings.Contains(w.Body.String(), WebDAVFolderMarker) {
+		t.Error("the folder markers have to be hidden")
+	}
+	if w = davDo(h, "GET", "/dav/docs/b.txt", "", map[string]string{"Range": "bytes=1-3"}); w.Body.String() != "ell" {
+		t.Error("unexpected content", w.Code, w.Body.String())
+	}
+	if w = davDo(h, "DELETE", "/dav/docs/final", "", nil); w.Code != http.StatusNoContent || s.objects["docs"]["final/a.txt"] != nil {
+		t.Error("unexpected delete", w.Code)
+	}
+	if w = davDo(h, "PROPFIND", "/dav/meta/", "", map[string]string{"Depth": "1"}); w.Code != http.StatusNotFound {
+		t.Error("the internal buckets must not be reachable", w.Code)
+	}
+}
+
+func Test_Unit_WebDAVMoveWatermarked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheDir, davPath, identities := MinioFilesCacheDir, WebDAVPath, Identities
+	MinioFilesCacheDir, WebDAVPath, Identities = dir, "/dav", map[string]string{"alice": "wonderland"}
+	defer func() { MinioFilesCacheDir, WebDAVPath, Identities = cacheDir, davPath, identities }()
+	s := newMemStorage()
+	s.put("previews", "shot.png", []byte("clean"))
+	s.put("open", "x.txt", []byte("x"))
+	if _, err := PutWatermarkPolicy(s, "previews", &WatermarkPolicy{Text: "preview", Opacity: 0.5}); err != nil {
+		t.Fatal(err)
+	}
+	h := (&Files{WSStorage: s, WSClient: "files", WSSecret: "secret"}).WebDAV()
+	move := func(identity, secret, target string) int {
+		r := httptest.NewRequest("MOVE", "/dav/previews/shot.png", nil)
+		r.SetBasicAuth(identity, secret)
+		r.Header.Set("Destination", target)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := move("alice", "wonderland", "/dav/open/shot.png"); code != http.StatusForbidden {
+		t.Error("non-owners must not move the clean original out of the bucket", code)
+	}
+	if s.objects["open"]["shot.png"] != nil || string(s.objects["previews"]["shot.png"]) != "clean" {
+		t.Error("the original has to stay in place", s.objects)
+	}
+	if code := move("alice", "wonderland", "/dav/previews/renamed.png"); code != http.StatusCreated {
+		t.Error("renames inside the bucket keep the policy and are allowed", code)
+	}
+	s.objects["previews"]["shot.png"] = []byte("clean")
+	if code := move("files", "secret", "/dav/open/shot.png"); code != http.StatusCreated {
+		t.Error("owners may move their files", code)
+	}
+}
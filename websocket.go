@@ -1,29 +1,25 @@
 package files
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
-	"fmt"
-	"io"
-	"mime/multipart"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	//"crypto/subtle"
-	"io/ioutil"
 	//"net/textproto"
-	"path/filepath"
 
 	"evalgo.org/evmsg"
 	echo "github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	echoLog "github.com/labstack/gommon/log"
-	"github.com/minio/minio-go/v6"
 	"github.com/neko-neko/echo-logrus/v2/log"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/net/websocket"
 )
 
 type Files struct {
@@ -32,6 +28,19 @@ type Files struct {
 	WSSecret  string
 	WSWebroot string
 	WSStorage Storage
+	WSScanner Scanner
+	WSAudit   *AuditLog
+
+	wsMu      sync.Mutex
+	wsConns   map[*wsConn]struct{}
+	wsClients map[string]int
+	wsStats   WSStats
+	wsClosing bool
+
+	rlMu       sync.Mutex
+	rlBuckets  map[string]*tokenBucket
+	rlSwept    time.Time
+	imageSlots chan struct{}
 }
 
 func New() *Files {
@@ -46,14 +55,55 @@ func (f *Files) ConnectStorage(sType string, connInfo map[string]string) error {
 		if err != nil {
 			return err
 		}
-		fmt.Println(err, m)
-		f.WSStorage = m
+		err = m.InitCache()
+		if err != nil {
+			return err
+		}
+		if EncryptionKeyFile != "" {
+			master, err := LoadMasterKey(EncryptionKeyFile)
+			if err != nil {
+				return err
+			}
+			m.Crypt, err = NewCrypt(m, master)
+			if err != nil {
+				return err
+			}
+		}
+		f.WSStorage = NewMeteredStorage(m)
+		if err := createBuckets(m, RequiredBuckets()); err != nil {
+			// MinIO may not be reachable yet, the readiness reports the missing buckets until it is
+			log.Logger().Error(err)
+			go ensureBuckets(m, RequiredBuckets())
+		}
+		if DedupEnabled {
+			f.WSStorage = NewDedup(f.WSStorage)
+		}
+		if SearchIndexFile != "" {
+			index := NewIndex(f.WSStorage, SearchIndexFile)
+			err = index.Load()
+			if err != nil {
+				return err
+			}
+			f.WSStorage = index
+		}
 		return nil
 	}
 	return errors.New("the given storage type <" + sType + "> is not supported!")
 }
 
-func (f *Files) Start(address, client, secret, webroot string) error {
+func jsonError(c echo.Context, status int, err error) error {
+	msg := evmsg.NewMessage()
+	msg.State = "Response"
+	msg.Debug.Error = err.Error()
+	mB, _ := json.Marshal(msg)
+	c.Response().Header().Set("Content-Type", "application/json")
+	c.Response().WriteHeader(status)
+	c.Response().Write(mB)
+	return err
+}
+
+// Start serves the service until the context ends, then it shuts down gracefully
+func (f *Files) Start(ctx context.Context, address, client, secret, webroot string) error {
 	f.WSAddress = address
 	f.WSClient = client
 	f.WSSecret = secret
@@ -67,6 +117,8 @@ func (f *Files) Start(address, client, secret, webroot string) error {
 	e.Logger = log.Logger()
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
+	e.Use(Metrics)
+	e.Use(Tracing)
 	/*e.Use(middleware.BasicAuth(
 		func(username, password string, c echo.Context) (bool, error) {
 			if subtle.ConstantTimeCompare([]byte(username), []byte("files")) == 1 &&
@@ -76,207 +128,205 @@ func (f *Files) Start(address, client, secret, webroot string) error {
 			return false, nil
 		}),
 	)*/
+	if WebDAVPath != "" {
+		// the router of echo does not know the WebDAV methods
+		dav := instrument("webdav", traced("webdav", f.audited("webdav", WebDAVPath, f.WebDAV())))
+		e.Pre(func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				p := c.Request().URL.Path
+				if p == WebDAVPath || strings.HasPrefix(p, WebDAVPath+"/") {
+					dav.ServeHTTP(c.Response(), c.Request())
+					return nil
+				}
+				return next(c)
+			}
+		})
+	}
+	if MetricsPath != "" {
+		e.GET(MetricsPath, echo.WrapHandler(MetricsHandler()))
+	}
+	f.RegisterHealth(e)
+	f.RegisterDebug(e)
 	e.Static("/", webroot)
 	e.GET("/v0.0.1/files/buckets/:bucket/objects/:object", func(c echo.Context) error {
-		msg, err := f.WSStorage.GetObject(c.Param("bucket"), c.Param("object"))
+		return f.serveObject(c, c.Param("bucket"), c.Param("object"))
+	}, f.Audit("Object/download"), f.RateLimit(RateDownload))
+	e.POST("/v0.0.1/files/buckets/:bucket/objects", func(c echo.Context) error {
+		return f.handleUpload(c, c.Param("bucket"))
+	}, f.Audit("Object/upload"), f.RateLimit(RateUpload))
+	f.RegisterREST(e)
+	e.GET("/v0.0.1/files/buckets/:bucket/thumbnails/:object", func(c echo.Context) error {
+		s := f.storageOf(c.Request().Context())
+		err := CheckBucket(c.Param("bucket"))
+		if err == nil {
+			err = CheckScan(s, c.Param("bucket"), c.Param("object"))
+		}
 		if err != nil {
-			c.Response().WriteHeader(http.StatusInternalServerError)
-			c.Response().Write([]byte(err.Error()))
-			return err
+			return jsonError(c, http.StatusForbidden, err)
+		}
+		policy, err := f.CheckWatermark(c.Request(), c.Param("bucket"))
+		if err != nil {
+			return jsonError(c, http.StatusInternalServerError, err)
 		}
-		c.Logger().Info(msg.Data.([]interface{})[0].(map[string]interface{})["path"].(string))
-		tmpFile := filepath.Base(msg.Data.([]interface{})[0].(map[string]interface{})["path"].(string))
-		cacheFilePath := MinioFilesCacheDir + string(os.PathSeparator) + tmpFile
-		resp, err := ioutil.ReadFile(cacheFilePath)
+		release, err := f.imageSlot(c.Request().Context())
 		if err != nil {
-			c.Response().WriteHeader(http.StatusInternalServerError)
-			c.Response().Write([]byte(err.Error()))
 			return err
 		}
-		c.Response().WriteHeader(http.StatusOK)
-		c.Response().Write(resp)
-		return nil
-	})
-	e.POST("/v0.0.1/files/buckets/:bucket/objects", func(c echo.Context) error {
-		file, err := c.FormFile("file")
+		tBytes, err := s.GetThumbnail(c.Param("bucket"), c.Param("object"))
+		release()
 		if err != nil {
 			return err
 		}
-		switch strings.ToLower(filepath.Ext(file.Filename)) {
-		case ".jpg", ".jpeg", ".png":
-			// found the right extensions that are supported
-		default:
-			// everything else is not supported
-			err = errors.New("the given extension <" + strings.ToLower(filepath.Ext(file.Filename)) + "> is not supported!")
-			c.Response().WriteHeader(http.StatusInternalServerError)
-			c.Response().Header().Set("Content-Type", "application/json")
-			msg := evmsg.NewMessage()
-			msg.State = "Response"
-			msg.Debug.Error = err.Error()
-			mB, _ := json.Marshal(msg)
-			c.Response().Write(mB)
+		if policy != nil {
+			tBytes, err = WatermarkThumbnail(s, tBytes, c.Param("object"), policy)
 			if err != nil {
-				return err
+				return jsonError(c, http.StatusInternalServerError, err)
 			}
-			return err
 		}
-		err = f.WSStorage.PutObject(c.Param("bucket"), file)
-		if err != nil {
-			return err
+		c.Response().Write(tBytes)
+		return nil
+	}, f.Audit("Object/thumbnail"), f.RateLimit(RateRendition))
+	e.GET(TransformFilePath, func(c echo.Context) error {
+		s := f.storageOf(c.Request().Context())
+		err := CheckBucket(c.Param("bucket"))
+		if err == nil {
+			err = CheckScan(s, c.Param("bucket"), c.Param("object"))
 		}
-		infoFile := strings.Replace(file.Filename, filepath.Ext(file.Filename), ".json", 1)
-		infoMap := map[string]string{"name": file.Filename, "description": c.Request().FormValue("description")}
-		iB, err := json.Marshal(infoMap)
 		if err != nil {
-			return err
+			return jsonError(c, http.StatusForbidden, err)
 		}
-		buff := bytes.NewBuffer(nil)
-		mw := multipart.NewWriter(buff)
-		err = mw.SetBoundary("myBoundary")
-		if err != nil {
-			return err
+		var pipeline []TransformOp
+		if c.QueryParam("pipeline") != "" {
+			pipeline, err = ParseTransformPipeline(c.QueryParam("pipeline"))
+		} else {
+			pipeline, err = ParseTransformOps(c.QueryParam("ops"))
+		}
+		if err == nil {
+			err = CheckTransformSources(c.Param("bucket"), pipeline)
 		}
-		mf, err := mw.CreateFormFile("file", infoFile)
 		if err != nil {
-			return err
+			return jsonError(c, http.StatusBadRequest, err)
 		}
-		mf.Write(iB)
-		mw.Close()
-		mr := multipart.NewReader(buff, "myBoundary")
-		form, err := mr.ReadForm(32 << 20)
+		expires, _ := strconv.ParseInt(c.QueryParam("expires"), 10, 64)
+		err = VerifyTransform(c.Param("bucket"), c.Param("object"), pipeline, expires, c.QueryParam("sig"))
 		if err != nil {
-			return err
+			return jsonError(c, http.StatusForbidden, err)
 		}
-		err = f.WSStorage.PutObject("meta", form.File["file"][0])
+		policy, err := f.CheckWatermark(c.Request(), c.Param("bucket"))
 		if err != nil {
-			return err
+			return jsonError(c, http.StatusInternalServerError, err)
 		}
-		msg, err := f.WSStorage.GetObject(c.Param("bucket"), file.Filename)
+		if policy != nil {
+			// the mark is applied last so no step of the pipeline can remove it
+			pipeline = append(pipeline, policy.Op())
+		}
+		release, err := f.imageSlot(c.Request().Context())
 		if err != nil {
 			return err
 		}
-		mB, err := json.Marshal(msg)
+		rc, cType, err := Transform(s, c.Param("bucket"), c.Param("object"), pipeline)
+		release()
 		if err != nil {
-			return err
+			return jsonError(c, http.StatusInternalServerError, err)
 		}
-		c.Response().WriteHeader(http.StatusOK)
-		c.Response().Header().Set("Content-Type", "application/json")
-		c.Response().Write(mB)
-		return nil
-	})
-	e.GET("/v0.0.1/files/buckets/:bucket/thumbnails/:object", func(c echo.Context) error {
-		tBytes, err := f.WSStorage.GetThumbnail(c.Param("bucket"), c.Param("object"))
+		defer rc.Close()
+		return c.Stream(http.StatusOK, cType, rc)
+	}, f.Audit("Object/transform"), f.RateLimit(RateRendition))
+	e.GET(ArchiveFilePath, f.serveArchive, f.Audit("Bucket/archive"), f.RateLimit(RateDownload))
+	e.GET("/v0.0.1/ws", echo.WrapHandler(f.WebsocketHandler()))
+	if err := StartTracing(); err != nil {
+		return err
+	}
+	var tlsConfig *tls.Config
+	if TLSCertFile != "" {
+		var err error
+		tlsConfig, err = TLSConfig()
 		if err != nil {
 			return err
 		}
-		c.Response().Write(tBytes)
-		return nil
-	})
-	e.GET("/v0.0.1/ws", func(c echo.Context) error {
-		s := websocket.Server{
-			Handler: websocket.Handler(func(ws *websocket.Conn) {
-				defer ws.Close()
-			WEBSOCKET:
-				for {
-					var msg evmsg.Message
-					err := websocket.JSON.Receive(ws, &msg)
-					if err != nil {
-						c.Logger().Error(err)
-						if err == io.EOF {
-							c.Logger().Info("websocket client closed connection!")
-							return
-						}
-					}
-					err = evmsg.Auth(&msg)
-					if err != nil {
-						c.Logger().Error(err)
-						err = websocket.JSON.Send(ws, &msg)
-						if err != nil {
-							c.Logger().Error(err)
-						}
-						continue WEBSOCKET
-					}
-					switch msg.Scope {
-					case "Object":
-						msg.State = "Response"
-						switch msg.Command {
-						case "delete":
-							err = evmsg.CheckRequiredKeys(&msg, []string{"bucket", "file"})
-							if err != nil {
-								c.Logger().Error(err)
-								msg.Debug.Error = err.Error()
-							} else {
-								nMsg, err := f.WSStorage.RemoveObject(msg.Value("bucket").(string), msg.Value("file").(string))
-								if err != nil {
-									c.Logger().Error(err)
-								}
-								msg = *nMsg
-							}
-						case "get":
-							err = evmsg.CheckRequiredKeys(&msg, []string{"bucket", "file"})
-							if err != nil {
-								c.Logger().Error(err)
-								msg.Debug.Error = err.Error()
-							} else {
-								nMsg, err := f.WSStorage.GetObject(msg.Value("bucket").(string), msg.Value("file").(string))
-								if err != nil {
-									c.Logger().Error(err)
-								}
-								msg = *nMsg
-							}
-						case "getList":
-							err = evmsg.CheckRequiredKeys(&msg, []string{"bucket", "prefix"})
-							if err != nil {
-								c.Logger().Error(err)
-								msg.Debug.Error = err.Error()
-							} else {
-								nMsg, err := f.WSStorage.ListObjects(minio.BucketInfo{Name: msg.Value("bucket").(string)}, msg.Value("prefix").(string))
-								if err != nil {
-									c.Logger().Error(err)
-								}
-								msg = *nMsg
-							}
-
-						}
+	}
+	server := e.Server
+	if tlsConfig != nil {
+		server = e.TLSServer
+		server.TLSConfig = tlsConfig
+	}
+	server.Addr = address
+	servers := []*http.Server{server}
+	errs := make(chan error, 3)
+	go func() {
+		errs <- e.StartServer(server)
+	}()
+	if S3Address != "" {
+		s3 := &http.Server{Addr: S3Address, Handler: instrument("s3", traced("s3", f.audited("s3", "", f.S3()))), TLSConfig: tlsConfig}
+		servers = append(servers, s3)
+		go func() {
+			e.Logger.Info("starting the S3 facade at " + S3Address)
+			if tlsConfig != nil {
+				errs <- s3.ListenAndServeTLS("", "")
+				return
+			}
+			errs <- s3.ListenAndServe()
+		}()
+	}
+	if tlsConfig != nil && TLSRedirectAddress != "" {
+		redirect := &http.Server{Addr: TLSRedirectAddress, Handler: RedirectHandler(address)}
+		servers = append(servers, redirect)
+		go func() {
+			e.Logger.Info("redirecting " + TLSRedirectAddress + " to TLS")
+			errs <- redirect.ListenAndServe()
+		}()
+	}
+	var err error
+	select {
+	case err = <-errs:
+		e.Logger.Error(err)
+	case <-ctx.Done():
+	}
+	if sErr := f.Shutdown(servers...); err == nil {
+		err = sErr
+	}
+	return err
+}
 
-					case "Bucket":
-						msg.State = "Response"
-						switch msg.Command {
-						case "create":
-							err = evmsg.CheckRequiredKeys(&msg, []string{"bucket"})
-							if err != nil {
-								c.Logger().Error(err)
-								msg.Debug.Error = err.Error()
-							} else {
-								nMsg, err := f.WSStorage.CreateBucket(msg.Value("bucket").(string))
-								if err != nil {
-									c.Logger().Error(err)
-								}
-								msg = *nMsg
-							}
-						case "getList":
-							nMsg, err := f.WSStorage.ListBuckets()
-							if err != nil {
-								c.Logger().Error(err)
-								msg.Debug.Error = err.Error()
-							} else {
-								msg = *nMsg
-							}
-						}
-					}
-					// send msg response
-					err = websocket.JSON.Send(ws, &msg)
-					if err != nil {
-						c.Logger().Error(err)
-					}
-				}
-			}),
-			Handshake: func(*websocket.Config, *http.Request) error {
-				return nil
-			},
+// serveArchive streams the objects of a bucket as one archive, the explicit keys are
+// checked before the headers are sent
+func (f *Files) serveArchive(c echo.Context) error {
+	format := c.QueryParam("format")
+	cType, ext, err := ArchiveContentType(format)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := CheckBucket(c.Param("bucket")); err != nil {
+		return jsonError(c, http.StatusForbidden, err)
+	}
+	s := f.storageOf(c.Request().Context())
+	keys := c.QueryParams()["keys"]
+	entries, err := ArchiveKeys(s, c.Param("bucket"), c.QueryParam("prefix"), keys)
+	if err != nil {
+		if cErr, ok := err.(*CommandError); ok {
+			return jsonError(c, cErr.Status, err)
 		}
-		s.ServeHTTP(c.Response(), c.Request())
-		return nil
-	})
-	return e.Start(address)
+		return jsonError(c, http.StatusInternalServerError, err)
+	}
+	policy, err := f.CheckWatermark(c.Request(), c.Param("bucket"))
+	if err != nil {
+		return jsonError(c, http.StatusInternalServerError, err)
+	}
+	if policy != nil {
+		return jsonError(c, http.StatusForbidden, errors.New("the archives of <"+c.Param("bucket")+"> are only available to the owners of the bucket!"))
+	}
+	for _, entry := range entries {
+		if err := CheckScan(s, c.Param("bucket"), entry.Key); err != nil {
+			return jsonError(c, http.StatusForbidden, err)
+		}
+	}
+	c.Response().Header().Set("Content-Type", cType)
+	c.Response().Header().Set("Content-Disposition", "attachment; filename=\""+c.Param("bucket")+ext+"\"")
+	c.Response().WriteHeader(http.StatusOK)
+	err = WriteArchive(c.Response(), s, format, c.Param("bucket"), entries, c.QueryParam("manifest") == "true")
+	if err != nil {
+		// the headers are already sent, the client receives a truncated archive
+		c.Logger().Error(err)
+	}
+	return nil
 }
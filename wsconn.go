@@ -0,0 +1,493 @@
+package files
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"evalgo.org/evmsg"
+	echo "github.com/labstack/echo/v4"
+	"github.com/neko-neko/echo-logrus/v2/log"
+	"golang.org/x/net/websocket"
+)
+
+var (
+	// WSMaxInFlight bounds the requests of a websocket connection that run at the same time
+	WSMaxInFlight int = 8
+	// WSAllowedOrigins are the origins browsers may connect from, empty allows the host of the service, * allows all
+	WSAllowedOrigins []string
+	// WSMaxConnsPerClient bounds the connections of an identity or an address, 0 disables the limit
+	WSMaxConnsPerClient int = 16
+	// WSPingInterval is the time between the pings of a connection, 0 disables them
+	WSPingInterval time.Duration = 30 * time.Second
+	// WSIdleTimeout closes connections that sent nothing, not even a pong, for this long
+	WSIdleTimeout time.Duration = 90 * time.Second
+	// WSMaxMessageSize bounds the size of a message
+	WSMaxMessageSize int = 1 << 20
+)
+
+// WSStats counts the websocket connections of the service
+type WSStats struct {
+	Open     int64 `json:"open"`
+	Accepted int64 `json:"accepted"`
+	Rejected int64 `json:"rejected"`
+	Messages int64 `json:"messages"`
+	TooLarge int64 `json:"tooLarge"`
+	Idle     int64 `json:"idle"`
+}
+
+// wsMessage is a message of the websocket protocol, the request id is echoed in the response,
+// the traceparent continues the trace of the client
+type wsMessage struct {
+	evmsg.Message
+	RequestID   string `json:"requestId,omitempty"`
+	Traceparent string `json:"traceparent,omitempty"`
+}
+
+// wsConn runs the requests of one websocket connection concurrently, the
+// responses are sent in the order the requests finish
+type wsConn struct {
+	f      *Files
+	ws     *websocket.Conn
+	logger echo.Logger
+	send   sync.Mutex
+	// pending bounds the requests read but not answered, running the ones executing
+	pending chan struct{}
+	running chan struct{}
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+	wg      sync.WaitGroup
+	// closing is closed when the service drains the connection or the peer went idle
+	closing   chan struct{}
+	closeOnce sync.Once
+	activity  *wsActivity
+	stop      context.CancelFunc
+	// client is the identity or the address the limits count for
+	client string
+	// the keepalive settings of the connection, taken when it opens
+	pingInterval time.Duration
+	idleTimeout  time.Duration
+}
+
+func newWSConn(f *Files, ws *websocket.Conn, logger echo.Logger) *wsConn {
+	max := WSMaxInFlight
+	if max < 1 {
+		max = 1
+	}
+	return &wsConn{
+		f:       f,
+		ws:      ws,
+		logger:  logger,
+		pending: make(chan struct{}, max*4),
+		running: make(chan struct{}, max),
+		cancels: map[string]context.CancelFunc{},
+		closing: make(chan struct{}),
+
+		pingInterval: WSPingInterval,
+		idleTimeout:  WSIdleTimeout,
+	}
+}
+
+// wsActivity records the last read of a hijacked connection, the pongs included
+type wsActivity struct {
+	net.Conn
+	last int64
+}
+
+func (a *wsActivity) Read(b []byte) (int, error) {
+	n, err := a.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&a.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (a *wsActivity) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.last)))
+}
+
+// wsHijacker hands the websocket server a connection that records its activity,
+// the server reads the pongs itself so they are only visible on the connection
+type wsHijacker struct {
+	http.ResponseWriter
+	activity *wsActivity
+}
+
+func (h *wsHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := h.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	h.activity.Conn = conn
+	atomic.StoreInt64(&h.activity.last, time.Now().UnixNano())
+	var r io.Reader = h.activity
+	if n := brw.Reader.Buffered(); n > 0 {
+		buffered, _ := brw.Reader.Peek(n)
+		r = io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), h.activity)
+	}
+	return h.activity, bufio.NewReadWriter(bufio.NewReader(r), bufio.NewWriter(h.activity)), nil
+}
+
+// checkOrigin allows clients without an origin, browsers only from the allowed origins
+func checkOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	config.Origin = u
+	if len(WSAllowedOrigins) == 0 {
+		if u.Host == r.Host {
+			return nil
+		}
+	}
+	for _, allowed := range WSAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return nil
+		}
+	}
+	return errors.New("the origin <" + origin + "> is not allowed!")
+}
+
+// WebsocketHandler accepts the websocket connections of the service
+func (f *Files) WebsocketHandler() http.Handler {
+	s := websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			err := checkOrigin(config, r)
+			if err != nil {
+				f.wsCount(func(stats *WSStats) { stats.Rejected++ })
+				log.Logger().Error(err)
+			}
+			return err
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := f.clientOf(r)
+		if err := f.wsAcquire(client); err != nil {
+			log.Logger().Error(err)
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		defer f.wsRelease(client)
+		activity := &wsActivity{}
+		s.Handler = func(ws *websocket.Conn) {
+			defer ws.Close()
+			ws.MaxPayloadBytes = WSMaxMessageSize
+			c := newWSConn(f, ws, log.Logger())
+			c.activity = activity
+			c.client = client
+			ctx, cancel := context.WithCancel(contextWithClient(r.Context(), r))
+			defer cancel()
+			c.stop = cancel
+			f.wsTrack(c, true)
+			defer f.wsTrack(c, false)
+			go c.keepalive(ctx)
+			c.serve(ctx)
+		}
+		s.ServeHTTP(&wsHijacker{ResponseWriter: w, activity: activity}, r)
+	})
+}
+
+func (f *Files) wsCount(count func(stats *WSStats)) {
+	f.wsMu.Lock()
+	defer f.wsMu.Unlock()
+	count(&f.wsStats)
+}
+
+// wsAcquire reserves a connection of a client
+func (f *Files) wsAcquire(client string) error {
+	f.wsMu.Lock()
+	defer f.wsMu.Unlock()
+	if f.wsClosing {
+		f.wsStats.Rejected++
+		return errors.New("the service is shutting down!")
+	}
+	if f.wsClients == nil {
+		f.wsClients = map[string]int{}
+	}
+	if WSMaxConnsPerClient > 0 && f.wsClients[client] >= WSMaxConnsPerClient {
+		f.wsStats.Rejected++
+		return errors.New("the client <" + client + "> has too many websocket connections!")
+	}
+	f.wsClients[client]++
+	return nil
+}
+
+func (f *Files) wsRelease(client string) {
+	f.wsMu.Lock()
+	defer f.wsMu.Unlock()
+	f.wsClients[client]--
+	if f.wsClients[client] <= 0 {
+		delete(f.wsClients, client)
+	}
+}
+
+func (f *Files) wsTrack(c *wsConn, open bool) {
+	f.wsMu.Lock()
+	defer f.wsMu.Unlock()
+	if f.wsConns == nil {
+		f.wsConns = map[*wsConn]struct{}{}
+	}
+	if open {
+		f.wsConns[c] = struct{}{}
+		f.wsStats.Accepted++
+		f.wsStats.Open++
+		wsConnections.add(1)
+		return
+	}
+	delete(f.wsConns, c)
+	f.wsStats.Open--
+	wsConnections.add(-1)
+}
+
+// WebsocketStats returns the counters of the websocket connections
+func (f *Files) WebsocketStats() WSStats {
+	f.wsMu.Lock()
+	defer f.wsMu.Unlock()
+	return f.wsStats
+}
+
+// CloseWebsockets stops reading from the open connections and lets their requests drain,
+// the requests still running when the context ends are canceled, then the connections get a close frame
+func (f *Files) CloseWebsockets(ctx context.Context) error {
+	f.wsMu.Lock()
+	f.wsClosing = true
+	conns := []*wsConn{}
+	for c := range f.wsConns {
+		conns = append(conns, c)
+	}
+	f.wsMu.Unlock()
+	for _, c := range conns {
+		c.drain()
+	}
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if f.WebsocketStats().Open <= 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			for _, c := range conns {
+				if c.stop != nil {
+					c.stop()
+				}
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// drain stops reading, serve answers the requests in flight before the connection is closed
+func (c *wsConn) drain() {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+		c.ws.SetReadDeadline(time.Now())
+	})
+}
+
+func (c *wsConn) isClosing() bool {
+	select {
+	case <-c.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// keepalive pings the peer and closes the connection once it stays idle for too long
+func (c *wsConn) keepalive(ctx context.Context) {
+	if c.pingInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if c.idleTimeout > 0 && c.activity != nil && c.activity.idle() > c.idleTimeout {
+			c.logger.Info("closing the idle websocket connection of " + c.ws.Request().RemoteAddr)
+			c.f.wsCount(func(stats *WSStats) { stats.Idle++ })
+			c.closeOnce.Do(func() { close(c.closing) })
+			c.ws.Close()
+			return
+		}
+		c.send.Lock()
+		c.ws.SetWriteDeadline(time.Now().Add(c.pingInterval))
+		c.ws.PayloadType = websocket.PingFrame
+		_, err := c.ws.Write([]byte("ping"))
+		c.ws.PayloadType = websocket.TextFrame
+		c.ws.SetWriteDeadline(time.Time{})
+		c.send.Unlock()
+		if err != nil {
+			c.logger.Error(err)
+		}
+	}
+}
+
+func (c *wsConn) respond(msg *wsMessage) {
+	c.send.Lock()
+	defer c.send.Unlock()
+	if err := websocket.JSON.Send(c.ws, msg); err != nil {
+		c.logger.Error(err)
+	}
+}
+
+func (c *wsConn) reject(msg *wsMessage, status int, code string, err error) {
+	failed(&msg.Message, &CommandError{Status: status, Code: code, Err: err})
+	c.respond(msg)
+}
+
+// serve reads the requests until the client closes the connection or breaks the protocol,
+// the requests still running are canceled before it returns unless the connection drains
+func (c *wsConn) serve(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		if c.isClosing() {
+			c.wg.Wait()
+		}
+		cancel()
+		c.wg.Wait()
+	}()
+	for {
+		msg := &wsMessage{}
+		err := websocket.JSON.Receive(c.ws, msg)
+		if c.isClosing() {
+			return
+		}
+		if err == io.EOF {
+			c.logger.Info("websocket client closed connection!")
+			return
+		}
+		if err == websocket.ErrFrameTooLarge {
+			// the rest of the frame is skipped by the next read
+			c.f.wsCount(func(stats *WSStats) { stats.TooLarge++ })
+			c.reject(&wsMessage{}, http.StatusRequestEntityTooLarge, "message_too_large", errors.New("the message is larger than the limit of the service!"))
+			continue
+		}
+		if err != nil {
+			// the connection can not be trusted after a broken frame
+			c.logger.Error(err)
+			c.reject(&wsMessage{}, http.StatusBadRequest, "protocol_error", errors.New("the message could not be read: "+err.Error()))
+			return
+		}
+		c.f.wsCount(func(stats *WSStats) { stats.Messages++ })
+		err = evmsg.Auth(&msg.Message)
+		if err != nil {
+			c.logger.Error(err)
+			c.respond(msg)
+			continue
+		}
+		if ok, wait := c.f.Allow(RateCommand, c.client); !ok {
+			c.reject(msg, http.StatusTooManyRequests, "rate_limited", RateLimitError(RateCommand, wait))
+			continue
+		}
+		if msg.Scope == "System" && msg.Command == "cancel" {
+			c.cancel(msg)
+			continue
+		}
+		select {
+		case c.pending <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		reqCtx, reqCancel := context.WithCancel(ContextWithTraceparent(ctx, msg.Traceparent))
+		if msg.RequestID != "" {
+			c.mu.Lock()
+			_, duplicate := c.cancels[msg.RequestID]
+			if !duplicate {
+				c.cancels[msg.RequestID] = reqCancel
+			}
+			c.mu.Unlock()
+			if duplicate {
+				reqCancel()
+				<-c.pending
+				c.reject(msg, http.StatusConflict, "duplicate_request", errors.New("the request <"+msg.RequestID+"> is already running!"))
+				continue
+			}
+		}
+		c.wg.Add(1)
+		go c.run(reqCtx, reqCancel, msg)
+	}
+}
+
+// run dispatches a request once a slot is free, canceled requests are answered at once
+func (c *wsConn) run(ctx context.Context, cancel context.CancelFunc, msg *wsMessage) {
+	defer func() {
+		cancel()
+		if msg.RequestID != "" {
+			c.mu.Lock()
+			delete(c.cancels, msg.RequestID)
+			c.mu.Unlock()
+		}
+		<-c.pending
+		c.wg.Done()
+	}()
+	canceled := errors.New("the request <" + msg.RequestID + "> was canceled!")
+	select {
+	case c.running <- struct{}{}:
+	case <-ctx.Done():
+		c.reject(msg, http.StatusRequestTimeout, "canceled", canceled)
+		return
+	}
+	done := make(chan *wsMessage, 1)
+	// the copy keeps msg for the answer of a cancel
+	req := msg.Message
+	go func() {
+		defer func() { <-c.running }()
+		defer func() {
+			// a panicking command fails its request instead of the service
+			if r := recover(); r != nil {
+				err := fmt.Errorf("the command <%s/%s> failed: %v", req.Scope, req.Command, r)
+				c.logger.Error(err)
+				failed(&req, &CommandError{Status: http.StatusInternalServerError, Code: "internal_error", Err: err})
+				done <- &wsMessage{Message: req, RequestID: msg.RequestID}
+			}
+		}()
+		// the websocket is authenticated as the service client
+		nMsg, err := c.f.Dispatch(ctx, c.f.WSClient, &req)
+		if err != nil {
+			c.logger.Error(err)
+		}
+		done <- &wsMessage{Message: *nMsg, RequestID: msg.RequestID}
+	}()
+	select {
+	case response := <-done:
+		c.respond(response)
+	case <-ctx.Done():
+		// the storage can not be interrupted, the result of the command is dropped
+		c.reject(msg, http.StatusRequestTimeout, "canceled", canceled)
+	}
+}
+
+// cancel stops an in-flight request of the connection
+func (c *wsConn) cancel(msg *wsMessage) {
+	id, _ := msg.Value("requestId").(string)
+	c.mu.Lock()
+	cancel, ok := c.cancels[id]
+	c.mu.Unlock()
+	if !ok {
+		c.reject(msg, http.StatusNotFound, "unknown_request", errors.New("the request <"+id+"> is not running!"))
+		return
+	}
+	cancel()
+	msg.State = "Response"
+	c.respond(msg)
+}
@@ -0,0 +1,209 @@
+package files
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"evalgo.org/evmsg"
+	echo "github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+func wsTestConn(t *testing.T, f *Files) (*websocket.Conn, func()) {
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		newWSConn(f, ws, echo.New().Logger).serve(ws.Request().Context())
+	}))
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http"), "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws, func() {
+		ws.Close()
+		server.Close()
+	}
+}
+
+func wsReceive(t *testing.T, ws *websocket.Conn) *wsMessage {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg := &wsMessage{}
+	if err := websocket.JSON.Receive(ws, msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func Test_Unit_WSConcurrentRequests(t *testing.T) {
+	release := make(chan struct{})
+	RegisterCommand(&Command{Scope: "Test", Name: "slow", Permission: PermissionRead,
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			<-release
+			return nil, nil
+		}})
+	defer func() {
+		commandsMu.Lock()
+		delete(commands, "Test/slow")
+		commandsMu.Unlock()
+	}()
+	defer close(release)
+	f := &Files{WSStorage: newMemStorage(), WSClient: "files"}
+	ws, done := wsTestConn(t, f)
+	defer done()
+
+	websocket.JSON.Send(ws, &wsMessage{Message: evmsg.Message{Scope: "Test", Command: "slow"}, RequestID: "slow-1"})
+	websocket.JSON.Send(ws, &wsMessage{Message: evmsg.Message{Scope: "Bucket", Command: "getList"}, RequestID: "list-1"})
+	if msg := wsReceive(t, ws); msg.RequestID != "list-1" || msg.State != "Response" {
+		t.Fatal("a slow request must not block the connection", msg)
+	}
+	websocket.JSON.Send(ws, &wsMessage{Message: evmsg.Message{Scope: "Test", Command: "slow"}, RequestID: "slow-1"})
+	if msg := wsReceive(t, ws); msg.RequestID != "slow-1" || msg.Value("code") != "duplicate_request" {
+		t.Error("request ids have to be unique while running", msg)
+	}
+	websocket.JSON.Send(ws, &wsMessage{Message: evmsg.Message{Scope: "System", Command: "cancel", Data: []interface{}{map[string]interface{}{"requestId": "slow-1"}}}, RequestID: "cancel-1"})
+	answers := map[string]*wsMessage{}
+	for i := 0; i < 2; i++ {
+		msg := wsReceive(t, ws)
+		answers[msg.RequestID] = msg
+	}
+	if answers["slow-1"] == nil || answers["slow-1"].Value("code") != "canceled" || answers["cancel-1"] == nil || answers["cancel-1"].Debug.Error != "" {
+		t.Error("the slow request has to be canceled", answers)
+	}
+}
+
+func Test_Unit_WSCommandPanic(t *testing.T) {
+	RegisterCommand(&Command{Scope: "Test", Name: "panic", Permission: PermissionRead,
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			var meta map[string]string
+			meta["broken"] = "yes"
+			return nil, nil
+		}})
+	defer func() {
+		commandsMu.Lock()
+		delete(commands, "Test/panic")
+		commandsMu.Unlock()
+	}()
+	f := &Files{WSStorage: newMemStorage(), WSClient: "files"}
+	ws, done := wsTestConn(t, f)
+	defer done()
+
+	websocket.JSON.Send(ws, &wsMessage{Message: evmsg.Message{Scope: "Test", Command: "panic"}, RequestID: "panic-1"})
+	if msg := wsReceive(t, ws); msg.RequestID != "panic-1" || msg.Value("code") != "internal_error" || !strings.Contains(msg.Debug.Error, "Test/panic") {
+		t.Fatal("a panicking command has to fail its request", msg)
+	}
+	websocket.JSON.Send(ws, &wsMessage{Message: evmsg.Message{Scope: "Bucket", Command: "getList"}, RequestID: "list-1"})
+	if msg := wsReceive(t, ws); msg.RequestID != "list-1" || msg.State != "Response" {
+		t.Error("the connection has to keep serving", msg)
+	}
+}
+
+func Test_Unit_WSProtocolError(t *testing.T) {
+	f := &Files{WSStorage: newMemStorage(), WSClient: "files"}
+	ws, done := wsTestConn(t, f)
+	defer done()
+	websocket.Message.Send(ws, "{not json")
+	if msg := wsReceive(t, ws); msg.Value("code") != "protocol_error" {
+		t.Error("broken messages have to be answered", msg)
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var rest string
+	if err := websocket.Message.Receive(ws, &rest); err == nil {
+		t.Error("the connection has to be closed after a protocol error", rest)
+	}
+}
+
+func Test_Unit_WSConnectionLimits(t *testing.T) {
+	origins, perClient, size := WSAllowedOrigins, WSMaxConnsPerClient, WSMaxMessageSize
+	WSAllowedOrigins, WSMaxConnsPerClient, WSMaxMessageSize = []string{"https://app.example.com"}, 1, 256
+	defer func() { WSAllowedOrigins, WSMaxConnsPerClient, WSMaxMessageSize = origins, perClient, size }()
+	f := &Files{WSStorage: newMemStorage(), WSClient: "files"}
+	server := httptest.NewServer(f.WebsocketHandler())
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	if _, err := websocket.Dial(wsURL, "", "https://evil.example.com"); err == nil {
+		t.Error("foreign origins have to be rejected")
+	}
+	ws, err := websocket.Dial(wsURL, "", "https://app.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := websocket.Dial(wsURL, "", "https://app.example.com"); err == nil {
+		t.Error("the connections of a client have to be limited")
+	}
+	websocket.Message.Send(ws, `{"scope":"Bucket","command":"getList","data":[{"padding":"`+strings.Repeat("x", 512)+`"}]}`)
+	if msg := wsReceive(t, ws); msg.Value("code") != "message_too_large" {
+		t.Error("large messages have to be rejected", msg)
+	}
+	websocket.JSON.Send(ws, &wsMessage{Message: evmsg.Message{Scope: "Bucket", Command: "getList"}, RequestID: "1"})
+	if msg := wsReceive(t, ws); msg.RequestID != "1" || msg.Debug.Error != "" {
+		t.Error("the connection has to survive a large message", msg)
+	}
+	stats := f.WebsocketStats()
+	if stats.Open != 1 || stats.Rejected != 2 || stats.TooLarge != 1 || stats.Messages != 1 {
+		t.Error("unexpected stats", stats)
+	}
+	ws.Close()
+}
+
+func Test_Unit_WSIdleAndDrain(t *testing.T) {
+	interval, idle := WSPingInterval, WSIdleTimeout
+	WSPingInterval, WSIdleTimeout = 20*time.Millisecond, 50*time.Millisecond
+	defer func() { WSPingInterval, WSIdleTimeout = interval, idle }()
+	release := make(chan struct{})
+	RegisterCommand(&Command{Scope: "Test", Name: "drain", Permission: PermissionRead,
+		Run: func(ctx context.Context, f *Files, p Params) (*evmsg.Message, error) {
+			<-release
+			return nil, nil
+		}})
+	defer func() {
+		commandsMu.Lock()
+		delete(commands, "Test/drain")
+		commandsMu.Unlock()
+	}()
+	f := &Files{WSStorage: newMemStorage(), WSClient: "files"}
+	server := httptest.NewServer(f.WebsocketHandler())
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// the raw reads of the client answer no pings
+	idleWS, err := websocket.Dial(wsURL, "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idleWS.Close()
+	time.Sleep(200 * time.Millisecond)
+	if stats := f.WebsocketStats(); stats.Idle != 1 || stats.Open != 0 {
+		t.Error("idle connections have to be closed", stats)
+	}
+
+	WSIdleTimeout = time.Minute
+	ws, err := websocket.Dial(wsURL, "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	websocket.JSON.Send(ws, &wsMessage{Message: evmsg.Message{Scope: "Test", Command: "drain"}, RequestID: "drain-1"})
+	for f.WebsocketStats().Messages < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	closed := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		closed <- f.CloseWebsockets(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if msg := wsReceive(t, ws); msg.RequestID != "drain-1" || msg.Debug.Error != "" {
+		t.Error("the requests in flight have to be answered", msg)
+	}
+	if err := <-closed; err != nil {
+		t.Error(err)
+	}
+	if _, err := websocket.Dial(wsURL, "", server.URL); err == nil {
+		t.Error("no connections are accepted while shutting down")
+	}
+}